@@ -1,11 +1,11 @@
 package adapter
 
 import (
+	"fmt"
 	"net/netip"
 	"strconv"
 	"strings"
-
-	"github.com/layou233/zbproxy/v3/common/console/color"
+	"time"
 
 	"github.com/zhangyunhao116/fastrand"
 )
@@ -27,11 +27,65 @@ type Metadata struct {
 	Minecraft           *MinecraftMetadata
 	TLS                 *TLSMetadata
 	Custom              map[string]any
+	Stats               ConnectionStats
+	// Captures are the groups captured by the matched rule, Captures[0] is the whole matched value.
+	Captures []string
 }
 
 func (m *Metadata) GenerateID() {
-	id := int64(fastrand.Int31())
-	m.ConnectionID = color.Apply(color.FgHiYellow, "["+strconv.FormatInt(id, 10)+"]")
+	m.ConnectionID = strconv.FormatInt(int64(fastrand.Int31()), 10)
+}
+
+// SetCustom sets the value of key in Custom, which is shared by the sniffers, rules and outbounds.
+func (m *Metadata) SetCustom(key string, value any) {
+	if m.Custom == nil {
+		m.Custom = make(map[string]any)
+	}
+	m.Custom[key] = value
+}
+
+// CustomString returns the value of key in Custom formatted as a string.
+func (m *Metadata) CustomString(key string) (string, bool) {
+	value, found := m.Custom[key]
+	if !found || value == nil {
+		return "", false
+	}
+	if s, isString := value.(string); isString {
+		return s, true
+	}
+	return fmt.Sprint(value), true
+}
+
+// Tags returns the string values in Custom, which are reported by the access log and metrics.
+func (m *Metadata) Tags() map[string]string {
+	var tags map[string]string
+	for key, value := range m.Custom {
+		if s, isString := value.(string); isString {
+			if tags == nil {
+				tags = make(map[string]string, len(m.Custom))
+			}
+			tags[key] = s
+		}
+	}
+	return tags
+}
+
+// ConnectionStats records how the connection is handled.
+type ConnectionStats struct {
+	StartTime time.Time
+	// RuleIndex is the index of the rule deciding the outbound,
+	// or -1 if the connection goes to the default outbound.
+	RuleIndex   int
+	Outbound    string
+	Upload      int64
+	Download    int64
+	CloseReason error
+}
+
+// AddTraffic adds relayed bytes to the stats.
+func (s *ConnectionStats) AddTraffic(upload, download int64) {
+	s.Upload += upload
+	s.Download += download
 }
 
 type MinecraftMetadata struct {
@@ -54,6 +108,32 @@ func (m *MinecraftMetadata) CleanOriginDestination() string {
 	return strings.TrimSuffix(m.OriginDestination, "\x00FML\x00")
 }
 
+// UUIDString returns the player UUID in the hyphenated form,
+// or an empty string if the client does not provide it.
+func (m *MinecraftMetadata) UUIDString() string {
+	if m.UUID == [16]byte{} {
+		return ""
+	}
+	const hexTable = "0123456789abcdef"
+	var dst [36]byte
+	dst[8] = '-'
+	dst[13] = '-'
+	dst[18] = '-'
+	dst[23] = '-'
+	for i, x := range [16]byte{
+		0, 2, 4, 6,
+		9, 11,
+		14, 16,
+		19, 21,
+		24, 26, 28, 30, 32, 34,
+	} {
+		c := m.UUID[i]
+		dst[x] = hexTable[c>>4]
+		dst[x+1] = hexTable[c&0x0F]
+	}
+	return string(dst[:])
+}
+
 type TLSMetadata struct {
 	SNI string
 }
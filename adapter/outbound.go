@@ -20,4 +20,16 @@ type InjectOutbound interface {
 	InjectConnection(ctx context.Context, conn *bufio.CachedConn, metadata *Metadata) error
 }
 
+// DrainOutbound is implemented by outbounds which reject new players
+// with a message when shutting down.
+type DrainOutbound interface {
+	Drain(message string)
+}
+
+// InheritOutbound is implemented by outbounds which take over
+// the state of the outbound with the same name when reloading.
+type InheritOutbound interface {
+	Inherit(old Outbound)
+}
+
 var ErrInjectionRequired = errors.New("injection required")
@@ -10,6 +10,31 @@ import (
 type Service interface {
 	Start(ctx context.Context) error
 	Reload(ctx context.Context, newConfig *config.Service) error
+	// PrepareReload loads newConfig with router and binds the listener if needed,
+	// without changing the running service.
+	PrepareReload(ctx context.Context, newConfig *config.Service, router Router) (ServiceReload, error)
 	UpdateRouter(router Router)
+	// Shutdown stops accepting and waits for active connections to finish
+	// until ctx is done, then closes the remaining connections.
+	Shutdown(ctx context.Context) error
 	io.Closer
 }
+
+// ServiceReload is a reload prepared by Service.PrepareReload,
+// it must be either applied or discarded.
+type ServiceReload interface {
+	// Apply applies the reload. It only fails if RebindsInPlace and the listener can not be bound,
+	// then the service keeps running with the old config.
+	Apply() error
+	// RebindsInPlace reports whether Apply has to close the listener and bind it again,
+	// since the socket options are changed on the same port.
+	RebindsInPlace() bool
+	Discard()
+}
+
+// DrainService is implemented by services owning outbounds,
+// such as the legacy Minecraft outbound, which should reject new players when shutting down.
+type DrainService interface {
+	Service
+	Drain(message string)
+}
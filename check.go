@@ -0,0 +1,89 @@
+package zbproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/event"
+	"github.com/layou233/zbproxy/v3/geoip"
+	"github.com/layou233/zbproxy/v3/list"
+	"github.com/layou233/zbproxy/v3/service"
+
+	"github.com/phuslu/log"
+)
+
+// CheckConfig initializes all the outbounds, lists, GeoIP databases, rules and services of the config
+// without listening, and returns the first error.
+// The config is read from options.ConfigFilePath if options.Config is nil.
+func CheckConfig(ctx context.Context, options Options) error {
+	newConfig := options.Config
+	if newConfig == nil {
+		if options.ConfigFilePath == "" {
+			return errors.New("no config provided for zbproxy")
+		}
+		var err error
+		newConfig, err = config.ReadConfigFromFile(options.ConfigFilePath)
+		if err != nil {
+			return common.Cause("load config: ", err)
+		}
+	}
+	logger := &log.Logger{
+		Writer: &log.IOWriter{Writer: io.Discard},
+	}
+
+	if newConfig.AccessLog != nil && newConfig.AccessLog.Path == "" {
+		return errors.New("access log path is empty")
+	}
+	if newConfig.Metrics != nil {
+		_, err := net.ResolveTCPAddr("tcp", newConfig.Metrics.Listen)
+		if err != nil {
+			return common.Cause("bad metrics listen address: ", err)
+		}
+	}
+	err := event.CheckConfig(newConfig.Events)
+	if err != nil {
+		return common.Cause("check event sinks: ", err)
+	}
+
+	listProviders, err := list.NewManager(ctx, logger, nil).Prepare(newConfig.ListProviders)
+	if err != nil {
+		return err
+	}
+	geoIPDatabases, err := geoip.NewManager(ctx, logger).Prepare(newConfig.GeoIP)
+	if err != nil {
+		return err
+	}
+
+	_, router, err := buildRouting(routingOptions{
+		ctx:             ctx,
+		outboundLogger:  logger,
+		routerLogger:    logger,
+		config:          newConfig,
+		listMap:         listProviders.Merge(newConfig.Lists),
+		geoIP:           geoIPDatabases,
+		ruleRegistry:    options.RuleRegistry,
+		snifferRegistry: options.SnifferRegistry,
+	})
+	if err != nil {
+		return err
+	}
+
+	serviceNames := make(map[string]bool, len(newConfig.Services))
+	for _, serviceConfig := range newConfig.Services {
+		if serviceNames[serviceConfig.Name] {
+			return errors.New("duplicated service [" + serviceConfig.Name + "]")
+		}
+		serviceNames[serviceConfig.Name] = true
+		newService := service.NewService(logger, nil, serviceConfig)
+		newService.UpdateRouter(router)
+		err = newService.Check()
+		if err != nil {
+			return common.Cause("check service ["+serviceConfig.Name+"]: ", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package zbproxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+	// checking does not listen, so a port in use is fine
+	busyListener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busyListener.Close()
+	busyPort := strconv.Itoa(busyListener.Addr().(*net.TCPAddr).Port)
+
+	for _, testCase := range []struct {
+		name    string
+		content string
+		err     string // empty if no error is expected
+	}{
+		{
+			name: "valid",
+			content: `{
+  "Services": [{"Name": "mc", "Listen": ` + busyPort + `, "IPAccess": {"Mode": "block", "ListTags": ["banned"]}}],
+  "Router": {
+    "DefaultOutbound": "lobby",
+    "Rules": [{"Type": "MinecraftPlayerName", "Parameter": "admins", "Outbound": "REJECT", "Invert": true}]
+  },
+  "Outbounds": [{"Name": "lobby", "TargetAddress": "127.0.0.1", "TargetPort": 25566}],
+  "Lists": {"banned": ["192.0.2.1"], "admins": ["Steve"]}
+}`,
+		},
+		{
+			name:    "unknown rule type",
+			content: `{"Router": {"Rules": [{"Type": "NoSuchRule", "Outbound": "REJECT"}]}}`,
+			err:     "initialize router: ",
+		},
+		{
+			name:    "unknown default outbound",
+			content: `{"Router": {"DefaultOutbound": "missing"}}`,
+			err:     "initialize router: ",
+		},
+		{
+			name:    "duplicated outbound",
+			content: `{"Outbounds": [{"Name": "a"}, {"Name": "a"}]}`,
+			err:     "outbound [a] is already defined",
+		},
+		{
+			name:    "duplicated service",
+			content: `{"Services": [{"Name": "a", "Listen": 25565}, {"Name": "a", "Listen": 25566}]}`,
+			err:     "service [a] is already defined",
+		},
+		{
+			name:    "service with an unknown access list",
+			content: `{"Services": [{"Name": "mc", "Listen": 25565, "IPAccess": {"Mode": "allow", "ListTags": ["missing"]}}]}`,
+			err:     "check service [mc]: load access control lists: ",
+		},
+		{
+			name: "service with exclusive legacy modes",
+			content: `{"Services": [{"Name": "mc", "Listen": 25565,
+  "Minecraft": {"PingMode": "disconnect"}, "TLSSniffing": {"RejectNonTLS": true}}]}`,
+			err: "check service [mc]: Minecraft and TLSSniffing are mutually exclusive",
+		},
+		{
+			name:    "bad metrics address",
+			content: `{"Metrics": {"Listen": "localhost:http-alt-x"}}`,
+			err:     "bad metrics listen address: ",
+		},
+		{
+			name:    "bad webhook",
+			content: `{"Events": {"Webhooks": [{"URL": "ftp://example.com"}]}}`,
+			err:     "check event sinks: ",
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "zbproxy.json")
+		err = os.WriteFile(path, []byte(testCase.content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckConfig(context.Background(), Options{ConfigFilePath: path})
+		if testCase.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", testCase.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("%s: got error %v, want %q", testCase.name, err, testCase.err)
+		}
+	}
+
+	err = CheckConfig(context.Background(), Options{ConfigFilePath: filepath.Join(t.TempDir(), "missing.json")})
+	if err == nil {
+		t.Error("checking a missing config file succeeds")
+	}
+
+	// the config provided directly is not merged by the loader
+	err = CheckConfig(context.Background(), Options{Config: &config.Root{
+		Services: []*config.Service{{Name: "a", Listen: 25565}, {Name: "a", Listen: 25566}},
+	}})
+	if err == nil || err.Error() != "duplicated service [a]" {
+		t.Errorf("got error %v, want duplicated service", err)
+	}
+	err = CheckConfig(context.Background(), Options{Config: &config.Root{
+		Outbounds: []*config.Outbound{{Name: "a"}, {Name: "a"}},
+	}})
+	if err == nil || err.Error() != "duplicated outbound [a]" {
+		t.Errorf("got error %v, want duplicated outbound", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/layou233/zbproxy/v3"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/version"
+)
+
+func commandCheck(args []string) error {
+	flagSet := newFlagSet("check")
+	configPath := flagSet.String("c", defaultConfigPath, "config file or directory path")
+	flagSet.Parse(args)
+
+	err := zbproxy.CheckConfig(context.Background(), zbproxy.Options{
+		ConfigFilePath: *configPath,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Config is valid: " + *configPath)
+	return nil
+}
+
+func commandFormat(args []string) error {
+	flagSet := newFlagSet("format")
+	configPath := flagSet.String("c", defaultConfigPath, "config file path")
+	flagSet.Parse(args)
+
+	return config.FormatConfigFile(*configPath)
+}
+
+func commandSchema(args []string) error {
+	flagSet := newFlagSet("schema")
+	outputPath := flagSet.String("o", "", "output file path, stdout if empty")
+	flagSet.Parse(args)
+
+	schema, err := config.GenerateSchema()
+	if err != nil {
+		return err
+	}
+	schema = append(schema, '\n')
+	if *outputPath == "" {
+		_, err = os.Stdout.Write(schema)
+		return err
+	}
+	return os.WriteFile(*outputPath, schema, 0o644)
+}
+
+func commandVersion() {
+	fmt.Printf("zbproxy %s\n", version.Version)
+	fmt.Printf("%s, %s/%s, CGO %s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH, common.CGOHint)
+}
+
+func commandReload(args []string) error {
+	flagSet := newFlagSet("reload")
+	pidFilePath := flagSet.String("pid-file", "", "the PID file written by the run command")
+	pid := flagSet.Int("pid", 0, "the process ID of zbproxy")
+	flagSet.Parse(args)
+
+	if *pid == 0 {
+		if *pidFilePath == "" {
+			return errors.New("-pid or -pid-file is required")
+		}
+		var err error
+		*pid, err = readPIDFile(*pidFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	process, err := os.FindProcess(*pid)
+	if err != nil {
+		return err
+	}
+	err = process.Signal(syscall.SIGHUP)
+	if err != nil {
+		return common.Cause("signal process "+strconv.Itoa(*pid)+": ", err)
+	}
+	return nil
+}
+
+func writePIDFile(path string) error {
+	err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+	if err != nil {
+		return common.Cause("write PID file: ", err)
+	}
+	return nil
+}
+
+func readPIDFile(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, common.Cause("read PID file: ", err)
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(content)))
+	if err != nil {
+		return 0, common.Cause("bad PID file: ", err)
+	}
+	return pid, nil
+}
+
+// removePIDFile removes the PID file only if it is written by this process,
+// since the new process after upgrading writes the same file.
+func removePIDFile(path string) {
+	pid, err := readPIDFile(path)
+	if err == nil && pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
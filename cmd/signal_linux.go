@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal triggers a zero-downtime upgrade.
+var upgradeSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// upgradeSignal is nil since upgrading is only supported on Linux.
+var upgradeSignal os.Signal
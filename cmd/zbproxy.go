@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -15,39 +16,139 @@ import (
 	"github.com/layou233/zbproxy/v3/version"
 )
 
+const defaultConfigPath = "zbproxy.json"
+
+const usage = `Usage: zbproxy [command] [flags]
+
+Commands:
+  run      Run zbproxy (default)
+  check    Check the config without listening
+  format   Rewrite the config in the canonical format
+  schema   Print the JSON Schema of the config
+  version  Print the version
+  reload   Reload the config of a running zbproxy
+
+Run "zbproxy <command> -h" for the flags of a command.
+`
+
 func main() {
-	console.SetTitle(fmt.Sprintf("zbproxy %v | running...", version.Version))
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		command = args[0]
+		args = args[1:]
+	}
+
+	var err error
+	switch command {
+	case "run":
+		err = commandRun(args)
+	case "check":
+		err = commandCheck(args)
+	case "format":
+		err = commandFormat(args)
+	case "schema":
+		err = commandSchema(args)
+	case "version":
+		commandVersion()
+	case "reload":
+		err = commandReload(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, color.Apply(color.FgHiRed, "Error: "+err.Error()))
+		os.Exit(1)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("zbproxy "+name, flag.ExitOnError)
+}
+
+func printBanner() {
 	fmt.Printf(color.Apply(color.FgHiGreen, "VCMCS forked zbproxy %s\n"), version.Version)
 	fmt.Printf(color.Apply(color.FgHiGreen, "Build Information: %s, %s/%s, CGO %s\n"),
 		runtime.Version(), runtime.GOOS, runtime.GOARCH, common.CGOHint)
+}
+
+func commandRun(args []string) error {
+	flagSet := newFlagSet("run")
+	configPath := flagSet.String("c", defaultConfigPath, "config file or directory path (.json, .yaml, .yml or .toml)")
+	pidFilePath := flagSet.String("pid-file", "", "write the process ID to the file, used by the reload command")
+	disableReload := flagSet.Bool("disable-reload", false, "do not watch and reload the config file")
+	flagSet.Parse(args)
+
+	console.SetTitle(fmt.Sprintf("zbproxy %v | running...", version.Version))
+	printBanner()
 	// go version.CheckUpdate()
 
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	instance, err := zbproxy.NewInstance(ctx, zbproxy.Options{
-		ConfigFilePath: "zbproxy.json",
-		DisableReload:  false,
+		ConfigFilePath: *configPath,
+		DisableReload:  *disableReload,
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = instance.Start()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if *pidFilePath != "" {
+		err = writePIDFile(*pidFilePath)
+		if err != nil {
+			return err
+		}
+		defer removePIDFile(*pidFilePath)
 	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGHUP, os.Interrupt)
+	signal.Notify(signalChan, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	if upgradeSignal != nil {
+		signal.Notify(signalChan, upgradeSignal)
+	}
 	for {
 		select {
 		case s := <-signalChan:
 			switch s {
 			case syscall.SIGHUP:
 				instance.Reload()
-			case os.Interrupt:
+			case os.Interrupt, syscall.SIGTERM:
+				shutdown(instance, signalChan)
+				return nil
+			case upgradeSignal:
+				err = instance.Upgrade()
+				if err != nil {
+					instance.Logger().Error().
+						Err(err).
+						Msg("Error when upgrading")
+					continue
+				}
+				shutdown(instance, signalChan)
+				return nil
+			}
+		}
+	}
+}
+
+// shutdown shuts down the instance gracefully,
+// another interrupt or termination signal skips the draining.
+func shutdown(instance *zbproxy.Instance, signalChan <-chan os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for s := range signalChan {
+			if s == os.Interrupt || s == syscall.SIGTERM {
 				cancel()
 				return
 			}
 		}
-	}
+	}()
+	instance.Shutdown(ctx)
 }
@@ -0,0 +1,67 @@
+package access
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/common/set"
+
+	"go4.org/netipx"
+)
+
+// AddIPToBuilder adds an IP address or a CIDR prefix to builder.
+// IPv4-mapped IPv6 addresses and prefixes are unmapped, and zones are removed,
+// so that they match the addresses normalized by NormalizeIP.
+func AddIPToBuilder(builder *netipx.IPSetBuilder, s string) error {
+	// modified from netipx.ParsePrefixOrAddr
+	i := strings.LastIndexByte(s, '/')
+	if i < 0 {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return err
+		}
+		builder.Add(NormalizeIP(addr))
+	} else {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		builder.AddPrefix(prefix.Masked())
+	}
+	return nil
+}
+
+// NormalizeIP unmaps IPv4-mapped IPv6 addresses and removes the zone.
+func NormalizeIP(addr netip.Addr) netip.Addr {
+	return addr.Unmap().WithZone("")
+}
+
+// NewIPSet builds an IP set from lists of IP addresses and CIDR prefixes.
+func NewIPSet(lists []set.StringSet) (*netipx.IPSet, error) {
+	var builder netipx.IPSetBuilder
+	for _, list := range lists {
+		for item := range list {
+			err := AddIPToBuilder(&builder, item)
+			if err != nil {
+				return nil, fmt.Errorf("bad IP address or CIDR [%s]: %w", item, err)
+			}
+		}
+	}
+	return builder.IPSet()
+}
+
+// CheckIP checks if addr passes the access control.
+func CheckIP(ipSet *netipx.IPSet, mode string, addr netip.Addr) bool {
+	hit := ipSet.Contains(NormalizeIP(addr))
+	switch mode {
+	case AllowMode:
+		return hit
+	case BlockMode:
+		return !hit
+	}
+	panic("bad access mode")
+}
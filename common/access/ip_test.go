@@ -0,0 +1,45 @@
+package access
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/common/set"
+)
+
+func TestCheckIP(t *testing.T) {
+	ipSet, err := NewIPSet([]set.StringSet{
+		set.NewStringSetFromSlice([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}),
+		set.NewStringSetFromSlice([]string{"::ffff:198.51.100.0/120", "::ffff:203.0.113.7"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		addr string
+		hit  bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"fe80::1%eth0", false},
+		{"198.51.100.42", true},
+		{"203.0.113.7", true},
+	} {
+		addr := netip.MustParseAddr(testCase.addr)
+		if CheckIP(ipSet, BlockMode, addr) == testCase.hit {
+			t.Errorf("block mode, address %s, expected hit=%v", testCase.addr, testCase.hit)
+		}
+		if CheckIP(ipSet, AllowMode, addr) != testCase.hit {
+			t.Errorf("allow mode, address %s, expected hit=%v", testCase.addr, testCase.hit)
+		}
+	}
+
+	_, err = NewIPSet([]set.StringSet{set.NewStringSetFromSlice([]string{"not-an-ip"})})
+	if err == nil {
+		t.Error("expected error for bad IP")
+	}
+}
@@ -12,20 +12,27 @@ import (
 )
 
 func CopyConn(remote net.Conn, local net.Conn) error {
+	_, _, err := CopyConnCounted(remote, local)
+	return err
+}
+
+// CopyConnCounted likes CopyConn, but also returns the number of bytes
+// copied from local to remote (upload) and from remote to local (download).
+func CopyConnCounted(remote net.Conn, local net.Conn) (upload, download int64, err error) {
 	done := make(chan struct{})
 	var errLocal, errRemote error
 	go func() {
-		_, errRemote = CopyBuffer(local, remote, nil)
+		download, errRemote = CopyBuffer(local, remote, nil)
 		local.Close()
 		close(done)
 	}()
-	_, errLocal = CopyBuffer(remote, local, nil)
+	upload, errLocal = CopyBuffer(remote, local, nil)
 	remote.Close()
 	<-done
 	if errLocal != nil || errRemote != nil {
-		return fmt.Errorf("relay connnections: download: %w | upload: %w", errRemote, errLocal)
+		err = fmt.Errorf("relay connnections: download: %w | upload: %w", errRemote, errLocal)
 	}
-	return nil
+	return
 }
 
 func Copy(destination io.Writer, source io.Reader) (written int64, err error) {
@@ -41,7 +48,9 @@ func CopyBuffer(destination io.Writer, source io.Reader, buffer *buf.Buffer) (wr
 				cachedConn.Release()
 				continue
 			}
-			written, err = cachedConn.cache.WriteTo(destination)
+			var _written int64
+			_written, err = cachedConn.cache.WriteTo(destination)
+			written += _written
 			if err != nil {
 				return
 			}
@@ -0,0 +1,36 @@
+package domain
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CompileGlob compiles a domain glob pattern to a regular expression matching the whole domain.
+// "*" matches any characters in a single label, "**" matches any characters including dots,
+// and "?" matches a single character. Each of them is a capture group.
+func CompileGlob(pattern string) (*regexp.Regexp, error) {
+	var builder strings.Builder
+	builder.Grow(len(pattern) + 16)
+	builder.WriteByte('^')
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				builder.WriteString("(.*)")
+				i++
+			} else {
+				builder.WriteString("([^.]*)")
+			}
+		case '?':
+			builder.WriteString("([^.])")
+		default:
+			start := i
+			for i+1 < len(pattern) && pattern[i+1] != '*' && pattern[i+1] != '?' {
+				i++
+			}
+			builder.WriteString(regexp.QuoteMeta(pattern[start : i+1]))
+		}
+	}
+	builder.WriteByte('$')
+	return regexp.Compile(builder.String())
+}
@@ -0,0 +1,47 @@
+package domain
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	for _, testCase := range []struct {
+		pattern  string
+		domain   string
+		captures []string // nil if not matched
+	}{
+		{"*.eu.example.net", "play.eu.example.net", []string{"play"}},
+		{"*.eu.example.net", "a.b.eu.example.net", nil},
+		{"*.eu.example.net", "eu.example.net", nil},
+		{"**.example.net", "a.b.example.net", []string{"a.b"}},
+		{"play-??-*.example.net", "play-eu-3.example.net", []string{"e", "u", "3"}},
+		{"play-??-*.example.net", "play-e.-3.example.net", nil},
+		{"*.mc.example.net", "partner.mc.example.net", []string{"partner"}},
+		{"example.net", "exampleXnet", nil},
+		{"(x).example.net", "(x).example.net", []string{}},
+	} {
+		regex, err := CompileGlob(testCase.pattern)
+		if err != nil {
+			t.Fatalf("compile %s: %v", testCase.pattern, err)
+		}
+		match := regex.FindStringSubmatch(testCase.domain)
+		if testCase.captures == nil {
+			if match != nil {
+				t.Errorf("%s matches %s", testCase.pattern, testCase.domain)
+			}
+			continue
+		}
+		if match == nil {
+			t.Errorf("%s does not match %s", testCase.pattern, testCase.domain)
+			continue
+		}
+		if len(match)-1 != len(testCase.captures) {
+			t.Errorf("%s on %s: got captures %q, want %q", testCase.pattern, testCase.domain, match[1:], testCase.captures)
+			continue
+		}
+		for i, capture := range testCase.captures {
+			if match[i+1] != capture {
+				t.Errorf("%s on %s: got captures %q, want %q", testCase.pattern, testCase.domain, match[1:], testCase.captures)
+				break
+			}
+		}
+	}
+}
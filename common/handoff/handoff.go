@@ -0,0 +1,99 @@
+// Package handoff passes listening sockets to a newly executed process,
+// so that zbproxy can be upgraded without refusing new connections.
+package handoff
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	listenersEnv = "ZBPROXY_LISTENER_FDS"
+	readyEnv     = "ZBPROXY_READY_FD"
+)
+
+var ErrUnsupported = errors.New("listener handoff is not supported on this platform")
+
+var (
+	access    sync.Mutex
+	loadOnce  sync.Once
+	inherited map[string]*net.TCPListener
+)
+
+// loadInherited parses the listeners passed by the parent process.
+// The environment looks like "key=3,key=4".
+func loadInherited() {
+	inherited = make(map[string]*net.TCPListener)
+	value := os.Getenv(listenersEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(listenersEnv)
+	for _, item := range strings.Split(value, ",") {
+		separator := strings.LastIndexByte(item, '=')
+		if separator < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(item[separator+1:])
+		if err != nil || fd < 3 {
+			continue
+		}
+		file := os.NewFile(uintptr(fd), item[:separator])
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			continue
+		}
+		if tcpListener, isTCP := listener.(*net.TCPListener); isTCP {
+			inherited[item[:separator]] = tcpListener
+		} else {
+			listener.Close()
+		}
+	}
+}
+
+// Listener takes the listener inherited from the parent process by key.
+// Every inherited listener can only be taken once.
+func Listener(key string) (*net.TCPListener, bool) {
+	loadOnce.Do(loadInherited)
+	access.Lock()
+	defer access.Unlock()
+	listener, ok := inherited[key]
+	if ok {
+		delete(inherited, key)
+	}
+	return listener, ok
+}
+
+// CloseUnused closes all the inherited listeners that are not taken.
+func CloseUnused() {
+	loadOnce.Do(loadInherited)
+	access.Lock()
+	defer access.Unlock()
+	for key, listener := range inherited {
+		listener.Close()
+		delete(inherited, key)
+	}
+}
+
+// Ready notifies the parent process that this process is started,
+// so the parent can stop accepting and begin draining.
+// It does nothing if the process is not started by Upgrade.
+func Ready() {
+	value := os.Getenv(readyEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 3 {
+		return
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	file.Write([]byte{1})
+	file.Close()
+}
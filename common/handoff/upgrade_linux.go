@@ -0,0 +1,87 @@
+package handoff
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common"
+)
+
+// Upgrade executes the current executable again with the same arguments,
+// and passes the listeners to it by key.
+// It returns the pid after the new process calls Ready, or kills it if timeout.
+func Upgrade(listeners map[string]*net.TCPListener, timeout time.Duration) (pid int, err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, common.Cause("find executable: ", err)
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	fds := make([]string, 0, len(listeners))
+	for key, listener := range listeners {
+		var file *os.File
+		file, err = listener.File()
+		if err != nil {
+			return 0, common.Cause("duplicate listener ["+key+"]: ", err)
+		}
+		// ExtraFiles starts from fd 3
+		fds = append(fds, key+"="+strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, common.Cause("create ready pipe: ", err)
+	}
+	defer readyReader.Close()
+	files = append(files, readyWriter)
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, item := range os.Environ() {
+		if !strings.HasPrefix(item, listenersEnv+"=") && !strings.HasPrefix(item, readyEnv+"=") {
+			env = append(env, item)
+		}
+	}
+	env = append(env,
+		listenersEnv+"="+strings.Join(fds, ","),
+		readyEnv+"="+strconv.Itoa(3+len(files)-1),
+	)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	if err != nil {
+		return 0, common.Cause("start new process: ", err)
+	}
+	// close our write end, so reading gets EOF if the new process exits
+	readyWriter.Close()
+	files = files[:len(files)-1]
+
+	readyReader.SetReadDeadline(time.Now().Add(timeout))
+	var ready [1]byte
+	_, err = readyReader.Read(ready[:])
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, errors.New("new process is not ready in " + timeout.String())
+		}
+		return 0, errors.New("new process exited before ready")
+	}
+	pid = cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
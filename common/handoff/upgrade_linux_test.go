@@ -0,0 +1,82 @@
+package handoff
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	childEnv    = "ZBPROXY_HANDOFF_TEST_CHILD"
+	listenerKey = "test"
+	childReply  = "from child"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) != "" {
+		os.Exit(runChild())
+	}
+	os.Exit(m.Run())
+}
+
+// runChild is the process executed by Upgrade,
+// it replies to one connection on the inherited listener.
+func runChild() int {
+	listener, ok := Listener(listenerKey)
+	if !ok {
+		return 2
+	}
+	CloseUnused()
+	Ready()
+	listener.SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := listener.Accept()
+	if err != nil {
+		return 3
+	}
+	conn.Write([]byte(childReply))
+	conn.Close()
+	listener.Close()
+	return 0
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Setenv(childEnv, "1")
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+
+	_, err = Upgrade(map[string]*net.TCPListener{listenerKey: listener}, 10*time.Second)
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+	// the child keeps accepting on the same socket after the parent closes its copy
+	listener.Close()
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != childReply {
+		t.Fatalf("got reply %q, want %q", reply, childReply)
+	}
+}
+
+func TestUpgradeNotReady(t *testing.T) {
+	t.Setenv(childEnv, "1")
+	// the child exits without calling Ready since no listener is passed
+	_, err := Upgrade(nil, 10*time.Second)
+	if err == nil {
+		t.Fatal("Upgrade succeeded without the new process being ready")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package handoff
+
+import (
+	"net"
+	"time"
+)
+
+func Upgrade(map[string]*net.TCPListener, time.Duration) (int, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,71 @@
+// Package logging contains log writers shared by zbproxy loggers.
+package logging
+
+import (
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+type FileOptions struct {
+	Path       string
+	MaxSize    int64 // in bytes, 0 means no size-based rotation
+	MaxBackups int
+	// RotateInterval rotates the log file periodically if it is positive.
+	RotateInterval time.Duration
+}
+
+// FileWriter is a log.FileWriter which can also be rotated by time.
+type FileWriter struct {
+	log.FileWriter
+	done chan struct{}
+}
+
+var _ log.Writer = (*FileWriter)(nil)
+
+func NewFileWriter(options FileOptions) *FileWriter {
+	w := &FileWriter{
+		FileWriter: log.FileWriter{
+			Filename:     options.Path,
+			MaxSize:      options.MaxSize,
+			MaxBackups:   options.MaxBackups,
+			FileMode:     0o644,
+			LocalTime:    true,
+			EnsureFolder: true,
+		},
+		done: make(chan struct{}),
+	}
+	if options.RotateInterval > 0 {
+		go w.rotateLoop(options.RotateInterval)
+	}
+	return w
+}
+
+func (w *FileWriter) rotateLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Rotate()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Open creates the log file now instead of on the first write,
+// so that errors can be reported early.
+func (w *FileWriter) Open() error {
+	_, err := w.FileWriter.Write(nil)
+	return err
+}
+
+func (w *FileWriter) Close() error {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	return w.FileWriter.Close()
+}
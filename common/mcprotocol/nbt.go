@@ -0,0 +1,128 @@
+package mcprotocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+
+	"github.com/layou233/zbproxy/v3/common/buf"
+)
+
+// NBT tag types used by text components.
+const (
+	tagEnd      = 0
+	tagByte     = 1
+	tagString   = 8
+	tagList     = 9
+	tagCompound = 10
+)
+
+var errNBTStringTooLong = errors.New("NBT string too long")
+
+// WriteNBTMessage writes m as a network NBT text component,
+// which replaces JSON text components in the play state since 1.20.3.
+func WriteNBTMessage(buffer *buf.Buffer, m Message) error {
+	buffer.WriteByte(tagCompound) // network NBT has no root name since 1.20.2
+	return writeNBTMessagePayload(buffer, m)
+}
+
+func writeNBTMessagePayload(buffer *buf.Buffer, m Message) error {
+	texts := []struct {
+		name  string
+		value string
+	}{
+		{"font", m.Font},
+		{"color", m.Color},
+		{"insertion", m.Insertion},
+		{"translate", m.Translate},
+	}
+	if m.Text != "" || m.Translate == "" {
+		err := writeNBTString(buffer, "text", m.Text)
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range texts {
+		if s.value != "" {
+			err := writeNBTString(buffer, s.name, s.value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, b := range []struct {
+		name  string
+		value bool
+	}{
+		{"bold", m.Bold},
+		{"italic", m.Italic},
+		{"underlined", m.UnderLined},
+		{"strikethrough", m.StrikeThrough},
+		{"obfuscated", m.Obfuscated},
+	} {
+		if b.value {
+			buffer.WriteByte(tagByte)
+			writeMUTF8(buffer, b.name)
+			buffer.WriteByte(1)
+		}
+	}
+	for _, list := range []struct {
+		name     string
+		messages []Message
+	}{
+		{"with", m.With},
+		{"extra", m.Extra},
+	} {
+		if len(list.messages) == 0 {
+			continue
+		}
+		buffer.WriteByte(tagList)
+		writeMUTF8(buffer, list.name)
+		buffer.WriteByte(tagCompound)
+		binary.BigEndian.PutUint32(buffer.Extend(4), uint32(len(list.messages)))
+		for _, message := range list.messages {
+			err := writeNBTMessagePayload(buffer, message)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return buffer.WriteByte(tagEnd)
+}
+
+func writeNBTString(buffer *buf.Buffer, name string, value string) error {
+	buffer.WriteByte(tagString)
+	err := writeMUTF8(buffer, name)
+	if err != nil {
+		return err
+	}
+	return writeMUTF8(buffer, value)
+}
+
+// writeMUTF8 writes s in the modified UTF-8 of Java with the uint16 length prefix.
+func writeMUTF8(buffer *buf.Buffer, s string) error {
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == 0:
+			encoded = append(encoded, 0xC0, 0x80)
+		case r < 0x80:
+			encoded = append(encoded, byte(r))
+		case r < 0x800:
+			encoded = append(encoded, 0xC0|byte(r>>6), 0x80|byte(r&0x3F))
+		case r < 0x10000:
+			encoded = append(encoded, 0xE0|byte(r>>12), 0x80|byte(r>>6&0x3F), 0x80|byte(r&0x3F))
+		default: // surrogate pairs are encoded separately
+			high, low := utf16.EncodeRune(r)
+			for _, c := range []rune{high, low} {
+				encoded = append(encoded, 0xE0|byte(c>>12), 0x80|byte(c>>6&0x3F), 0x80|byte(c&0x3F))
+			}
+		}
+	}
+	if len(encoded) > 0xFFFF {
+		return errNBTStringTooLong
+	}
+	binary.BigEndian.PutUint16(buffer.Extend(2), uint16(len(encoded)))
+	_, err := buffer.Write(encoded)
+	return err
+}
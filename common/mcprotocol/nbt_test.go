@@ -0,0 +1,33 @@
+package mcprotocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/common/buf"
+)
+
+func TestWriteNBTMessage(t *testing.T) {
+	buffer := buf.New()
+	defer buffer.Release()
+	err := WriteNBTMessage(buffer, Message{
+		Text:  "\x00é",
+		Bold:  true,
+		Extra: []Message{{Text: "😀"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		tagCompound,
+		tagString, 0, 4, 't', 'e', 'x', 't', 0, 4, 0xC0, 0x80, 0xC3, 0xA9,
+		tagByte, 0, 4, 'b', 'o', 'l', 'd', 1,
+		tagList, 0, 5, 'e', 'x', 't', 'r', 'a', tagCompound, 0, 0, 0, 1,
+		tagString, 0, 4, 't', 'e', 'x', 't', 0, 6, 0xED, 0xA0, 0xBD, 0xED, 0xB8, 0x80,
+		tagEnd,
+		tagEnd,
+	}
+	if !bytes.Equal(buffer.Bytes(), expected) {
+		t.Fatalf("got %v, expect %v", buffer.Bytes(), expected)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DialSuccess = "success"
+	DialFailure = "failure"
+
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+// Reasons of access control rejections.
+const (
+	RejectServiceIP          = "service_ip"
+	RejectMinecraftHostname  = "minecraft_hostname"
+	RejectMinecraftName      = "minecraft_name"
+	RejectMinecraftOnlineMax = "minecraft_online_max"
+	RejectRule               = "rule"
+)
+
+var (
+	ServiceConnections = NewCounterVec("zbproxy_service_connections_total",
+		"Total number of connections accepted by service.", "service")
+	RuleMatches = NewCounterVec("zbproxy_rule_matches_total",
+		"Total number of router rule matches by rule index.", "rule")
+	OutboundDials = NewCounterVec("zbproxy_outbound_dials_total",
+		"Total number of outbound dials by result.", "outbound", "result")
+	OutboundDialDuration = NewHistogramVec("zbproxy_outbound_dial_duration_seconds",
+		"Latency of successful outbound dials.", nil, "outbound")
+	OutboundBytes = NewCounterVec("zbproxy_outbound_bytes_total",
+		"Total number of bytes relayed by outbound and direction.", "outbound", "direction")
+	MinecraftOnlinePlayers = NewGaugeVec("zbproxy_minecraft_online_players",
+		"Current number of online players by Minecraft outbound.", "outbound")
+	SniffFailures = NewCounterVec("zbproxy_sniff_failures_total",
+		"Total number of failed protocol sniffs.", "protocol")
+	AccessRejections = NewCounterVec("zbproxy_access_rejections_total",
+		"Total number of connections rejected by access control.", "reason")
+	ConnectionTags = NewCounterVec("zbproxy_connection_tags_total",
+		"Total number of finished connections by tag, only for the keys in config.", "key", "value")
+)
+
+func init() {
+	DefaultRegistry.MustRegister(
+		ServiceConnections,
+		RuleMatches,
+		OutboundDials,
+		OutboundDialDuration,
+		OutboundBytes,
+		MinecraftOnlinePlayers,
+		SniffFailures,
+		AccessRejections,
+		ConnectionTags,
+	)
+}
+
+// ObserveDial records the result and latency of an outbound dial started at startTime.
+func ObserveDial(outbound string, startTime time.Time, err error) {
+	if err != nil {
+		OutboundDials.WithLabelValues(outbound, DialFailure).Inc()
+		return
+	}
+	OutboundDials.WithLabelValues(outbound, DialSuccess).Inc()
+	OutboundDialDuration.WithLabelValues(outbound).Observe(time.Since(startTime).Seconds())
+}
+
+// AddTraffic records bytes relayed through the outbound.
+func AddTraffic(outbound string, upload, download int64) {
+	if upload > 0 {
+		OutboundBytes.WithLabelValues(outbound, DirectionUpload).Add(float64(upload))
+	}
+	if download > 0 {
+		OutboundBytes.WithLabelValues(outbound, DirectionDownload).Add(float64(download))
+	}
+}
+
+// tagKeys are the tag keys counted by AddTags.
+var tagKeys atomic.Pointer[map[string]struct{}]
+
+// SetTagKeys sets the tag keys counted by AddTags, the counters of other keys are removed.
+// Values of the tags are labels, so keys with unbounded values should not be set.
+func SetTagKeys(keys []string) {
+	keySet := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		keySet[key] = struct{}{}
+	}
+	tagKeys.Store(&keySet)
+	labelValues, _ := ConnectionTags.sorted()
+	for _, values := range labelValues {
+		if _, found := keySet[values[0]]; !found {
+			ConnectionTags.DeleteLabelValues(values...)
+		}
+	}
+}
+
+// AddTags records the tags of a finished connection, whose keys are set by SetTagKeys.
+func AddTags(tags map[string]string) {
+	keySet := tagKeys.Load()
+	if keySet == nil {
+		return
+	}
+	for key, value := range tags {
+		if _, found := (*keySet)[key]; found {
+			ConnectionTags.WithLabelValues(key, value).Inc()
+		}
+	}
+}
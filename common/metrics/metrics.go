@@ -0,0 +1,393 @@
+// Package metrics implements a minimal Prometheus-compatible metrics registry.
+//
+// Only counters, gauges and histograms with constant label names are supported,
+// which is everything zbproxy needs. Metrics are exposed in the text-based
+// exposition format version 0.0.4.
+//
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+
+	labelSeparator = "\xff"
+)
+
+type Collector interface {
+	Name() string
+	WriteTo(w io.Writer) (int64, error)
+}
+
+type Registry struct {
+	access     sync.RWMutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// DefaultRegistry is the registry that all the built-in metrics of zbproxy belong to.
+var DefaultRegistry = NewRegistry()
+
+func (r *Registry) MustRegister(collectors ...Collector) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	for _, collector := range collectors {
+		for _, registered := range r.collectors {
+			if registered.Name() == collector.Name() {
+				panic("duplicate metrics collector: " + collector.Name())
+			}
+		}
+		r.collectors = append(r.collectors, collector)
+	}
+}
+
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	r.access.RLock()
+	collectors := make([]Collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.access.RUnlock()
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].Name() < collectors[j].Name()
+	})
+	for _, collector := range collectors {
+		var nn int64
+		nn, err = collector.WriteTo(w)
+		n += nn
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// value is a float64 which can be updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) Load() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+func (v *value) Store(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+func (v *value) Add(f float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+f)) {
+			return
+		}
+	}
+}
+
+type desc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) writeHeader(b *strings.Builder) {
+	b.WriteString("# HELP ")
+	b.WriteString(d.name)
+	b.WriteByte(' ')
+	b.WriteString(strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	b.WriteString("\n# TYPE ")
+	b.WriteString(d.name)
+	b.WriteByte(' ')
+	b.WriteString(d.metricType)
+	b.WriteByte('\n')
+}
+
+// writeSeries writes a sample line like `name{a="1",b="2"} 3`.
+// extraName and extraValue append one more label, which is used by histogram buckets.
+func (d *desc) writeSeries(b *strings.Builder, name string, labelValues []string, extraName, extraValue string, v float64) {
+	b.WriteString(name)
+	if len(labelValues) > 0 || extraName != "" {
+		b.WriteByte('{')
+		for i, labelValue := range labelValues {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeLabel(b, d.labelNames[i], labelValue)
+		}
+		if extraName != "" {
+			if len(labelValues) > 0 {
+				b.WriteByte(',')
+			}
+			writeLabel(b, extraName, extraValue)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+}
+
+func writeLabel(b *strings.Builder, name, value string) {
+	b.WriteString(name)
+	b.WriteString(`="`)
+	b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+	b.WriteByte('"')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// vec stores children of a metric family indexed by their label values.
+type vec[T any] struct {
+	desc
+	access   sync.RWMutex
+	children map[string]*T
+	newChild func() *T
+}
+
+func (v *vec[T]) with(labelValues []string) *T {
+	if len(labelValues) != len(v.labelNames) {
+		panic("metrics " + v.name + ": expect " + strconv.Itoa(len(v.labelNames)) +
+			" label values, got " + strconv.Itoa(len(labelValues)))
+	}
+	key := strings.Join(labelValues, labelSeparator)
+	v.access.RLock()
+	child, found := v.children[key]
+	v.access.RUnlock()
+	if found {
+		return child
+	}
+	v.access.Lock()
+	defer v.access.Unlock()
+	child, found = v.children[key]
+	if !found {
+		child = v.newChild()
+		v.children[key] = child
+	}
+	return child
+}
+
+func (v *vec[T]) delete(labelValues []string) {
+	v.access.Lock()
+	delete(v.children, strings.Join(labelValues, labelSeparator))
+	v.access.Unlock()
+}
+
+// sorted returns a snapshot of the children sorted by label values.
+func (v *vec[T]) sorted() (labelValues [][]string, children []*T) {
+	v.access.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labelValues = make([][]string, 0, len(keys))
+	children = make([]*T, 0, len(keys))
+	for _, key := range keys {
+		if len(v.labelNames) == 0 {
+			labelValues = append(labelValues, nil)
+		} else {
+			labelValues = append(labelValues, strings.Split(key, labelSeparator))
+		}
+		children = append(children, v.children[key])
+	}
+	v.access.RUnlock()
+	return
+}
+
+func newVec[T any](name, help, metricType string, labelNames []string, newChild func() *T) vec[T] {
+	return vec[T]{
+		desc: desc{
+			name:       name,
+			help:       help,
+			metricType: metricType,
+			labelNames: labelNames,
+		},
+		children: make(map[string]*T),
+		newChild: newChild,
+	}
+}
+
+type Counter struct {
+	value
+}
+
+// Add increases the counter by f. Panics if f is negative.
+func (c *Counter) Add(f float64) {
+	if f < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.value.Add(f)
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+var _ Collector = (*CounterVec)(nil)
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, typeCounter, labelNames, func() *Counter { return &Counter{} })}
+}
+
+func (c *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return c.with(labelValues)
+}
+
+func (c *CounterVec) DeleteLabelValues(labelValues ...string) {
+	c.delete(labelValues)
+}
+
+func (c *CounterVec) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	c.writeHeader(&b)
+	labelValues, children := c.sorted()
+	for i, child := range children {
+		c.writeSeries(&b, c.name, labelValues[i], "", "", child.Load())
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Set(f float64) {
+	g.Store(f)
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+var _ Collector = (*GaugeVec)(nil)
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, typeGauge, labelNames, func() *Gauge { return &Gauge{} })}
+}
+
+func (g *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return g.with(labelValues)
+}
+
+func (g *GaugeVec) DeleteLabelValues(labelValues ...string) {
+	g.delete(labelValues)
+}
+
+func (g *GaugeVec) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	g.writeHeader(&b)
+	labelValues, children := g.sorted()
+	for i, child := range children {
+		g.writeSeries(&b, g.name, labelValues[i], "", "", child.Load())
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// DefaultBuckets are the default histogram buckets, the same as the official Prometheus client.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	upperBounds []float64
+	buckets     []atomic.Uint64 // not cumulative
+	count       atomic.Uint64
+	sum         value
+}
+
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.upperBounds, f)
+	if i < len(h.buckets) {
+		h.buckets[i].Add(1)
+	}
+	h.sum.Add(f)
+	h.count.Add(1)
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+var _ Collector = (*HistogramVec)(nil)
+
+// NewHistogramVec creates a histogram family. Buckets must be sorted in increasing order,
+// DefaultBuckets is used if it is empty.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &HistogramVec{newVec(name, help, typeHistogram, labelNames, func() *Histogram {
+		return &Histogram{
+			upperBounds: buckets,
+			buckets:     make([]atomic.Uint64, len(buckets)),
+		}
+	})}
+}
+
+func (h *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return h.with(labelValues)
+}
+
+func (h *HistogramVec) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	h.writeHeader(&b)
+	labelValues, children := h.sorted()
+	for i, child := range children {
+		var cumulative uint64
+		for j, upperBound := range child.upperBounds {
+			cumulative += child.buckets[j].Load()
+			h.writeSeries(&b, h.name+"_bucket", labelValues[i], "le", formatFloat(upperBound), float64(cumulative))
+		}
+		count := child.count.Load()
+		h.writeSeries(&b, h.name+"_bucket", labelValues[i], "le", "+Inf", float64(count))
+		h.writeSeries(&b, h.name+"_sum", labelValues[i], "", "", child.sum.Load())
+		h.writeSeries(&b, h.name+"_count", labelValues[i], "", "", float64(count))
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	registry := NewRegistry()
+	counter := NewCounterVec("test_requests_total", "Total requests.", "service")
+	gauge := NewGaugeVec("test_online", "Online \"players\".")
+	histogram := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "outbound")
+	registry.MustRegister(counter, gauge, histogram)
+
+	counter.WithLabelValues("b").Add(2)
+	counter.WithLabelValues("a\"\n").Inc()
+	gauge.WithLabelValues().Set(3)
+	gauge.WithLabelValues().Dec()
+	histogram.WithLabelValues("x").Observe(0.05)
+	histogram.WithLabelValues("x").Observe(0.5)
+	histogram.WithLabelValues("x").Observe(5)
+
+	var b strings.Builder
+	_, err := registry.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{outbound="x",le="0.1"} 1
+test_latency_seconds_bucket{outbound="x",le="1"} 2
+test_latency_seconds_bucket{outbound="x",le="+Inf"} 3
+test_latency_seconds_sum{outbound="x"} 5.55
+test_latency_seconds_count{outbound="x"} 3
+# HELP test_online Online "players".
+# TYPE test_online gauge
+test_online 2
+# HELP test_requests_total Total requests.
+# TYPE test_requests_total counter
+test_requests_total{service="a\"\n"} 1
+test_requests_total{service="b"} 2
+`
+	if b.String() != expected {
+		t.Errorf("unexpected output:\n%s", b.String())
+	}
+}
+
+func TestRegistry_MustRegisterDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate collector is registered")
+		}
+	}()
+	registry := NewRegistry()
+	registry.MustRegister(NewCounterVec("dup", ""), NewGaugeVec("dup", ""))
+}
+
+func TestAddTags(t *testing.T) {
+	defer SetTagKeys(nil)
+	AddTags(map[string]string{"region": "eu"})
+	SetTagKeys([]string{"region", "edition"})
+	AddTags(map[string]string{"region": "eu", "player": "Steve"})
+	AddTags(map[string]string{"region": "eu", "edition": "java"})
+
+	labelValues, children := ConnectionTags.sorted()
+	var b strings.Builder
+	for i, values := range labelValues {
+		b.WriteString(strings.Join(values, "=") + " " + formatFloat(children[i].Load()) + "\n")
+	}
+	const expected = "edition=java 1\nregion=eu 2\n"
+	if b.String() != expected {
+		t.Errorf("got counters:\n%swant:\n%s", b.String(), expected)
+	}
+
+	// counters of removed keys are deleted
+	SetTagKeys([]string{"edition"})
+	labelValues, _ = ConnectionTags.sorted()
+	if len(labelValues) != 1 || labelValues[0][0] != "edition" {
+		t.Errorf("got counters of %q, want only edition", labelValues)
+	}
+}
@@ -1,6 +1,9 @@
 package set
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"sort"
+)
 
 type StringSet map[string]struct{}
 
@@ -27,6 +30,7 @@ func (s StringSet) MarshalJSON() (data []byte, err error) {
 	for item := range s {
 		slice = append(slice, item)
 	}
+	sort.Strings(slice)
 	return json.Marshal(slice)
 }
 
@@ -0,0 +1,21 @@
+package config
+
+import "github.com/layou233/zbproxy/v3/common/jsonx"
+
+type Events struct {
+	Webhooks []*EventWebhook `json:",omitempty"`
+	Files    []*EventFile    `json:",omitempty"`
+}
+
+type EventWebhook struct {
+	URL        string
+	Headers    map[string]string `json:",omitempty"`
+	Types      []string          `json:",omitempty"` // all types if empty
+	Timeout    jsonx.Duration    `json:",omitempty"` // 10s by default
+	MaxRetries int               `json:",omitempty"` // 3 by default, -1 to disable retry
+}
+
+type EventFile struct {
+	LogFile
+	Types []string `json:",omitempty"` // all types if empty
+}
@@ -0,0 +1,274 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// YAML and TOML files are converted to JSON before decoding,
+// so that they share the same unmarshalers with JSON.
+
+type fileFormat uint8
+
+const (
+	formatUnknown fileFormat = iota
+	formatJSON
+	formatYAML
+	formatTOML
+)
+
+func formatOf(filePath string) fileFormat {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	}
+	return formatUnknown
+}
+
+func isConfigFile(filePath string) bool {
+	return formatOf(filePath) != formatUnknown
+}
+
+// decodeContent decodes the content of a single config file into root strictly.
+// Files without a known extension are decoded as JSON.
+func decodeContent(filePath string, content []byte, root *_Root) error {
+	value, err := decodeValue(filePath, content)
+	if err == nil {
+		err = checkFields(value, rootType, nil)
+	}
+	if err == nil {
+		err = unmarshalValue(value, root)
+	}
+	if err != nil {
+		return fileError(filePath, content, err)
+	}
+	return nil
+}
+
+// decodeValue decodes the content of a single config file into a value JSON could encode.
+func decodeValue(filePath string, content []byte) (any, error) {
+	var value any
+	switch formatOf(filePath) {
+	case formatYAML:
+		err := yaml.Unmarshal(content, &value)
+		if err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		err := toml.Unmarshal(content, &value)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err := decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		if decoder.More() {
+			return nil, errors.New("invalid character after top-level value")
+		}
+		return value, nil
+	}
+	return normalizeValue(value)
+}
+
+func unmarshalValue(value any, v any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// normalizeValue converts the values decoded by YAML and TOML to the ones checkFields expects.
+func normalizeValue(value any) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			item, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = item
+		}
+	case map[any]any:
+		newMap := make(map[string]any, len(value))
+		for key, item := range value {
+			stringKey, isString := key.(string)
+			if !isString {
+				return nil, errors.New("non-string key is not supported")
+			}
+			item, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			newMap[stringKey] = item
+		}
+		return newMap, nil
+	case []map[string]any: // arrays of tables in TOML
+		list := make([]any, 0, len(value))
+		for _, item := range value {
+			normalized, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, normalized)
+		}
+		return list, nil
+	case []any:
+		for i, item := range value {
+			item, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = item
+		}
+	}
+	return value, nil
+}
+
+// encodeContent encodes root in the format chosen by the extension of filePath.
+func encodeContent(writer io.Writer, filePath string, root *_Root) error {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	err := encoder.Encode(root)
+	if err != nil {
+		return err
+	}
+	switch formatOf(filePath) {
+	case formatYAML:
+		var node *yaml.Node
+		decoder := json.NewDecoder(buffer)
+		decoder.UseNumber()
+		node, err = jsonToYAML(decoder)
+		if err != nil {
+			return err
+		}
+		yamlEncoder := yaml.NewEncoder(writer)
+		yamlEncoder.SetIndent(2)
+		err = yamlEncoder.Encode(node)
+		if err != nil {
+			return err
+		}
+		return yamlEncoder.Close()
+	case formatTOML:
+		var value any
+		decoder := json.NewDecoder(buffer)
+		decoder.UseNumber()
+		err = decoder.Decode(&value)
+		if err != nil {
+			return err
+		}
+		tomlEncoder := toml.NewEncoder(writer)
+		tomlEncoder.Indent = ""
+		return tomlEncoder.Encode(jsonToTOML(value))
+	}
+	_, err = buffer.WriteTo(writer)
+	return err
+}
+
+// jsonToYAML converts the next JSON value to a YAML node keeping the order of keys.
+// Null values are omitted in mappings.
+func jsonToYAML(decoder *json.Decoder) (*yaml.Node, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		node := &yaml.Node{}
+		if token == '{' {
+			node.Kind = yaml.MappingNode
+			for decoder.More() {
+				var key json.Token
+				key, err = decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				var value *yaml.Node
+				value, err = jsonToYAML(decoder)
+				if err != nil {
+					return nil, err
+				}
+				if value.Tag == "!!null" {
+					continue
+				}
+				node.Content = append(node.Content, &yaml.Node{
+					Kind:  yaml.ScalarNode,
+					Tag:   "!!str",
+					Value: key.(string),
+				}, value)
+			}
+		} else {
+			node.Kind = yaml.SequenceNode
+			for decoder.More() {
+				var value *yaml.Node
+				value, err = jsonToYAML(decoder)
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, value)
+			}
+		}
+		_, err = decoder.Token() // closing delimiter
+		return node, err
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	case json.Number:
+		tag := "!!int"
+		if _, err = token.Int64(); err != nil {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: token.String()}, nil
+	default:
+		node := &yaml.Node{}
+		err = node.Encode(token)
+		return node, err
+	}
+}
+
+// jsonToTOML converts the decoded JSON value to the one TOML could encode.
+// TOML has no null, so null values are omitted in both tables and arrays.
+func jsonToTOML(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			if item == nil {
+				delete(value, key)
+				continue
+			}
+			value[key] = jsonToTOML(item)
+		}
+	case []any:
+		list := value[:0]
+		for _, item := range value {
+			if item == nil {
+				continue
+			}
+			list = append(list, jsonToTOML(item))
+		}
+		return list
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		return float
+	}
+	return value
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/common/set"
+
+	"github.com/phuslu/log"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	root := defaultConfig()
+	root.Router.Rules = append(root.Router.Rules, &Rule{
+		Type:      "ServiceName",
+		Parameter: jsonx.RawJSON(`["default-service"]`),
+		Outbound:  "default-outbound",
+	})
+	root.Lists["players"] = set.NewStringSetFromSlice([]string{"Steve", "Alex"})
+	root.Metrics = &Metrics{Listen: "127.0.0.1:9100"}
+	expected, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filePath := range []string{"zbproxy.json", "zbproxy.yaml", "zbproxy.toml"} {
+		buffer := &bytes.Buffer{}
+		err = encodeContent(buffer, filePath, root)
+		if err != nil {
+			t.Errorf("encode %s: %v", filePath, err)
+			continue
+		}
+		var decoded _Root
+		decoded.Log.Level = log.DebugLevel
+		err = decodeContent(filePath, buffer.Bytes(), &decoded)
+		if err != nil {
+			t.Errorf("decode %s: %v\n%s", filePath, err, buffer)
+			continue
+		}
+		actual, err := json.Marshal(&decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s round trip:\ngot  %s\nwant %s", filePath, actual, expected)
+		}
+	}
+}
+
+func TestEncodeTOMLNullInArray(t *testing.T) {
+	root := defaultConfig()
+	root.Router.Rules = append(root.Router.Rules, &Rule{
+		Type:      "ServiceName",
+		Parameter: jsonx.RawJSON(`["default-service", null]`),
+		Outbound:  "default-outbound",
+	})
+	buffer := &bytes.Buffer{}
+	err := encodeContent(buffer, "zbproxy.toml", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), `Parameter = ["default-service"]`) {
+		t.Errorf("null is not omitted from array:\n%s", buffer)
+	}
+}
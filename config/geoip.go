@@ -0,0 +1,27 @@
+package config
+
+import (
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+)
+
+const DefaultGeoIPInterval = time.Minute
+
+// GeoIP configures the MaxMind-format databases used by SourceGeoIP and SourceASN rules.
+// Databases are reloaded when their files change.
+type GeoIP struct {
+	Country  string         `json:",omitempty"` // a country or city database, relative to the config file
+	ASN      string         `json:",omitempty"` // an ASN database, relative to the config file
+	Interval jsonx.Duration `json:",omitempty"` // how often the files are checked, 1m by default, negative to disable
+}
+
+func (g *GeoIP) GetInterval() time.Duration {
+	switch {
+	case g.Interval < 0:
+		return 0
+	case g.Interval > 0:
+		return time.Duration(g.Interval)
+	}
+	return DefaultGeoIPInterval
+}
@@ -0,0 +1,21 @@
+package config
+
+import "github.com/layou233/zbproxy/v3/common/jsonx"
+
+// HostMap makes an outbound route connections to the target mapped from the sniffed hostname.
+// Hostnames are matched exactly, "*.example.net" matches all the subdomains of example.net,
+// and ".example.net" matches example.net and all its subdomains. The most specific one is used.
+type HostMap struct {
+	Hosts map[string]*HostMapTarget `json:",omitempty"`
+	// HostLists are tags of lists with entries like "play.example.net 10.0.0.2:25565",
+	// the port can be omitted to use TargetPort of the outbound.
+	HostLists jsonx.Listable[string] `json:",omitempty"`
+	Minecraft *MinecraftService      `json:",omitempty"` // default Minecraft options of targets
+	Fallback  string                 `json:",omitempty"` // outbound for unmapped hostnames, rejected if empty
+}
+
+type HostMapTarget struct {
+	TargetAddress string
+	TargetPort    uint16            `json:",omitempty"` // TargetPort of the outbound by default
+	Minecraft     *MinecraftService `json:",omitempty"` // overrides HostMap.Minecraft
+}
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/common/set"
+
+	"github.com/phuslu/log"
+)
+
+// configLoader loads a config file or directory with all the files included.
+// Services, Outbounds, Router.Rules, Router.RuleSets, Lists and ListProviders are merged in the loading order,
+// other sections can only be defined in one file.
+type configLoader struct {
+	files         []string // all the loaded files in order
+	patterns      []string // new files matching them should trigger reloading
+	secrets       []string // files read by ${file:path} substitutions
+	defined       map[string]string
+	services      map[string]string
+	outbounds     map[string]string
+	listProviders map[string]string
+	ruleSets      map[string]string
+}
+
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		defined:       make(map[string]string),
+		services:      make(map[string]string),
+		outbounds:     make(map[string]string),
+		listProviders: make(map[string]string),
+		ruleSets:      make(map[string]string),
+	}
+}
+
+// load loads the file or all the config files in the directory at path into root.
+func (l *configLoader) load(root *_Root, path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		l.files = append(l.files, path) // so that creating it can be detected
+		return err
+	}
+	if !info.IsDir() {
+		return l.loadFile(root, path)
+	}
+	l.patterns = append(l.patterns, filepath.Join(path, "*"))
+	entries, err := os.ReadDir(path) // sorted by name
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isConfigFile(entry.Name()) {
+			continue
+		}
+		err = l.loadFile(root, filepath.Join(path, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) loadFile(root *_Root, path string) error {
+	for _, loaded := range l.files {
+		if loaded == path {
+			return errors.New("config file is loaded more than once: " + path)
+		}
+	}
+	l.files = append(l.files, path)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var (
+		fileConfig _Root
+		sections   map[string]json.RawMessage
+	)
+	fileConfig.Log.Level = log.DebugLevel
+	value, err := decodeValue(path, content)
+	if err == nil {
+		value, err = l.substitute(value, filepath.Dir(path), nil)
+	}
+	if err == nil {
+		err = checkFields(value, rootType, nil)
+	}
+	if err == nil {
+		err = unmarshalValue(value, &sections)
+	}
+	if err == nil {
+		err = unmarshalValue(value, &fileConfig)
+	}
+	if err != nil {
+		return fileError(path, content, err)
+	}
+	err = l.merge(root, &fileConfig, sections, path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, include := range fileConfig.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if !strings.ContainsAny(include, "*?[") {
+			err = l.load(root, include)
+			if err != nil {
+				return fmt.Errorf("%s: include: %w", path, err)
+			}
+			continue
+		}
+		l.patterns = append(l.patterns, include)
+		var matches []string
+		matches, err = filepath.Glob(include)
+		if err != nil {
+			return fmt.Errorf("%s: include: %w", path, err)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			err = l.load(root, match)
+			if err != nil {
+				return fmt.Errorf("%s: include: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func hasSection(sections map[string]json.RawMessage, name string) bool {
+	for key := range sections {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *configLoader) define(section string, path string) error {
+	if definedPath, ok := l.defined[section]; ok {
+		return errors.New(section + " is already defined in " + definedPath)
+	}
+	l.defined[section] = path
+	return nil
+}
+
+func (l *configLoader) merge(root *_Root, fileConfig *_Root, sections map[string]json.RawMessage, path string) error {
+	var err error
+	if hasSection(sections, "Log") {
+		err = l.define("Log", path)
+		if err != nil {
+			return err
+		}
+		root.Log = fileConfig.Log
+	}
+	if fileConfig.Router.DefaultOutbound != "" {
+		err = l.define("Router.DefaultOutbound", path)
+		if err != nil {
+			return err
+		}
+		root.Router.DefaultOutbound = fileConfig.Router.DefaultOutbound
+	}
+	for _, section := range []struct {
+		name  string
+		isSet bool
+		apply func()
+	}{
+		{"GeoIP", fileConfig.GeoIP != nil, func() { root.GeoIP = fileConfig.GeoIP }},
+		{"Metrics", fileConfig.Metrics != nil, func() { root.Metrics = fileConfig.Metrics }},
+		{"AccessLog", fileConfig.AccessLog != nil, func() { root.AccessLog = fileConfig.AccessLog }},
+		{"Events", fileConfig.Events != nil, func() { root.Events = fileConfig.Events }},
+		{"Shutdown", fileConfig.Shutdown != nil, func() { root.Shutdown = fileConfig.Shutdown }},
+	} {
+		if section.isSet {
+			err = l.define(section.name, path)
+			if err != nil {
+				return err
+			}
+			section.apply()
+		}
+	}
+
+	for _, service := range fileConfig.Services {
+		if definedPath, ok := l.services[service.Name]; ok {
+			return errors.New("service [" + service.Name + "] is already defined in " + definedPath)
+		}
+		l.services[service.Name] = path
+		root.Services = append(root.Services, service)
+	}
+	for _, outbound := range fileConfig.Outbounds {
+		if definedPath, ok := l.outbounds[outbound.Name]; ok {
+			return errors.New("outbound [" + outbound.Name + "] is already defined in " + definedPath)
+		}
+		l.outbounds[outbound.Name] = path
+		root.Outbounds = append(root.Outbounds, outbound)
+	}
+	if fileConfig.GeoIP != nil {
+		fileConfig.GeoIP.Country = resolvePath(path, fileConfig.GeoIP.Country)
+		fileConfig.GeoIP.ASN = resolvePath(path, fileConfig.GeoIP.ASN)
+	}
+	root.Router.Rules = append(root.Router.Rules, fileConfig.Router.Rules...)
+	for name, ruleSet := range fileConfig.Router.RuleSets {
+		if definedPath, ok := l.ruleSets[name]; ok {
+			return errors.New("rule set [" + name + "] is already defined in " + definedPath)
+		}
+		l.ruleSets[name] = path
+		if root.Router.RuleSets == nil {
+			root.Router.RuleSets = make(map[string]*RuleSet)
+		}
+		root.Router.RuleSets[name] = ruleSet
+	}
+	for tag, list := range fileConfig.Lists {
+		if root.Lists == nil {
+			root.Lists = make(map[string]set.StringSet)
+		}
+		if existing := root.Lists[tag]; existing != nil {
+			for item := range list {
+				existing.Add(item)
+			}
+		} else {
+			root.Lists[tag] = list
+		}
+	}
+	for tag, provider := range fileConfig.ListProviders {
+		if definedPath, ok := l.listProviders[tag]; ok {
+			return errors.New("list provider [" + tag + "] is already defined in " + definedPath)
+		}
+		l.listProviders[tag] = path
+		if provider != nil {
+			provider.Path = resolvePath(path, provider.Path)
+		}
+		if root.ListProviders == nil {
+			root.ListProviders = make(map[string]*ListProvider)
+		}
+		root.ListProviders[tag] = provider
+	}
+	return nil
+}
+
+// resolvePath resolves target relative to the directory of the config file at path.
+func resolvePath(path string, target string) string {
+	if target == "" || filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(filepath.Dir(path), target)
+}
+
+// loadContent loads the config at filePath with all the files included.
+func loadContent(filePath string) (*_Root, *configLoader, error) {
+	root := &_Root{}
+	root.Log.Level = log.DebugLevel // default log level if Log is omitted
+	loader := newConfigLoader()
+	err := loader.load(root, filePath)
+	if err != nil {
+		return nil, loader, err
+	}
+	return root, loader, nil
+}
+
+// watches reports whether the change of path should trigger reloading.
+func (l *configLoader) watches(path string) bool {
+	for _, file := range l.files {
+		if file == path {
+			return true
+		}
+	}
+	for _, secret := range l.secrets {
+		if secret == path {
+			return true
+		}
+	}
+	if !isConfigFile(path) {
+		return false
+	}
+	for _, pattern := range l.patterns {
+		if match, _ := filepath.Match(pattern, path); match {
+			return true
+		}
+	}
+	return false
+}
+
+// directories returns all the directories to watch.
+func (l *configLoader) directories() []string {
+	directories := make([]string, 0, len(l.files)+len(l.patterns)+len(l.secrets))
+	for _, file := range l.files {
+		directories = append(directories, filepath.Dir(file))
+	}
+	for _, pattern := range l.patterns {
+		directories = append(directories, filepath.Dir(pattern))
+	}
+	for _, secret := range l.secrets {
+		directories = append(directories, filepath.Dir(secret))
+	}
+	return directories
+}
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the files with their contents under directory.
+func writeFiles(t *testing.T, directory string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(directory, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serviceNames(root *_Root) string {
+	names := make([]string, 0, len(root.Services))
+	for _, service := range root.Services {
+		names = append(names, service.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestLoadIncludeGlob(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"zbproxy.json": `{
+  "Include": ["servers/*.json", "lists.yaml"],
+  "Services": [{"Name": "main", "Listen": 25565}],
+  "Router": {"Rules": [{"Type": "always", "Outbound": "REJECT"}]}
+}`,
+		"servers/b.json": `{"Services": [{"Name": "b", "Listen": 25567}], "Outbounds": [{"Name": "b"}]}`,
+		"servers/a.json": `{"Services": [{"Name": "a", "Listen": 25566}], "Outbounds": [{"Name": "a"}],
+  "Router": {"Rules": [{"Type": "always", "Outbound": "RESET"}]}}`,
+		"servers/notes.txt": "not a config",
+		"lists.yaml":        "Lists:\n  admins: [Steve]\n",
+	})
+
+	root, loader, err := loadContent(filepath.Join(directory, "zbproxy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// included files are merged after the including one, glob matches are sorted by name
+	if names := serviceNames(root); names != "main,a,b" {
+		t.Errorf("got services %s, want main,a,b", names)
+	}
+	if len(root.Outbounds) != 2 || root.Outbounds[0].Name != "a" || root.Outbounds[1].Name != "b" {
+		t.Errorf("got outbounds %v, want a and b", root.Outbounds)
+	}
+	if len(root.Router.Rules) != 2 || root.Router.Rules[0].Outbound != "REJECT" || root.Router.Rules[1].Outbound != "RESET" {
+		t.Errorf("rules are not merged in order: %v", root.Router.Rules)
+	}
+	if !root.Lists["admins"].Has("Steve") {
+		t.Errorf("list of the YAML file is not merged: %v", root.Lists)
+	}
+
+	for _, testCase := range []struct {
+		path    string
+		watches bool
+	}{
+		{"zbproxy.json", true},
+		{"lists.yaml", true},
+		{"servers/a.json", true},
+		{"servers/c.json", true}, // a new file matching the pattern
+		{"servers/c.yaml", false},
+		{"servers/notes.txt", false},
+		{"other.json", false},
+	} {
+		if loader.watches(filepath.Join(directory, testCase.path)) != testCase.watches {
+			t.Errorf("watches %s: %v, want %v", testCase.path, !testCase.watches, testCase.watches)
+		}
+	}
+}
+
+func TestLoadDirectory(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"20-b.json":        `{"Services": [{"Name": "b", "Listen": 25566}]}`,
+		"10-a.yaml":        "Services:\n  - Name: a\n    Listen: 25565\n",
+		"30-c.toml":        "[[Services]]\nName = \"c\"\nListen = 25567\n",
+		"README.md":        "not a config",
+		"disabled/d.json":  `{"Services": [{"Name": "d", "Listen": 25568}]}`,
+		"disabled/e.jsonx": `broken`,
+	})
+
+	root, loader, err := loadContent(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files are loaded in the order of names, sub-directories and other files are skipped
+	if names := serviceNames(root); names != "a,b,c" {
+		t.Errorf("got services %s, want a,b,c", names)
+	}
+	if !loader.watches(filepath.Join(directory, "40-d.json")) {
+		t.Error("new config file in the directory is not watched")
+	}
+	if loader.watches(filepath.Join(directory, "README.md")) {
+		t.Error("non-config file in the directory is watched")
+	}
+}
+
+func TestLoadDuplicatedInclude(t *testing.T) {
+	for _, testCase := range []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			"include cycle",
+			map[string]string{
+				"zbproxy.json": `{"Include": ["a.json"]}`,
+				"a.json":       `{"Include": ["zbproxy.json"]}`,
+			},
+		},
+		{
+			"included twice",
+			map[string]string{
+				"zbproxy.json": `{"Include": ["a.json", "./a.json"]}`,
+				"a.json":       `{}`,
+			},
+		},
+		{
+			"included by a glob again",
+			map[string]string{
+				"zbproxy.json": `{"Include": ["conf/a.json", "conf/*.json"]}`,
+				"conf/a.json":  `{}`,
+			},
+		},
+	} {
+		directory := t.TempDir()
+		writeFiles(t, directory, testCase.files)
+		_, _, err := loadContent(filepath.Join(directory, "zbproxy.json"))
+		if err == nil || !strings.Contains(err.Error(), "config file is loaded more than once") {
+			t.Errorf("%s: got error %v, want loaded more than once", testCase.name, err)
+		}
+	}
+}
+
+func TestLoadConflicts(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		included string
+		err      string
+	}{
+		{"Log", `{"Log": {"Level": "info"}}`, "Log is already defined in "},
+		{"empty Log", `{"Log": {}}`, "Log is already defined in "},
+		{"Metrics", `{"Metrics": {"Listen": ":9090"}}`, "Metrics is already defined in "},
+		{"Shutdown", `{"Shutdown": {"DrainTimeout": "1s"}}`, "Shutdown is already defined in "},
+		{"default outbound", `{"Router": {"DefaultOutbound": "RESET"}}`, "Router.DefaultOutbound is already defined in "},
+		{"service", `{"Services": [{"Name": "main", "Listen": 1}]}`, "service [main] is already defined in "},
+		{"outbound", `{"Outbounds": [{"Name": "main"}]}`, "outbound [main] is already defined in "},
+		{"rule set", `{"Router": {"RuleSets": {"set": {"Rules": []}}}}`, "rule set [set] is already defined in "},
+		{"list provider", `{"ListProviders": {"players": {"Path": "b.txt"}}}`, "list provider [players] is already defined in "},
+	} {
+		directory := t.TempDir()
+		writeFiles(t, directory, map[string]string{
+			"zbproxy.json": `{
+  "Include": ["included.json"],
+  "Log": {"Level": "debug"},
+  "Metrics": {"Listen": ":9091"},
+  "Shutdown": {},
+  "Services": [{"Name": "main", "Listen": 25565}],
+  "Outbounds": [{"Name": "main"}],
+  "Router": {"DefaultOutbound": "main", "RuleSets": {"set": {"Rules": []}}},
+  "ListProviders": {"players": {"Path": "a.txt"}}
+}`,
+			"included.json": testCase.included,
+		})
+		_, _, err := loadContent(filepath.Join(directory, "zbproxy.json"))
+		wantErr := filepath.Join(directory, "included.json") + ": " + testCase.err + filepath.Join(directory, "zbproxy.json")
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: got error %v, want %s", testCase.name, err, wantErr)
+		}
+	}
+
+	// lists of the same tag are merged instead
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"zbproxy.json":  `{"Include": ["included.json"], "Lists": {"admins": ["Steve"]}}`,
+		"included.json": `{"Lists": {"admins": ["Alex"]}}`,
+	})
+	root, _, err := loadContent(filepath.Join(directory, "zbproxy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admins := root.Lists["admins"]; len(admins) != 2 || !admins.Has("Steve") || !admins.Has("Alex") {
+		t.Errorf("lists are not merged: %v", admins)
+	}
+}
+
+func TestLoadRelativePaths(t *testing.T) {
+	directory := t.TempDir()
+	absoluteList := filepath.Join(directory, "absolute.txt")
+	writeFiles(t, directory, map[string]string{
+		"zbproxy.json": `{"Include": ["sub/lists.json"], "ListProviders": {"main": {"Path": "main.txt"}}}`,
+		"sub/lists.json": `{
+  "ListProviders": {
+    "players": {"Path": "players.txt"},
+    "absolute": {"Path": ` + strconv.Quote(absoluteList) + `},
+    "remote": {"URL": "https://example.com/list.txt"}
+  },
+  "GeoIP": {"Country": "geo/country.mmdb", "ASN": ` + strconv.Quote(filepath.Join(directory, "asn.mmdb")) + `}
+}`,
+	})
+
+	root, _, err := loadContent(filepath.Join(directory, "zbproxy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, want := range map[string]string{
+		"main":     filepath.Join(directory, "main.txt"),
+		"players":  filepath.Join(directory, "sub", "players.txt"),
+		"absolute": absoluteList,
+		"remote":   "",
+	} {
+		if got := root.ListProviders[tag].Path; got != want {
+			t.Errorf("path of list provider %s is %s, want %s", tag, got, want)
+		}
+	}
+	if want := filepath.Join(directory, "sub", "geo", "country.mmdb"); root.GeoIP.Country != want {
+		t.Errorf("GeoIP country database is %s, want %s", root.GeoIP.Country, want)
+	}
+	if want := filepath.Join(directory, "asn.mmdb"); root.GeoIP.ASN != want {
+		t.Errorf("GeoIP ASN database is %s, want %s", root.GeoIP.ASN, want)
+	}
+}
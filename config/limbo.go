@@ -0,0 +1,27 @@
+package config
+
+import (
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+)
+
+const DefaultLimboCheckInterval = 5 * time.Second
+
+// Limbo holds players in a void world queue when the server is full or down,
+// and transfers them back when a slot opens. Only Minecraft 1.21 and 1.21.1 are supported,
+// players of other versions are kicked as before.
+type Limbo struct {
+	QueueSize       int            `json:",omitempty"` // unlimited by default
+	QueueMessage    string         `json:",omitempty"` // supports {POSITION} and {SIZE}
+	TransferAddress string         `json:",omitempty"` // the address players connected to by default
+	TransferPort    uint16         `json:",omitempty"`
+	CheckInterval   jsonx.Duration `json:",omitempty"` // how often a down server is checked, 5s by default
+}
+
+func (l *Limbo) GetCheckInterval() time.Duration {
+	if l.CheckInterval > 0 {
+		return time.Duration(l.CheckInterval)
+	}
+	return DefaultLimboCheckInterval
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+)
+
+const (
+	DefaultListFileInterval = 10 * time.Second
+	DefaultListURLInterval  = time.Hour
+	DefaultListURLTimeout   = 30 * time.Second
+)
+
+// ListProvider loads a list from a file, a directory or a URL,
+// one entry per line and "#" starts a comment.
+// Entries are merged with the inline list of the same tag.
+type ListProvider struct {
+	Path     string         `json:",omitempty"` // a file or a directory, relative to the config file
+	URL      string         `json:",omitempty"`
+	Interval jsonx.Duration `json:",omitempty"` // 10s for Path and 1h for URL by default, negative to disable refreshing
+	Timeout  jsonx.Duration `json:",omitempty"` // 30s by default, only for URL
+}
+
+func (p *ListProvider) GetInterval() time.Duration {
+	switch {
+	case p.Interval < 0:
+		return 0
+	case p.Interval > 0:
+		return time.Duration(p.Interval)
+	case p.URL != "":
+		return DefaultListURLInterval
+	}
+	return DefaultListFileInterval
+}
+
+func (p *ListProvider) GetTimeout() time.Duration {
+	if p.Timeout > 0 {
+		return time.Duration(p.Timeout)
+	}
+	return DefaultListURLTimeout
+}
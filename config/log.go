@@ -3,16 +3,43 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/common/logging"
 
 	"github.com/phuslu/log"
 )
 
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+	LogOutputFile   = "file"
+	LogOutputSyslog = "syslog"
+
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
+// LogModules are the modules whose log levels can be overridden.
+var LogModules = []string{"router", "service", "outbound", "config"}
+
 type _Log struct {
-	Level string
+	Level   string
+	Output  string            `json:",omitempty"`
+	Format  string            `json:",omitempty"`
+	File    *LogFile          `json:",omitempty"`
+	Syslog  *LogSyslog        `json:",omitempty"`
+	Modules map[string]string `json:",omitempty"`
 }
 
 type Log struct {
-	Level log.Level
+	Level   log.Level
+	Output  string // stdout (default), stderr, file or syslog
+	Format  string // console (default) or json, it must be empty for syslog which always writes JSON
+	File    *LogFile
+	Syslog  *LogSyslog
+	Modules map[string]log.Level
 }
 
 var (
@@ -20,25 +47,123 @@ var (
 	_ json.Unmarshaler = (*Log)(nil)
 )
 
+func parseLogLevel(s string) (log.Level, error) {
+	if s == "" {
+		return log.DebugLevel, nil // default log level
+	}
+	level := log.ParseLevel(s)
+	if level > log.PanicLevel { // the last enum value
+		return 0, fmt.Errorf("unknown log level: %s", s)
+	}
+	return level, nil
+}
+
 func (l *Log) UnmarshalJSON(bytes []byte) error {
 	var rawLog _Log
 	err := json.Unmarshal(bytes, &rawLog)
 	if err != nil {
 		return err
 	}
-	if rawLog.Level == "" {
-		l.Level = log.DebugLevel // default log level
-	} else {
-		l.Level = log.ParseLevel(rawLog.Level)
-		if l.Level > log.PanicLevel { // the last enum value
-			return fmt.Errorf("unknown log level: %s", rawLog.Level)
+	l.Level, err = parseLogLevel(rawLog.Level)
+	if err != nil {
+		return err
+	}
+
+	switch rawLog.Output {
+	case "", LogOutputStdout, LogOutputStderr:
+	case LogOutputFile:
+		if rawLog.File == nil || rawLog.File.Path == "" {
+			return fmt.Errorf("log output %s requires a file path", rawLog.Output)
+		}
+	case LogOutputSyslog:
+		if rawLog.Format != "" {
+			return fmt.Errorf("log output %s always writes %s, Format must be empty", rawLog.Output, LogFormatJSON)
+		}
+	default:
+		return fmt.Errorf("unknown log output: %s", rawLog.Output)
+	}
+	switch rawLog.Format {
+	case "", LogFormatConsole, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format: %s", rawLog.Format)
+	}
+	l.Output = rawLog.Output
+	l.Format = rawLog.Format
+	l.File = rawLog.File
+	l.Syslog = rawLog.Syslog
+
+	l.Modules = nil
+	if len(rawLog.Modules) > 0 {
+		l.Modules = make(map[string]log.Level, len(rawLog.Modules))
+		for module, level := range rawLog.Modules {
+			if !isLogModule(module) {
+				return fmt.Errorf("unknown log module: %s", module)
+			}
+			if level == "" {
+				return fmt.Errorf("empty log level for module: %s", module)
+			}
+			l.Modules[module], err = parseLogLevel(level)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
 func (l Log) MarshalJSON() ([]byte, error) {
+	var modules map[string]string
+	if len(l.Modules) > 0 {
+		modules = make(map[string]string, len(l.Modules))
+		for module, level := range l.Modules {
+			modules[module] = level.String()
+		}
+	}
 	return json.Marshal(_Log{
-		Level: l.Level.String(),
+		Level:   l.Level.String(),
+		Output:  l.Output,
+		Format:  l.Format,
+		File:    l.File,
+		Syslog:  l.Syslog,
+		Modules: modules,
 	})
 }
+
+// ModuleLevel returns the log level of the module.
+func (l *Log) ModuleLevel(module string) log.Level {
+	if level, found := l.Modules[module]; found {
+		return level
+	}
+	return l.Level
+}
+
+func isLogModule(module string) bool {
+	for _, m := range LogModules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+type LogFile struct {
+	Path           string
+	MaxSize        int64          `json:",omitempty"` // in megabytes
+	MaxBackups     int            `json:",omitempty"`
+	RotateInterval jsonx.Duration `json:",omitempty"`
+}
+
+func (f *LogFile) FileOptions() logging.FileOptions {
+	return logging.FileOptions{
+		Path:           f.Path,
+		MaxSize:        f.MaxSize * 1024 * 1024,
+		MaxBackups:     f.MaxBackups,
+		RotateInterval: time.Duration(f.RotateInterval),
+	}
+}
+
+type LogSyslog struct {
+	Network string `json:",omitempty"` // "unixgram" by default
+	Address string `json:",omitempty"` // "/dev/log" by default
+	Tag     string `json:",omitempty"` // "zbproxy" by default
+}
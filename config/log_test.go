@@ -0,0 +1,81 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/phuslu/log"
+)
+
+func TestLogUnmarshal(t *testing.T) {
+	for _, testCase := range []struct {
+		content string
+		err     string // empty if no error is expected
+	}{
+		{`{"Level": ""}`, ""},
+		{`{"Level": "info", "Output": "stderr", "Format": "json"}`, ""},
+		{`{"Level": "info", "Output": "file", "File": {"Path": "zbproxy.log"}}`, ""},
+		{`{"Level": "info", "Output": "syslog"}`, ""},
+		{`{"Level": "info", "Modules": {"router": "trace", "config": "warn"}}`, ""},
+		{`{"Level": "verbose"}`, "unknown log level: verbose"},
+		{`{"Level": "info", "Output": "file"}`, "log output file requires a file path"},
+		{`{"Level": "info", "Output": "file", "File": {}}`, "log output file requires a file path"},
+		{`{"Level": "info", "Output": "syslog", "Format": "json"}`, "log output syslog always writes json, Format must be empty"},
+		{`{"Level": "info", "Output": "syslog", "Format": "console"}`, "log output syslog always writes json, Format must be empty"},
+		{`{"Level": "info", "Output": "journal"}`, "unknown log output: journal"},
+		{`{"Level": "info", "Format": "xml"}`, "unknown log format: xml"},
+		{`{"Level": "info", "Modules": {"sniffer": "debug"}}`, "unknown log module: sniffer"},
+		{`{"Level": "info", "Modules": {"router": ""}}`, "empty log level for module: router"},
+		{`{"Level": "info", "Modules": {"router": "loud"}}`, "unknown log level: loud"},
+	} {
+		var l Log
+		err := json.Unmarshal([]byte(testCase.content), &l)
+		if testCase.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", testCase.content, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != testCase.err {
+			t.Errorf("%s: got error %v, want %s", testCase.content, err, testCase.err)
+		}
+	}
+}
+
+func TestLogModuleLevel(t *testing.T) {
+	var l Log
+	err := json.Unmarshal([]byte(`{"Level": "info", "Modules": {"router": "trace"}}`), &l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := l.ModuleLevel("router"); level != log.TraceLevel {
+		t.Errorf("router level is %s, want trace", level)
+	}
+	if level := l.ModuleLevel("service"); level != log.InfoLevel {
+		t.Errorf("service level is %s, want info", level)
+	}
+
+	// the default level is debug
+	err = json.Unmarshal([]byte(`{"Level": ""}`), &l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Level != log.DebugLevel || l.Modules != nil {
+		t.Errorf("got level %s and modules %v, want debug and no modules", l.Level, l.Modules)
+	}
+
+	// marshaling keeps the module levels
+	l.Modules = map[string]log.Level{"outbound": log.ErrorLevel}
+	content, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Log
+	err = json.Unmarshal(content, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ModuleLevel("outbound") != log.ErrorLevel {
+		t.Errorf("outbound level is lost after marshaling: %s", content)
+	}
+}
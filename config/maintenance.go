@@ -0,0 +1,17 @@
+package config
+
+import "github.com/layou233/zbproxy/v3/common/jsonx"
+
+// Maintenance makes an outbound answer status pings with a maintenance MOTD
+// and disconnect players, except the bypassed ones.
+type Maintenance struct {
+	VersionName     string `json:",omitempty"` // "Maintenance" by default
+	VersionProtocol int    `json:",omitempty"` // -1 by default, so that clients show VersionName in red
+	MotdDescription string `json:",omitempty"`
+	MotdFavicon     string `json:",omitempty"`
+	Message         string `json:",omitempty"` // shown to disconnected players
+
+	// Bypass contains player names, UUIDs, or "list:" references of them.
+	Bypass         jsonx.Listable[string] `json:",omitempty"`
+	BypassOutbound string                 `json:",omitempty"` // a Minecraft outbound for bypassed players
+}
@@ -0,0 +1,11 @@
+package config
+
+import "github.com/layou233/zbproxy/v3/common/jsonx"
+
+type Metrics struct {
+	Listen string
+	Path   string `json:",omitempty"` // "/metrics" by default
+	// TagKeys are the keys of connection tags counted with their values,
+	// which should have only a few values. Other tags are only in the access log.
+	TagKeys jsonx.Listable[string] `json:",omitempty"`
+}
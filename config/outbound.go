@@ -8,6 +8,8 @@ type Outbound struct {
 	TargetAddress string                         `json:",omitempty"`
 	TargetPort    uint16                         `json:",omitempty"`
 	Minecraft     *MinecraftService              `json:",omitempty"`
+	Maintenance   *Maintenance                   `json:",omitempty"`
+	HostMap       *HostMap                       `json:",omitempty"`
 	SocketOptions *network.OutboundSocketOptions `json:",omitempty"`
 	ProxyOptions  outbound                       `json:",omitempty"`
 }
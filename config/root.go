@@ -1,10 +1,11 @@
 package config
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/layou233/zbproxy/v3/common"
@@ -17,26 +18,44 @@ import (
 )
 
 type _Root struct {
-	Log       Log
-	Services  []*Service
-	Router    Router
-	Outbounds []*Outbound
-	Lists     map[string]set.StringSet
+	Include       []string `json:",omitempty"`
+	Log           Log
+	Services      []*Service
+	Router        Router
+	Outbounds     []*Outbound
+	Lists         map[string]set.StringSet
+	ListProviders map[string]*ListProvider `json:",omitempty"`
+	GeoIP         *GeoIP                   `json:",omitempty"`
+	Metrics       *Metrics                 `json:",omitempty"`
+	AccessLog     *LogFile                 `json:",omitempty"`
+	Events        *Events                  `json:",omitempty"`
+	Shutdown      *Shutdown                `json:",omitempty"`
 }
 
 type Root struct {
-	Log       Log
-	Services  []*Service
-	Router    Router
-	Outbounds []*Outbound
-	Lists     map[string]set.StringSet
+	Log           Log
+	Services      []*Service
+	Router        Router
+	Outbounds     []*Outbound
+	Lists         map[string]set.StringSet
+	ListProviders map[string]*ListProvider
+	GeoIP         *GeoIP
+	Metrics       *Metrics
+	AccessLog     *LogFile
+	Events        *Events
+	Shutdown      *Shutdown
 
 	ctx           context.Context
 	logger        *log.Logger
 	filePath      string
 	watcher       *fsnotify.Watcher
+	closeOnce     sync.Once
+	watchedDirs   map[string]struct{}
+	loader        *configLoader
 	reloadChan    chan struct{}
 	updateHandler func()
+	reloadHandler func(newConfig *Root) error
+	errorHandler  func(err error)
 }
 
 func (r *Root) WatcherEnabled() bool {
@@ -45,10 +64,25 @@ func (r *Root) WatcherEnabled() bool {
 
 // SetUpdateHandler sets a function that would be called
 // after the config reloading.
+// The reloaded config is applied to r before calling it, so it can not be rejected,
+// use SetReloadHandler instead to validate the config first.
 func (r *Root) SetUpdateHandler(handler func()) {
 	r.updateHandler = handler
 }
 
+// SetReloadHandler sets a function that would be called with the reloaded config.
+// The handler should validate newConfig completely, and call Apply only if it succeeds.
+// It takes the place of the handler set by SetUpdateHandler.
+func (r *Root) SetReloadHandler(handler func(newConfig *Root) error) {
+	r.reloadHandler = handler
+}
+
+// SetReloadErrorHandler sets a function that would be called
+// if the config fails to load when reloading.
+func (r *Root) SetReloadErrorHandler(handler func(err error)) {
+	r.errorHandler = handler
+}
+
 // Reload tries to reload the config and returns false if another reloading is on the way.
 // Only takes effect when watcher is enabled.
 func (r *Root) Reload() bool {
@@ -63,12 +97,13 @@ func (r *Root) Reload() bool {
 	}
 }
 
+// Close stops watching the config files, it is safe to call more than once.
 func (r *Root) Close() (err error) {
-	if r.watcher != nil {
-		close(r.reloadChan)
-		err = r.watcher.Close()
-		r.watcher = nil
-	}
+	r.closeOnce.Do(func() {
+		if r.watcher != nil {
+			err = r.watcher.Close()
+		}
+	})
 	return
 }
 
@@ -85,9 +120,16 @@ func (r *Root) reloadEventLoop() {
 			if !ok {
 				return
 			}
+			if !r.loader.watches(event.Name) {
+				continue
+			}
 			r.logger.Debug().
+				Str("file", event.Name).
 				Uint32("operation", uint32(event.Op)).
 				Msg("Config update detected")
+			if !r.waitForQuiet() {
+				return
+			}
 		case err, ok := <-r.watcher.Errors:
 			if ok {
 				r.logger.Debug().
@@ -104,23 +146,33 @@ func (r *Root) reloadEventLoop() {
 		}
 		startTime := time.Now()
 
-		var rawConfig _Root
-		err := loadContent(&rawConfig, r.filePath)
+		rawConfig, loader, err := loadContent(r.filePath)
+		r.loader = loader
+		r.syncWatcher()
 		if err != nil {
 			r.logger.Error().
 				Err(err).
 				Msg("Error when loading content from file")
+			if r.errorHandler != nil {
+				r.errorHandler(err)
+			}
 			continue
 		}
 
-		r.Log = rawConfig.Log
-		r.Services = rawConfig.Services
-		r.Router = rawConfig.Router
-		r.Outbounds = rawConfig.Outbounds
-		r.Lists = rawConfig.Lists
-
-		if r.updateHandler != nil {
-			r.updateHandler()
+		newConfig := rawConfig.toRoot()
+		if r.reloadHandler != nil {
+			err = r.reloadHandler(newConfig)
+			if err != nil {
+				r.logger.Error().
+					Err(err).
+					Msg("Error when applying config, keeping the old config")
+				continue
+			}
+		} else {
+			r.Apply(newConfig)
+			if r.updateHandler != nil {
+				r.updateHandler()
+			}
 		}
 		r.logger.Info().
 			Str("duration", time.Now().Sub(startTime).String()).
@@ -128,98 +180,218 @@ func (r *Root) reloadEventLoop() {
 	}
 }
 
-func loadContent(root *_Root, filePath string) error {
+// reloadDelay is how long the files should stay unchanged before reloading,
+// since editors and secret managers usually touch several files at once.
+const reloadDelay = 100 * time.Millisecond
+
+// waitForQuiet waits until no more file changes are detected in reloadDelay.
+// It returns false if the watcher is closed.
+func (r *Root) waitForQuiet() bool {
+	timer := time.NewTimer(reloadDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-r.watcher.Events:
+			if !ok {
+				return false
+			}
+			timer.Reset(reloadDelay)
+		case <-timer.C:
+			return true
+		case <-r.ctx.Done():
+			r.Close()
+			return false
+		}
+	}
+}
+
+func (r *_Root) toRoot() *Root {
+	return &Root{
+		Log:           r.Log,
+		Services:      r.Services,
+		Router:        r.Router,
+		Outbounds:     r.Outbounds,
+		Lists:         r.Lists,
+		ListProviders: r.ListProviders,
+		GeoIP:         r.GeoIP,
+		Metrics:       r.Metrics,
+		AccessLog:     r.AccessLog,
+		Events:        r.Events,
+		Shutdown:      r.Shutdown,
+	}
+}
+
+// Apply replaces the config sections of r with newConfig.
+func (r *Root) Apply(newConfig *Root) {
+	r.Log = newConfig.Log
+	r.Services = newConfig.Services
+	r.Router = newConfig.Router
+	r.Outbounds = newConfig.Outbounds
+	r.Lists = newConfig.Lists
+	r.ListProviders = newConfig.ListProviders
+	r.GeoIP = newConfig.GeoIP
+	r.Metrics = newConfig.Metrics
+	r.AccessLog = newConfig.AccessLog
+	r.Events = newConfig.Events
+	r.Shutdown = newConfig.Shutdown
+}
+
+// ReadConfigFromFile reads the config with all the files included without watching,
+// and it does not generate the default config if the file does not exist.
+func ReadConfigFromFile(filePath string) (*Root, error) {
+	rawConfig, _, err := loadContent(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return rawConfig.toRoot(), nil
+}
+
+// FormatConfigFile rewrites the config file in the canonical format.
+// Included files are not merged, they should be formatted separately.
+func FormatConfigFile(filePath string) error {
 	fileContent, err := os.ReadFile(filePath)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(fileContent, root)
+	var rawConfig _Root
+	rawConfig.Log.Level = log.DebugLevel
+	err = decodeContent(filePath, fileContent, &rawConfig)
 	if err != nil {
 		return err
 	}
-	return nil
+	buffer := &bytes.Buffer{}
+	err = encodeContent(buffer, filePath, &rawConfig)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, buffer.Bytes(), 0o644)
 }
 
-func LoadConfigFromFile(ctx context.Context, filePath string, watch bool, logger *log.Logger) (*Root, error) {
-	var rawConfig _Root
-	err := loadContent(&rawConfig, filePath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			logger.Warn().Msg("Config file does not exist, generating a new one...")
-			rawConfig = _Root{
-				Log: Log{
-					Level: log.DebugLevel,
-				},
-				Services: []*Service{
-					{
-						Name:   "default-service",
-						Listen: 25565,
-					},
-				},
-				Router: Router{
-					Rules: []*Rule{
-						{
-							Type:  "always",
-							Sniff: jsonx.Listable[string]{"minecraft"},
-						},
-					},
-					DefaultOutbound: "default-outbound",
-				},
-				Outbounds: []*Outbound{
-					{
-						Name:          "default-outbound",
-						TargetAddress: "mc.example.net",
-						TargetPort:    25565,
-						Minecraft: &MinecraftService{
-							EnableHostnameRewrite: true,
-							OnlineCount: onlineCount{
-								Max:    20,
-								Online: -1,
-							},
-							MotdFavicon: "{DEFAULT_MOTD}",
-						},
-					},
-				},
-				Lists: map[string]set.StringSet{},
-			}
-			var file *os.File
-			file, err = os.Create("zbproxy.json")
+// syncWatcher watches the directories of all the loaded files,
+// so that replacing or creating them can be detected.
+func (r *Root) syncWatcher() {
+	directories := make(map[string]struct{})
+	for _, directory := range r.loader.directories() {
+		if _, watched := r.watchedDirs[directory]; !watched {
+			err := r.watcher.Add(directory)
 			if err != nil {
-				return nil, common.Cause("create config file: ", err)
-			}
-			encoder := json.NewEncoder(file)
-			encoder.SetEscapeHTML(false)
-			encoder.SetIndent("", "    ")
-			err = encoder.Encode(&rawConfig)
-			if err != nil {
-				return nil, common.Cause("generate config: ", err)
+				r.logger.Debug().
+					Str("directory", directory).
+					Err(err).
+					Msg("Failed to watch config directory")
+				continue
 			}
-		} else {
-			return nil, common.Cause("load config: ", err)
 		}
+		directories[directory] = struct{}{}
 	}
-	root := &Root{
-		Log:       rawConfig.Log,
-		Services:  rawConfig.Services,
-		Router:    rawConfig.Router,
-		Outbounds: rawConfig.Outbounds,
-		Lists:     rawConfig.Lists,
-		ctx:       ctx,
-		logger:    logger,
-		filePath:  filePath,
+	for directory := range r.watchedDirs {
+		if _, ok := directories[directory]; !ok {
+			r.watcher.Remove(directory)
+		}
 	}
-	if watch {
-		root.watcher, err = fsnotify.NewWatcher()
+	r.watchedDirs = directories
+}
+
+func generateDefaultConfig(filePath string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return common.Cause("create config file: ", err)
+	}
+	err = encodeContent(file, filePath, defaultConfig())
+	file.Close()
+	if err != nil {
+		return common.Cause("generate config: ", err)
+	}
+	return nil
+}
+
+func defaultConfig() *_Root {
+	return &_Root{
+		Log: Log{
+			Level: log.DebugLevel,
+		},
+		Services: []*Service{
+			{
+				Name:   "default-service",
+				Listen: 25565,
+			},
+		},
+		Router: Router{
+			Rules: []*Rule{
+				{
+					Type:  "always",
+					Sniff: jsonx.Listable[string]{"minecraft"},
+				},
+			},
+			DefaultOutbound: "default-outbound",
+		},
+		Outbounds: []*Outbound{
+			{
+				Name:          "default-outbound",
+				TargetAddress: "mc.example.net",
+				TargetPort:    25565,
+				Minecraft: &MinecraftService{
+					EnableHostnameRewrite: true,
+					OnlineCount: onlineCount{
+						Max:    20,
+						Online: -1,
+					},
+					MotdFavicon: "{DEFAULT_MOTD}",
+				},
+			},
+		},
+		Lists: map[string]set.StringSet{},
+	}
+}
+
+// LoadConfigFromFile loads the config from a file or a directory with all the files included.
+// The default config is generated if filePath does not exist.
+// If watch is true, Watch is called before returning.
+func LoadConfigFromFile(ctx context.Context, filePath string, watch bool, logger *log.Logger) (*Root, error) {
+	_, err := os.Stat(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Warn().Msg("Config file does not exist, generating a new one...")
+		err = generateDefaultConfig(filePath)
 		if err != nil {
 			return nil, err
 		}
-		err = root.watcher.Add(filePath)
+	}
+	rawConfig, loader, err := loadContent(filePath)
+	if err != nil {
+		return nil, common.Cause("load config: ", err)
+	}
+	root := rawConfig.toRoot()
+	root.ctx = ctx
+	root.logger = logger
+	root.filePath = filePath
+	root.loader = loader
+	if watch {
+		err = root.Watch()
 		if err != nil {
-			root.Close()
 			return nil, err
 		}
-		root.reloadChan = make(chan struct{})
-		go root.reloadEventLoop()
 	}
 	return root, nil
 }
+
+// Watch starts reloading the config when the files change.
+// The reloading runs in another goroutine and logs with the logger of r,
+// so the handlers and the logger should be set up before calling it.
+// It only works for the config loaded by LoadConfigFromFile.
+func (r *Root) Watch() error {
+	if r.watcher != nil {
+		return nil
+	}
+	if r.loader == nil {
+		return errors.New("config is not loaded from file")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	r.watcher = watcher
+	r.syncWatcher()
+	r.reloadChan = make(chan struct{})
+	go r.reloadEventLoop()
+	return nil
+}
@@ -3,20 +3,48 @@ package config
 import "github.com/layou233/zbproxy/v3/common/jsonx"
 
 type Router struct {
-	DefaultOutbound string  `json:",omitempty"`
-	Rules           []*Rule `json:",omitempty"`
+	DefaultOutbound string              `json:",omitempty"`
+	Rules           []*Rule             `json:",omitempty"`
+	RuleSets        map[string]*RuleSet `json:",omitempty"`
+}
+
+// RuleSet is a named group of rules, referenced by RuleSet rules and Jump of rules.
+type RuleSet struct {
+	Rules []*Rule
+	// DefaultOutbound is used when a rule jumps into the set and no rule in it decides the outbound.
+	// If it is empty, the evaluation returns to the rules after the jumping one.
+	DefaultOutbound string `json:",omitempty"`
 }
 
 type Rule struct {
 	Type      string
 	Parameter jsonx.RawJSON `json:",omitempty"`
 	//SubRules []Rule `json:",omitempty"`
+	Action   string                 `json:",omitempty"` // one of RuleAction*, see below
 	Rewrite  RuleRewrite            `json:",omitempty"`
 	Sniff    jsonx.Listable[string] `json:",omitempty"`
 	Outbound string                 `json:",omitempty"`
+	Jump     string                 `json:",omitempty"` // name of the rule set to evaluate when matched
+	Metadata map[string]string      `json:",omitempty"` // tags set to Metadata.Custom, values can contain variables
+	Message  string                 `json:",omitempty"` // shown to players rejected by the rule
 	Invert   bool                   `json:",omitempty"`
 }
 
+// Actions of matched rules. Each explicit action only uses its own field.
+// Without Action, a rule applies Sniff and Rewrite, then jumps or routes if Jump or Outbound is set,
+// otherwise the evaluation continues.
+const (
+	RuleActionRoute             = "route"               // use Outbound and stop
+	RuleActionJump              = "jump"                // evaluate the rule set Jump, and continue if it returns
+	RuleActionSniff             = "sniff"               // sniff the protocols in Sniff and continue
+	RuleActionRewrite           = "rewrite"             // apply Rewrite and continue
+	RuleActionSetMetadata       = "set-metadata"        // set Metadata and continue
+	RuleActionReturn            = "return"              // return from the rule set, or use the default outbound in the root
+	RuleActionRejectWithMessage = "reject-with-message" // disconnect Minecraft players with Message and stop
+)
+
+// RuleRewrite rewrites the destination of matched connections.
+// TargetAddress and Minecraft.Hostname can contain variables like {source_ip} and $1.
 type RuleRewrite struct {
 	TargetAddress string                `json:",omitempty"`
 	TargetPort    uint16                `json:",omitempty"`
@@ -28,7 +56,12 @@ type ruleRewriteMinecraft struct {
 	Port     uint16 `json:",omitempty"`
 }
 
+// RuleDomain matches domains, the groups captured by DomainRegex and DomainGlob
+// can be referenced as $1, $2... in the rewrite target address and hostname.
 type RuleDomain struct {
-	Domain       jsonx.Listable[string] `json:",omitempty"`
-	DomainSuffix jsonx.Listable[string] `json:",omitempty"`
+	Domain        jsonx.Listable[string] `json:",omitempty"`
+	DomainSuffix  jsonx.Listable[string] `json:",omitempty"`
+	DomainKeyword jsonx.Listable[string] `json:",omitempty"`
+	DomainRegex   jsonx.Listable[string] `json:",omitempty"`
+	DomainGlob    jsonx.Listable[string] `json:",omitempty"`
 }
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+)
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// ruleParameterTypes are the Parameter types of built-in rules registered by RegisterRuleType,
+// nil if the rule has no parameter.
+var ruleParameterTypes = make(map[string]reflect.Type)
+
+// RegisterRuleType registers a built-in rule type for strict decoding and the schema.
+// parameter is a value of the type its Parameter is decoded into, nil if it has no parameter.
+// It is not safe to call concurrently, so it should be called only in init functions.
+func RegisterRuleType(name string, parameter any) {
+	ruleParameterTypes[name] = reflect.TypeOf(parameter)
+}
+
+// schemaEnums are the allowed values of string fields, indexed by "Type.Field".
+var schemaEnums = map[string][]string{
+	"_Log.Level":                {"trace", "debug", "info", "warn", "error", "fatal", "panic"},
+	"_Log.Output":               {LogOutputStdout, LogOutputStderr, LogOutputFile, LogOutputSyslog},
+	"_Log.Format":               {LogFormatConsole, LogFormatJSON},
+	"access.Mode":               {"", "allow", "block"},
+	"MinecraftService.PingMode": {"", "disconnect", "0ms"},
+	"outbound.Type":             {"", "socks", "socks5", "socks4a", "socks4"},
+	"Rule.Action": {
+		"", RuleActionRoute, RuleActionJump, RuleActionSniff, RuleActionRewrite,
+		RuleActionSetMetadata, RuleActionReturn, RuleActionRejectWithMessage,
+	},
+}
+
+type schemaGenerator struct {
+	definitions map[string]any
+}
+
+// GenerateSchema generates the JSON Schema of config files.
+// Field names in the schema are case-sensitive, though they are not when decoding.
+func GenerateSchema() ([]byte, error) {
+	generator := &schemaGenerator{
+		definitions: make(map[string]any),
+	}
+	schema := generator.structSchema(rootType)
+	schema["$schema"] = schemaDraft
+	schema["title"] = "zbproxy config"
+	schema["$defs"] = generator.definitions
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case logType:
+		t = rawLogType
+	case durationType:
+		return map[string]any{
+			"type":    "string",
+			"pattern": `^([-+]?([0-9]*(\.[0-9]*)?[a-zµ]+)+|0)$`,
+		}
+	case rawJSONType:
+		return map[string]any{}
+	case stringSetType:
+		return map[string]any{
+			"type":        "array",
+			"items":       map[string]any{"type": "string"},
+			"uniqueItems": true,
+		}
+	}
+	if isListable(t) {
+		item := g.schemaOf(t.Elem())
+		return map[string]any{
+			"anyOf": []any{item, map[string]any{
+				"type":  "array",
+				"items": item,
+			}},
+		}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		schema := map[string]any{"type": "integer"}
+		if t.Bits() < 64 {
+			schema["minimum"] = -(int64(1) << (t.Bits() - 1))
+			schema["maximum"] = int64(1)<<(t.Bits()-1) - 1
+		}
+		return schema
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema := map[string]any{"type": "integer", "minimum": 0}
+		if t.Bits() < 64 {
+			schema["maximum"] = uint64(math.MaxUint64) >> (64 - t.Bits())
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{
+			"type":  "array",
+			"items": g.schemaOf(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]any{
+			"type":                 "object",
+			"additionalProperties": g.schemaOf(t.Elem()),
+		}
+	case reflect.Struct:
+		name := t.Name()
+		if t == rawLogType {
+			name = "Log"
+		}
+		if _, defined := g.definitions[name]; !defined {
+			g.definitions[name] = nil // placeholder for recursive types
+			g.definitions[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + name}
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for _, field := range jsonFields(t) {
+		var schema map[string]any
+		if t == ruleType && field.Name == "Parameter" {
+			schema = map[string]any{}
+		} else {
+			schema = g.schemaOf(field.Type)
+		}
+		if enum, found := schemaEnums[t.Name()+"."+field.Name]; found {
+			schema["enum"] = enum
+		}
+		properties[jsonName(field)] = schema
+	}
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	switch t {
+	case rawLogType:
+		properties["Modules"] = map[string]any{
+			"type":                 "object",
+			"propertyNames":        map[string]any{"enum": LogModules},
+			"additionalProperties": map[string]any{"enum": schemaEnums["_Log.Level"]},
+		}
+	case ruleType:
+		g.ruleSchema(schema)
+	}
+	return schema
+}
+
+// ruleSchema adds the Parameter of each built-in rule type to the schema of Rule.
+func (g *schemaGenerator) ruleSchema(schema map[string]any) {
+	ruleTypes := make([]string, 0, len(ruleParameterTypes))
+	for ruleTypeName := range ruleParameterTypes {
+		ruleTypes = append(ruleTypes, ruleTypeName)
+	}
+	sort.Strings(ruleTypes)
+	conditions := make([]any, 0, len(ruleTypes))
+	for _, ruleTypeName := range ruleTypes {
+		var parameterSchema any = false // no parameter is allowed
+		if parameterType := ruleParameterTypes[ruleTypeName]; parameterType != nil {
+			parameterSchema = g.schemaOf(parameterType)
+		}
+		conditions = append(conditions, map[string]any{
+			"if": map[string]any{
+				"properties": map[string]any{"Type": map[string]any{"const": ruleTypeName}},
+				"required":   []string{"Type"},
+			},
+			"then": map[string]any{
+				"properties": map[string]any{"Parameter": parameterSchema},
+			},
+		})
+	}
+	schema["properties"].(map[string]any)["Type"] = map[string]any{
+		"anyOf": []any{
+			map[string]any{"enum": ruleTypes},
+			map[string]any{"type": "string", "pattern": "^custom:"},
+		},
+	}
+	schema["required"] = []string{"Type"}
+	schema["allOf"] = conditions
+}
@@ -16,7 +16,7 @@ type Service struct {
 }
 
 type access struct {
-	Mode     string   // 'accept' or 'deny' or empty
+	Mode     string   // 'allow' or 'block' or empty
 	ListTags []string `json:",omitempty"`
 }
 
@@ -34,6 +34,8 @@ type MinecraftService struct {
 	PingMode        string
 	MotdFavicon     string
 	MotdDescription string
+
+	Limbo *Limbo `json:",omitempty"`
 }
 
 type onlineCount struct {
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+)
+
+const DefaultDrainTimeout = 30 * time.Second
+
+type Shutdown struct {
+	DrainTimeout jsonx.Duration `json:",omitempty"` // 30s by default, negative to close immediately
+	// DisconnectMessage is sent to Minecraft players who are logging in while shutting down.
+	// Players already relayed to a server can not receive it,
+	// because their traffic may be compressed or encrypted by the server.
+	DisconnectMessage string `json:",omitempty"`
+}
+
+func (s *Shutdown) GetDrainTimeout() time.Duration {
+	if s == nil || s.DrainTimeout == 0 {
+		return DefaultDrainTimeout
+	}
+	if s.DrainTimeout < 0 {
+		return 0
+	}
+	return time.Duration(s.DrainTimeout)
+}
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/common/set"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	rootType      = reflect.TypeOf(_Root{})
+	logType       = reflect.TypeOf(Log{})
+	rawLogType    = reflect.TypeOf(_Log{})
+	ruleType      = reflect.TypeOf(Rule{})
+	durationType  = reflect.TypeOf(jsonx.Duration(0))
+	rawJSONType   = reflect.TypeOf(jsonx.RawJSON{})
+	stringSetType = reflect.TypeOf(set.StringSet{})
+	listablePath  = reflect.TypeOf(jsonx.Listable[string]{}).PkgPath()
+)
+
+// valueError is an error about the value at path in a config file.
+type valueError struct {
+	path    []string
+	message string
+}
+
+func (e *valueError) Error() string {
+	return strings.Join(e.path, ".") + ": " + e.message
+}
+
+func isListable(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.PkgPath() == listablePath && strings.HasPrefix(t.Name(), "Listable[")
+}
+
+// findField finds the JSON field of a struct matching key like encoding/json does,
+// which prefers an exact match and falls back to a case-insensitive one.
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var (
+		fallback reflect.StructField
+		found    bool
+	)
+	for _, field := range jsonFields(t) {
+		name := jsonName(field)
+		if name == key {
+			return field, true
+		}
+		if !found && strings.EqualFold(name, key) {
+			fallback, found = field, true
+		}
+	}
+	return fallback, found
+}
+
+// jsonFields returns the fields of struct t encoded by encoding/json,
+// with fields of embedded structs flattened.
+func jsonFields(t reflect.Type) []reflect.StructField {
+	fields := make([]reflect.StructField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if name, _, _ := strings.Cut(tag, ","); field.Anonymous && name == "" {
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(fieldType)...)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// checkFields reports the first unknown field in value decoded from a config file.
+func checkFields(value any, t reflect.Type, path []string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case logType:
+		t = rawLogType
+	case durationType, rawJSONType, stringSetType:
+		return nil
+	}
+	if isListable(t) {
+		if _, isList := value.([]any); !isList {
+			return checkFields(value, t.Elem(), path)
+		}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, isObject := value.(map[string]any)
+		if !isObject {
+			return nil // type errors are reported when unmarshaling
+		}
+		for key, item := range object {
+			field, found := findField(t, key)
+			itemPath := append(path[:len(path):len(path)], key)
+			if !found {
+				return &valueError{itemPath, "unknown field"}
+			}
+			if t == ruleType && field.Name == "Parameter" {
+				err := checkRuleParameter(object, item, itemPath)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err := checkFields(item, field.Type, itemPath)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		object, isObject := value.(map[string]any)
+		if !isObject {
+			return nil
+		}
+		for key, item := range object {
+			err := checkFields(item, t.Elem(), append(path[:len(path):len(path)], key))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		list, isList := value.([]any)
+		if !isList {
+			return nil
+		}
+		for i, item := range list {
+			err := checkFields(item, t.Elem(), append(path[:len(path):len(path)], strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkRuleParameter(rule map[string]any, parameter any, path []string) error {
+	var ruleTypeName string
+	for key, item := range rule {
+		if strings.EqualFold(key, "Type") {
+			ruleTypeName, _ = item.(string)
+		}
+	}
+	parameterType, found := ruleParameterTypes[ruleTypeName]
+	if !found || parameter == nil {
+		return nil
+	}
+	if parameterType == nil {
+		return &valueError{path, "rule type " + ruleTypeName + " has no parameter"}
+	}
+	err := checkFields(parameter, parameterType, path)
+	if err != nil {
+		return err
+	}
+	err = unmarshalValue(parameter, reflect.New(parameterType).Interface())
+	if err != nil {
+		return &valueError{path, err.Error()}
+	}
+	return nil
+}
+
+// fileError adds the file path, and the position if possible, to err.
+func fileError(filePath string, content []byte, err error) error {
+	var (
+		line, column int
+		found        bool
+		syntaxError  *json.SyntaxError
+		valueErr     *valueError
+	)
+	if errors.As(err, &syntaxError) && formatOf(filePath) != formatYAML && formatOf(filePath) != formatTOML {
+		line, column = offsetToPosition(content, int(syntaxError.Offset))
+		found = true
+	} else if errors.As(err, &valueErr) {
+		line, column, found = findPosition(filePath, content, valueErr.path)
+	}
+	if found {
+		return fmt.Errorf("%s:%d:%d: %w", filePath, line, column, err)
+	}
+	return fmt.Errorf("%s: %w", filePath, err)
+}
+
+// findPosition finds the line and column of the key at path in a JSON or YAML file.
+// TOML files are not supported.
+func findPosition(filePath string, content []byte, path []string) (line int, column int, found bool) {
+	if len(path) == 0 {
+		return
+	}
+	switch formatOf(filePath) {
+	case formatTOML:
+		return
+	case formatYAML:
+		var document yaml.Node
+		if yaml.Unmarshal(content, &document) != nil || len(document.Content) == 0 {
+			return
+		}
+		node := findYAMLNode(document.Content[0], path)
+		if node == nil {
+			return
+		}
+		return node.Line, node.Column, true
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	offset, found, _ := findJSONOffset(decoder, content, path, true)
+	if !found {
+		return
+	}
+	line, column = offsetToPosition(content, offset)
+	return line, column, true
+}
+
+func findYAMLNode(node *yaml.Node, path []string) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == path[0] {
+				if len(path) == 1 {
+					return node.Content[i]
+				}
+				return findYAMLNode(node.Content[i+1], path[1:])
+			}
+		}
+	case yaml.SequenceNode:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= len(node.Content) {
+			return nil
+		}
+		if len(path) == 1 {
+			return node.Content[index]
+		}
+		return findYAMLNode(node.Content[index], path[1:])
+	}
+	return nil
+}
+
+// findJSONOffset reads the next JSON value, and finds the offset of the key at path in it.
+func findJSONOffset(decoder *json.Decoder, content []byte, path []string, match bool) (int, bool, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return 0, false, err
+	}
+	delim, isDelim := token.(json.Delim)
+	if !isDelim {
+		return 0, false, nil
+	}
+	for i := 0; decoder.More(); i++ {
+		offset := skipSeparators(content, int(decoder.InputOffset()))
+		key := strconv.Itoa(i)
+		if delim == '{' {
+			token, err = decoder.Token()
+			if err != nil {
+				return 0, false, err
+			}
+			key, _ = token.(string)
+		}
+		matchItem := match && key == path[0]
+		if matchItem && len(path) == 1 {
+			return offset, true, nil
+		}
+		var found bool
+		if matchItem {
+			offset, found, err = findJSONOffset(decoder, content, path[1:], true)
+		} else {
+			_, _, err = findJSONOffset(decoder, content, nil, false)
+		}
+		if found || err != nil {
+			return offset, found, err
+		}
+	}
+	_, err = decoder.Token() // closing delimiter
+	return 0, false, err
+}
+
+func skipSeparators(content []byte, offset int) int {
+	for offset < len(content) {
+		switch content[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func offsetToPosition(content []byte, offset int) (line int, column int) {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	line = bytes.Count(content[:offset], []byte{'\n'}) + 1
+	column = offset - bytes.LastIndexByte(content[:offset], '\n')
+	return
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+)
+
+func TestStrictDecoding(t *testing.T) {
+	// built-in rule types are registered by the route package, which config does not import
+	RegisterRuleType("always", nil)
+	RegisterRuleType("ServiceName", jsonx.Listable[string]{})
+	RegisterRuleType("MinecraftHostname", RuleDomain{})
+
+	for _, testCase := range []struct {
+		filePath string
+		content  string
+		err      string // empty if no error is expected
+	}{
+		{
+			"zbproxy.json",
+			"{\n  \"Services\": [\n    {\"Name\": \"a\", \"Listn\": 25565}\n  ]\n}",
+			"zbproxy.json:3:19: Services.0.Listn: unknown field",
+		},
+		{
+			"zbproxy.yaml",
+			"Services:\n  - Name: a\n    Listn: 25565\n",
+			"zbproxy.yaml:3:5: Services.0.Listn: unknown field",
+		},
+		{
+			"zbproxy.toml",
+			"[[Services]]\nName = \"a\"\nListn = 25565\n",
+			"zbproxy.toml: Services.0.Listn: unknown field",
+		},
+		{
+			"zbproxy.json",
+			"{\"Router\": {\"Rules\": [{\"Type\": \"MinecraftHostname\", \"Parameter\": {\"Domians\": []}}]}}",
+			"zbproxy.json:1:67: Router.Rules.0.Parameter.Domians: unknown field",
+		},
+		{
+			"zbproxy.yaml",
+			"Router:\n  Rules:\n    - Type: always\n      Parameter: [a]\n",
+			"zbproxy.yaml:4:7: Router.Rules.0.Parameter: rule type always has no parameter",
+		},
+		{
+			"zbproxy.json",
+			"{\"Router\": {\"Rules\": [{\"Type\": \"ServiceName\", \"Parameter\": 1}]}}",
+			"zbproxy.json:1:47: Router.Rules.0.Parameter: json: cannot unmarshal number into Go value of type []string\njson: cannot unmarshal number into Go value of type string",
+		},
+		{
+			"zbproxy.json",
+			"{\"Router\": {\"Rules\": [{\"Type\": \"custom:anything\", \"Parameter\": {\"Any\": 1}}]}}",
+			"",
+		},
+		{
+			"zbproxy.json",
+			"{\"services\": [{\"name\": \"a\", \"listen\": 25565}]}",
+			"",
+		},
+	} {
+		var root _Root
+		err := decodeContent(testCase.filePath, []byte(testCase.content), &root)
+		if testCase.err == "" {
+			if err != nil {
+				t.Errorf("decode %q: %v", testCase.content, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("decode %q: no error, want %q", testCase.content, testCase.err)
+		} else if err.Error() != testCase.err {
+			t.Errorf("decode %q:\ngot  %q\nwant %q", testCase.content, err.Error(), testCase.err)
+		}
+	}
+}
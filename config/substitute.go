@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Substitutions in string values:
+//
+//	${NAME}             the environment variable NAME, it is an error if NAME is not set
+//	${NAME:-default}    the environment variable NAME, or default if NAME is unset or empty
+//	${file:path}        the content of the file without trailing newlines,
+//	                    path is relative to the directory of the config file
+//	$${                 a literal "${"
+
+const fileSubstitutionPrefix = "file:"
+
+// substitute replaces the substitutions in all the string values of value.
+// Keys of maps are not substituted.
+func (l *configLoader) substitute(value any, directory string, path []string) (any, error) {
+	switch value := value.(type) {
+	case string:
+		result, err := l.substituteString(value, directory)
+		if err != nil {
+			return nil, &valueError{path, err.Error()}
+		}
+		return result, nil
+	case map[string]any:
+		for key, item := range value {
+			item, err := l.substitute(item, directory, append(path[:len(path):len(path)], key))
+			if err != nil {
+				return nil, err
+			}
+			value[key] = item
+		}
+	case []any:
+		for i, item := range value {
+			item, err := l.substitute(item, directory, append(path[:len(path):len(path)], strconv.Itoa(i)))
+			if err != nil {
+				return nil, err
+			}
+			value[i] = item
+		}
+	}
+	return value, nil
+}
+
+func (l *configLoader) substituteString(value string, directory string) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	var builder strings.Builder
+	for {
+		index := strings.Index(value, "${")
+		if index < 0 {
+			builder.WriteString(value)
+			return builder.String(), nil
+		}
+		if index > 0 && value[index-1] == '$' {
+			builder.WriteString(value[:index-1])
+			builder.WriteString("${")
+			value = value[index+2:]
+			continue
+		}
+		builder.WriteString(value[:index])
+		value = value[index+2:]
+		end := strings.IndexByte(value, '}')
+		if end < 0 {
+			return "", errors.New("unclosed substitution: ${" + value)
+		}
+		result, err := l.resolve(value[:end], directory)
+		if err != nil {
+			return "", err
+		}
+		builder.WriteString(result)
+		value = value[end+1:]
+	}
+}
+
+func (l *configLoader) resolve(expression string, directory string) (string, error) {
+	if strings.HasPrefix(expression, fileSubstitutionPrefix) {
+		path := strings.TrimPrefix(expression, fileSubstitutionPrefix)
+		if path == "" {
+			return "", errors.New("empty file path in ${" + expression + "}")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(directory, path)
+		} else {
+			path = filepath.Clean(path)
+		}
+		l.secrets = append(l.secrets, path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	name, defaultValue, hasDefault := strings.Cut(expression, ":-")
+	if name == "" {
+		return "", errors.New("empty variable name in ${" + expression + "}")
+	}
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return defaultValue, nil
+	}
+	if !ok {
+		return "", errors.New("environment variable " + name + " is not set")
+	}
+	return value, nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSubstituteString(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"token":              "s3cret\n",
+		"crlf":               "s3cret\r\n",
+		"blank-lines":        "s3cret\n\n\n",
+		"multi-line":         "line 1\nline 2\n",
+		"sub/password":       "hunter2",
+		"trailing-space.txt": "s3cret \n",
+	})
+	absoluteToken := filepath.Join(directory, "token")
+	t.Setenv("ZBPROXY_TEST_SET", "value")
+	t.Setenv("ZBPROXY_TEST_EMPTY", "")
+	os.Unsetenv("ZBPROXY_TEST_UNSET")
+
+	for _, testCase := range []struct {
+		value string
+		want  string
+		err   string // empty if no error is expected
+	}{
+		{value: "plain", want: "plain"},
+		{value: "$HOME and {braces}", want: "$HOME and {braces}"},
+		{value: "$${ZBPROXY_TEST_SET}", want: "${ZBPROXY_TEST_SET}"},
+		{value: "a$${b}${ZBPROXY_TEST_SET}", want: "a${b}value"},
+		{value: "${ZBPROXY_TEST_SET}", want: "value"},
+		{value: "<${ZBPROXY_TEST_SET}:${ZBPROXY_TEST_SET}>", want: "<value:value>"},
+		{value: "${ZBPROXY_TEST_SET:-default}", want: "value"},
+		{value: "${ZBPROXY_TEST_UNSET:-default}", want: "default"},
+		{value: "${ZBPROXY_TEST_UNSET:-}", want: ""},
+		{value: "${ZBPROXY_TEST_UNSET:-a:-b}", want: "a:-b"},
+		{value: "${ZBPROXY_TEST_EMPTY:-default}", want: "default"},
+		{value: "${ZBPROXY_TEST_EMPTY}", want: ""},
+		{value: "${ZBPROXY_TEST_UNSET}", err: "environment variable ZBPROXY_TEST_UNSET is not set"},
+		{value: "${ZBPROXY_TEST_SET", err: "unclosed substitution: ${ZBPROXY_TEST_SET"},
+		{value: "${ZBPROXY_TEST_SET}${", err: "unclosed substitution: ${"},
+		{value: "${}", err: "empty variable name in ${}"},
+		{value: "${:-default}", err: "empty variable name in ${:-default}"},
+		{value: "${file:token}", want: "s3cret"},
+		{value: "${file:crlf}", want: "s3cret"},
+		{value: "${file:blank-lines}", want: "s3cret"},
+		{value: "${file:multi-line}", want: "line 1\nline 2"},
+		{value: "${file:trailing-space.txt}", want: "s3cret "},
+		{value: "${file:sub/password}", want: "hunter2"},
+		{value: "${file:./sub/../token}", want: "s3cret"},
+		{value: "${file:" + absoluteToken + "}", want: "s3cret"},
+		{value: "Bearer ${file:token}", want: "Bearer s3cret"},
+		{value: "${file:missing}", err: filepath.Join(directory, "missing")},
+		{value: "${file:}", err: "empty file path in ${file:}"},
+	} {
+		loader := newConfigLoader()
+		got, err := loader.substituteString(testCase.value, directory)
+		if testCase.err != "" {
+			if err == nil || !strings.Contains(err.Error(), testCase.err) {
+				t.Errorf("%q: got error %v, want %q", testCase.value, err, testCase.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", testCase.value, err)
+		} else if got != testCase.want {
+			t.Errorf("%q: got %q, want %q", testCase.value, got, testCase.want)
+		}
+	}
+}
+
+func TestSubstituteSecrets(t *testing.T) {
+	directory := t.TempDir()
+	writeFiles(t, directory, map[string]string{
+		"zbproxy.json":       `{"Include": ["sub/outbounds.json"], "Services": [{"Name": "${file:secrets/name}", "Listen": 25565}]}`,
+		"secrets/name":       "main\n",
+		"sub/outbounds.json": `{"Outbounds": [{"Name": "${file:../secrets/name}-${file:address}", "TargetAddress": "${file:address}"}]}`,
+		"sub/address":        "mc.example.com\n",
+	})
+	root, loader, err := loadContent(filepath.Join(directory, "zbproxy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Services[0].Name != "main" {
+		t.Errorf("service name is %q, want main", root.Services[0].Name)
+	}
+	// paths are relative to the file containing them
+	if root.Outbounds[0].Name != "main-mc.example.com" || root.Outbounds[0].TargetAddress != "mc.example.com" {
+		t.Errorf("got outbound %+v", root.Outbounds[0])
+	}
+	for _, path := range []string{"secrets/name", "sub/address"} {
+		if !loader.watches(filepath.Join(directory, path)) {
+			t.Errorf("secret %s is not watched", path)
+		}
+	}
+	if loader.watches(filepath.Join(directory, "secrets/other")) {
+		t.Error("other files next to a secret are watched")
+	}
+
+	// the error names the file and the field
+	os.Unsetenv("ZBPROXY_TEST_UNSET")
+	writeFiles(t, directory, map[string]string{
+		"sub/outbounds.json": `{"Outbounds": [{"Name": "a", "TargetAddress": "${ZBPROXY_TEST_UNSET}"}]}`,
+	})
+	_, _, err = loadContent(filepath.Join(directory, "zbproxy.json"))
+	if err == nil ||
+		!strings.Contains(err.Error(), filepath.Join(directory, "sub", "outbounds.json")) ||
+		!strings.Contains(err.Error(), "Outbounds.0.TargetAddress") ||
+		!strings.Contains(err.Error(), "environment variable ZBPROXY_TEST_UNSET is not set") {
+		t.Errorf("got error %v, want the file, the field and the variable", err)
+	}
+}
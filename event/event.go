@@ -0,0 +1,206 @@
+// Package event delivers notable zbproxy events, such as player logins,
+// to in-process subscribers and configured sinks.
+package event
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	TypePlayerLogin        = "player_login"
+	TypePlayerDisconnect   = "player_disconnect"
+	TypePlayerRejected     = "player_rejected"
+	TypeAccessRejected     = "access_rejected"
+	TypeConfigReloaded     = "config_reloaded"
+	TypeConfigReloadFailed = "config_reload_failed"
+)
+
+// Types are all the event types.
+var Types = []string{
+	TypePlayerLogin,
+	TypePlayerDisconnect,
+	TypePlayerRejected,
+	TypeAccessRejected,
+	TypeConfigReloaded,
+	TypeConfigReloadFailed,
+}
+
+type Event struct {
+	Type         string         `json:"type"`
+	Time         time.Time      `json:"time"`
+	ConnectionID string         `json:"connectionID,omitempty"`
+	Service      string         `json:"service,omitempty"`
+	Outbound     string         `json:"outbound,omitempty"`
+	Source       string         `json:"source,omitempty"`
+	Hostname     string         `json:"hostname,omitempty"`
+	Player       string         `json:"player,omitempty"`
+	UUID         string         `json:"uuid,omitempty"`
+	Duration     jsonx.Duration `json:"duration,omitempty"`
+	Reason       string         `json:"reason,omitempty"`
+}
+
+type Sink interface {
+	// Send delivers the event. It should not block for long.
+	Send(e *Event)
+	Close() error
+}
+
+type Handler = func(e *Event)
+
+const queueSize = 1024
+
+// Bus dispatches events asynchronously in a single goroutine,
+// so handlers and sinks see events in the order they are emitted.
+type Bus struct {
+	logger *log.Logger
+	queue  chan *Event
+
+	access      sync.RWMutex
+	subscribers map[uint64]Handler
+	nextID      uint64
+	sinks       []Sink
+}
+
+func NewBus(ctx context.Context, logger *log.Logger) *Bus {
+	b := &Bus{
+		logger:      logger,
+		queue:       make(chan *Event, queueSize),
+		subscribers: make(map[uint64]Handler),
+	}
+	go b.loop(ctx)
+	return b
+}
+
+func (b *Bus) loop(ctx context.Context) {
+	for {
+		select {
+		case e := <-b.queue:
+			// copied under the lock, so handlers can subscribe or unsubscribe
+			b.access.RLock()
+			handlers := make([]Handler, 0, len(b.subscribers))
+			for _, handler := range b.subscribers {
+				handlers = append(handlers, handler)
+			}
+			sinks := b.sinks
+			b.access.RUnlock()
+			for _, handler := range handlers {
+				handler(e)
+			}
+			for _, sink := range sinks {
+				sink.Send(e)
+			}
+		case <-ctx.Done():
+			b.access.Lock()
+			for _, sink := range b.sinks {
+				sink.Close()
+			}
+			b.sinks = nil
+			b.access.Unlock()
+			return
+		}
+	}
+}
+
+// Subscribe registers an in-process handler for all events.
+// Handlers are called in the dispatching goroutine and must not block.
+// Call the returned function to unsubscribe.
+func (b *Bus) Subscribe(handler Handler) (unsubscribe func()) {
+	b.access.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = handler
+	b.access.Unlock()
+	return func() {
+		b.access.Lock()
+		delete(b.subscribers, id)
+		b.access.Unlock()
+	}
+}
+
+// Sinks returns the current sinks.
+func (b *Bus) Sinks() []Sink {
+	b.access.RLock()
+	defer b.access.RUnlock()
+	return b.sinks
+}
+
+// SetSinks replaces all the sinks, the old sinks not in sinks are closed.
+func (b *Bus) SetSinks(sinks []Sink) {
+	b.access.Lock()
+	oldSinks := b.sinks
+	b.sinks = sinks
+	b.access.Unlock()
+	CloseSinks(oldSinks, sinks)
+}
+
+// Emit queues the event, and drops it if the queue is full.
+func (b *Bus) Emit(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case b.queue <- e:
+	default:
+		b.logger.Warn().
+			Str("type", e.Type).
+			Msg("Event queue is full, dropped event")
+	}
+}
+
+type busKey struct{}
+
+// WithBus returns a copy of ctx carrying the bus.
+func WithBus(ctx context.Context, bus *Bus) context.Context {
+	return context.WithValue(ctx, busKey{}, bus)
+}
+
+// FromContext returns the bus carried by ctx, or nil if there is no bus.
+func FromContext(ctx context.Context) *Bus {
+	bus, _ := ctx.Value(busKey{}).(*Bus)
+	return bus
+}
+
+// Emit emits the event to the bus carried by ctx, it does nothing if there is no bus.
+func Emit(ctx context.Context, e *Event) {
+	if bus := FromContext(ctx); bus != nil {
+		bus.Emit(e)
+	}
+}
+
+// typeFilter returns nil if all types are accepted.
+func typeFilter(types []string) map[string]bool {
+	if len(types) == 0 {
+		return nil
+	}
+	filter := make(map[string]bool, len(types))
+	for _, t := range types {
+		filter[t] = true
+	}
+	return filter
+}
+
+// NewConnectionEvent creates an event filled with the connection information.
+func NewConnectionEvent(eventType string, metadata *adapter.Metadata) *Event {
+	e := &Event{
+		Type:         eventType,
+		Time:         time.Now(),
+		ConnectionID: metadata.ConnectionID,
+		Service:      metadata.ServiceName,
+		Source:       metadata.SourceAddress.String(),
+	}
+	if metadata.Minecraft != nil {
+		e.Hostname = metadata.Minecraft.CleanOriginDestination()
+		e.Player = metadata.Minecraft.PlayerName
+		e.UUID = metadata.Minecraft.UUIDString()
+	} else if metadata.TLS != nil {
+		e.Hostname = metadata.TLS.SNI
+	}
+	return e
+}
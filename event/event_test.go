@@ -0,0 +1,261 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+func TestBusDropWhenFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logBuffer := &bytes.Buffer{}
+	bus := NewBus(ctx, &log.Logger{Writer: &log.IOWriter{Writer: logBuffer}})
+
+	var (
+		received int
+		access   sync.Mutex
+		blocked  = make(chan struct{})
+		release  = make(chan struct{})
+		done     = make(chan struct{})
+	)
+	bus.Subscribe(func(e *Event) {
+		access.Lock()
+		received++
+		count := received
+		access.Unlock()
+		if count == 1 {
+			close(blocked)
+			<-release
+		}
+		if e.Type == TypeConfigReloaded {
+			close(done)
+		}
+	})
+
+	// the first event blocks the dispatching goroutine, then the queue is filled
+	bus.Emit(&Event{Type: TypePlayerLogin})
+	<-blocked
+	for n := 0; n < queueSize-1; n++ {
+		bus.Emit(&Event{Type: TypePlayerLogin})
+	}
+	bus.Emit(&Event{Type: TypeConfigReloaded})
+	bus.Emit(&Event{Type: TypePlayerDisconnect}) // dropped
+	if !strings.Contains(logBuffer.String(), "Event queue is full") {
+		t.Error("dropping is not logged")
+	}
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued events are not dispatched")
+	}
+	// the dropped event would be dispatched right after the last queued one
+	time.Sleep(10 * time.Millisecond)
+	access.Lock()
+	defer access.Unlock()
+	if received != queueSize+1 {
+		t.Errorf("received %d events, want %d", received, queueSize+1)
+	}
+}
+
+func TestBusSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := NewBus(ctx, &log.Logger{Writer: &log.IOWriter{Writer: io.Discard}})
+	events := make(chan *Event, 10)
+	unsubscribe := bus.Subscribe(func(e *Event) {
+		events <- e
+	})
+
+	Emit(WithBus(ctx, bus), &Event{Type: TypePlayerLogin, Player: "Steve"})
+	Emit(ctx, &Event{Type: TypePlayerLogin}) // no bus in ctx
+	select {
+	case e := <-events:
+		if e.Player != "Steve" || e.Time.IsZero() {
+			t.Errorf("got event %+v, want player Steve with the time set", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is not dispatched")
+	}
+
+	unsubscribe()
+	bus.Emit(&Event{Type: TypePlayerLogin})
+	select {
+	case e := <-events:
+		t.Errorf("got event %+v after unsubscribing", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	oldDelay := webhookRetryBaseDelay
+	webhookRetryBaseDelay = 20 * time.Millisecond
+	defer func() { webhookRetryBaseDelay = oldDelay }()
+
+	var (
+		access    sync.Mutex
+		failures  = 2
+		attempts  []time.Time
+		delivered = make(chan *Event, 10)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		access.Lock()
+		attempts = append(attempts, time.Now())
+		fail := failures > 0
+		failures--
+		access.Unlock()
+		if request.Header.Get("Content-Type") != "application/json" ||
+			request.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected headers: %v", request.Header)
+		}
+		if fail {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		err := json.NewDecoder(request.Body).Decode(&e)
+		if err != nil {
+			t.Error(err)
+		}
+		delivered <- &e
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(&log.Logger{Writer: &log.IOWriter{Writer: io.Discard}}, &config.EventWebhook{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Types:   []string{TypePlayerLogin},
+	})
+	defer sink.Close()
+	sink.Send(&Event{Type: TypePlayerDisconnect}) // filtered
+	sink.Send(&Event{Type: TypePlayerLogin, Player: "Steve"})
+
+	select {
+	case e := <-delivered:
+		if e.Type != TypePlayerLogin || e.Player != "Steve" {
+			t.Errorf("delivered event %+v, want the login of Steve", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is not delivered")
+	}
+	access.Lock()
+	defer access.Unlock()
+	if len(attempts) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(attempts))
+	}
+	// the delay doubles after each retry
+	if delay := attempts[1].Sub(attempts[0]); delay < webhookRetryBaseDelay {
+		t.Errorf("first retry after %s, want at least %s", delay, webhookRetryBaseDelay)
+	}
+	if delay := attempts[2].Sub(attempts[1]); delay < 2*webhookRetryBaseDelay {
+		t.Errorf("second retry after %s, want at least %s", delay, 2*webhookRetryBaseDelay)
+	}
+}
+
+func TestWebhookSinkGiveUp(t *testing.T) {
+	oldDelay := webhookRetryBaseDelay
+	webhookRetryBaseDelay = time.Millisecond
+	defer func() { webhookRetryBaseDelay = oldDelay }()
+
+	for _, testCase := range []struct {
+		maxRetries   int
+		wantAttempts int
+	}{
+		{-1, 1},
+		{2, 3},
+	} {
+		attempts := make(chan struct{}, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			attempts <- struct{}{}
+			writer.WriteHeader(http.StatusInternalServerError)
+		}))
+		logBuffer := &syncBuffer{}
+		sink := NewWebhookSink(&log.Logger{Writer: &log.IOWriter{Writer: logBuffer}}, &config.EventWebhook{
+			URL:        server.URL,
+			MaxRetries: testCase.maxRetries,
+		})
+		sink.Send(&Event{Type: TypePlayerLogin})
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(logBuffer.String(), "Failed to deliver event to webhook") {
+			if time.Now().After(deadline) {
+				t.Fatalf("max retries %d: giving up is not logged", testCase.maxRetries)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		sink.Close()
+		server.Close()
+		if len(attempts) != testCase.wantAttempts {
+			t.Errorf("max retries %d: got %d attempts, want %d", testCase.maxRetries, len(attempts), testCase.wantAttempts)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	sink := NewFileSink(&config.EventFile{
+		LogFile: config.LogFile{Path: path},
+		Types:   []string{TypePlayerLogin, TypePlayerDisconnect},
+	})
+	sink.Send(&Event{Type: TypePlayerLogin, Player: "Steve"})
+	sink.Send(&Event{Type: TypeAccessRejected, Source: "192.0.2.1:50000"}) // filtered
+	sink.Send(&Event{Type: TypePlayerDisconnect, Player: "Steve", Duration: 90_000_000_000})
+	err := sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), content)
+	}
+	for index, wantType := range []string{TypePlayerLogin, TypePlayerDisconnect} {
+		var e Event
+		err = json.Unmarshal([]byte(lines[index]), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != wantType || e.Player != "Steve" {
+			t.Errorf("line %d: got event %+v, want %s of Steve", index, e, wantType)
+		}
+	}
+	if !strings.Contains(lines[1], `"duration":"1m30s"`) {
+		t.Errorf("duration is not formatted: %s", lines[1])
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	access sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.access.Lock()
+	defer b.access.Unlock()
+	return b.buffer.String()
+}
@@ -0,0 +1,40 @@
+package event
+
+import (
+	"encoding/json"
+
+	"github.com/layou233/zbproxy/v3/common/logging"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+// FileSink appends every event as a JSON line to the file.
+type FileSink struct {
+	config *config.EventFile
+	writer *logging.FileWriter
+	filter map[string]bool
+}
+
+var _ Sink = (*FileSink)(nil)
+
+func NewFileSink(newConfig *config.EventFile) *FileSink {
+	return &FileSink{
+		config: newConfig,
+		writer: logging.NewFileWriter(newConfig.FileOptions()),
+		filter: typeFilter(newConfig.Types),
+	}
+}
+
+func (s *FileSink) Send(e *Event) {
+	if s.filter != nil && !s.filter[e.Type] {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.writer.Write(append(line, '\n'))
+}
+
+func (s *FileSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,116 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+// CheckConfig validates the config without creating sinks.
+func CheckConfig(newConfig *config.Events) error {
+	if newConfig == nil {
+		return nil
+	}
+	for _, webhookConfig := range newConfig.Webhooks {
+		u, err := url.Parse(webhookConfig.URL)
+		if err != nil {
+			return fmt.Errorf("bad webhook URL [%s]: %w", webhookConfig.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("bad webhook URL [%s]: unsupported scheme", webhookConfig.URL)
+		}
+		err = checkTypes(webhookConfig.Types)
+		if err != nil {
+			return err
+		}
+	}
+	for _, fileConfig := range newConfig.Files {
+		if fileConfig.Path == "" {
+			return errors.New("event file path is empty")
+		}
+		err := checkTypes(fileConfig.Types)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSinks creates all the sinks described by the config.
+// The sinks in current with unchanged config are reused, so their queued events are kept.
+func NewSinks(logger *log.Logger, newConfig *config.Events, current []Sink) ([]Sink, error) {
+	err := CheckConfig(newConfig)
+	if err != nil || newConfig == nil {
+		return nil, err
+	}
+
+	reused := make(map[Sink]bool)
+	findSink := func(matches func(sink Sink) bool) Sink {
+		for _, sink := range current {
+			if !reused[sink] && matches(sink) {
+				reused[sink] = true
+				return sink
+			}
+		}
+		return nil
+	}
+	sinks := make([]Sink, 0, len(newConfig.Webhooks)+len(newConfig.Files))
+	for _, webhookConfig := range newConfig.Webhooks {
+		sink := findSink(func(sink Sink) bool {
+			webhookSink, isWebhook := sink.(*WebhookSink)
+			return isWebhook && reflect.DeepEqual(webhookSink.config, webhookConfig)
+		})
+		if sink == nil {
+			sink = NewWebhookSink(logger, webhookConfig)
+		}
+		sinks = append(sinks, sink)
+	}
+	for _, fileConfig := range newConfig.Files {
+		sink := findSink(func(sink Sink) bool {
+			fileSink, isFile := sink.(*FileSink)
+			return isFile && reflect.DeepEqual(fileSink.config, fileConfig)
+		})
+		if sink == nil {
+			sink = NewFileSink(fileConfig)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// CloseSinks closes the sinks which are not in kept.
+func CloseSinks(sinks []Sink, kept []Sink) {
+	for _, sink := range sinks {
+		isKept := false
+		for _, keptSink := range kept {
+			if sink == keptSink {
+				isKept = true
+				break
+			}
+		}
+		if !isKept {
+			sink.Close()
+		}
+	}
+}
+
+func checkTypes(types []string) error {
+	for _, t := range types {
+		found := false
+		for _, known := range Types {
+			if t == known {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown event type: %s", t)
+		}
+	}
+	return nil
+}
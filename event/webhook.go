@@ -0,0 +1,144 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/version"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultWebhookMaxRetries = 3
+)
+
+// webhookRetryBaseDelay is the delay before the first retry, it doubles after each retry.
+var webhookRetryBaseDelay = time.Second
+
+// WebhookSink POSTs every event as JSON to the URL.
+// Failed requests are retried with exponential backoff.
+type WebhookSink struct {
+	logger     *log.Logger
+	config     *config.EventWebhook
+	client     *http.Client
+	maxRetries int
+	filter     map[string]bool
+	queue      chan *Event
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+var _ Sink = (*WebhookSink)(nil)
+
+func NewWebhookSink(logger *log.Logger, newConfig *config.EventWebhook) *WebhookSink {
+	timeout := time.Duration(newConfig.Timeout)
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	maxRetries := newConfig.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultWebhookMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &WebhookSink{
+		logger:     logger,
+		config:     newConfig,
+		client:     &http.Client{Timeout: timeout},
+		maxRetries: maxRetries,
+		filter:     typeFilter(newConfig.Types),
+		queue:      make(chan *Event, queueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	go s.loop()
+	return s
+}
+
+func (s *WebhookSink) Send(e *Event) {
+	if s.filter != nil && !s.filter[e.Type] {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		s.logger.Warn().
+			Str("url", s.config.URL).
+			Str("type", e.Type).
+			Msg("Webhook queue is full, dropped event")
+	}
+}
+
+func (s *WebhookSink) loop() {
+	for {
+		select {
+		case e := <-s.queue:
+			body, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			s.deliver(e, body)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *WebhookSink) deliver(e *Event, body []byte) {
+	delay := webhookRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := s.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= s.maxRetries {
+			s.logger.Warn().
+				Str("url", s.config.URL).
+				Str("type", e.Type).
+				Int("attempts", attempt+1).
+				Err(err).
+				Msg("Failed to deliver event to webhook")
+			return
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *WebhookSink) post(body []byte) error {
+	request, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "zbproxy/"+version.Version)
+	for key, value := range s.config.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	s.cancel()
+	return nil
+}
@@ -0,0 +1,97 @@
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Database is a MaxMind-format database, which can be reloaded in place.
+type Database struct {
+	path   string
+	reader atomic.Pointer[maxminddb.Reader]
+
+	access  sync.Mutex // serializes reloading
+	size    int64
+	modTime time.Time
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	Number uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// Open loads the database at path.
+func Open(path string) (*Database, error) {
+	d := &Database{path: path}
+	_, err := d.reload()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Database) Path() string {
+	return d.path
+}
+
+// reload loads the file again if it is changed, and returns false if not.
+func (d *Database) reload() (bool, error) {
+	d.access.Lock()
+	defer d.access.Unlock()
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+	if d.reader.Load() != nil && info.Size() == d.size && info.ModTime().Equal(d.modTime) {
+		return false, nil
+	}
+	// read into memory instead of mmap, so that the old reader stays valid for running lookups
+	content, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+	reader, err := maxminddb.FromBytes(content)
+	if err != nil {
+		return false, err
+	}
+	d.reader.Store(reader)
+	d.size = info.Size()
+	d.modTime = info.ModTime()
+	return true, nil
+}
+
+// Country returns the upper case ISO country code of addr, or empty if not found.
+// The registered country is used if the country is unknown.
+func (d *Database) Country(addr netip.Addr) string {
+	var record countryRecord
+	if d.reader.Load().Lookup(net.IP(addr.AsSlice()), &record) != nil {
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// ASN returns the autonomous system number of addr, or 0 if not found.
+func (d *Database) ASN(addr netip.Addr) uint32 {
+	var record asnRecord
+	if d.reader.Load().Lookup(net.IP(addr.AsSlice()), &record) != nil {
+		return 0
+	}
+	return record.Number
+}
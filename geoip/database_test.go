@@ -0,0 +1,249 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+// writeDatabase writes a minimal IPv4 MaxMind DB with record size 24,
+// mapping each prefix to its record. Prefixes must not overlap.
+func writeDatabase(t *testing.T, path string, databaseType string, records map[string]map[string]any) {
+	t.Helper()
+	type node struct {
+		children [2]*node
+		data     int // offset in the data section plus one, 0 if not a leaf
+	}
+	var (
+		root = &node{}
+		data []byte
+	)
+	prefixes := make([]string, 0, len(records))
+	for prefix := range records {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		parsed := netip.MustParsePrefix(prefix)
+		address := parsed.Addr().As4()
+		current := root
+		for i := 0; i < parsed.Bits(); i++ {
+			bit := address[i/8] >> (7 - i%8) & 1
+			if current.children[bit] == nil {
+				current.children[bit] = &node{}
+			}
+			current = current.children[bit]
+		}
+		current.data = len(data) + 1
+		data = append(data, encodeValue(records[prefix])...)
+	}
+
+	// number the inner nodes in breadth-first order
+	nodes := []*node{root}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil && child.data == 0 {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	index := make(map[*node]int, len(nodes))
+	for i, n := range nodes {
+		index[n] = i
+	}
+	nodeCount := len(nodes)
+	var tree []byte
+	for _, n := range nodes {
+		for _, child := range n.children {
+			record := nodeCount // not found
+			if child != nil {
+				if child.data != 0 {
+					record = nodeCount + 16 + child.data - 1
+				} else {
+					record = index[child]
+				}
+			}
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+
+	buffer := &bytes.Buffer{}
+	buffer.Write(tree)
+	buffer.Write(make([]byte, 16))
+	buffer.Write(data)
+	buffer.WriteString("\xab\xcd\xefMaxMind.com")
+	buffer.Write(encodeValue(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               databaseType,
+		"description":                 map[string]any{},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	}))
+	err := os.WriteFile(path, buffer.Bytes(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encodeValue encodes value in the data section format of MaxMind DB.
+func encodeValue(value any) []byte {
+	control := func(dataType int, size int) []byte {
+		if size >= 29 {
+			panic("size is too large for the test encoder")
+		}
+		if dataType > 7 {
+			return []byte{byte(size), byte(dataType - 7)}
+		}
+		return []byte{byte(dataType<<5 | size)}
+	}
+	unsigned := func(dataType int, number uint64) []byte {
+		var content [8]byte
+		binary.BigEndian.PutUint64(content[:], number)
+		trimmed := bytes.TrimLeft(content[:], "\x00")
+		return append(control(dataType, len(trimmed)), trimmed...)
+	}
+	switch value := value.(type) {
+	case string:
+		return append(control(2, len(value)), value...)
+	case uint16:
+		return unsigned(5, uint64(value))
+	case uint32:
+		return unsigned(6, uint64(value))
+	case uint64:
+		return unsigned(9, value)
+	case []any:
+		result := control(11, len(value))
+		for _, item := range value {
+			result = append(result, encodeValue(item)...)
+		}
+		return result
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		result := control(7, len(value))
+		for _, key := range keys {
+			result = append(result, encodeValue(key)...)
+			result = append(result, encodeValue(value[key])...)
+		}
+		return result
+	}
+	panic("unsupported type for the test encoder")
+}
+
+func country(code string) map[string]any {
+	return map[string]any{"country": map[string]any{"iso_code": code}}
+}
+
+func TestDatabase(t *testing.T) {
+	directory := t.TempDir()
+	countryPath := filepath.Join(directory, "country.mmdb")
+	writeDatabase(t, countryPath, "GeoLite2-Country", map[string]map[string]any{
+		"1.0.0.0/8":   country("AU"),
+		"3.2.0.0/16":  country("CN"),
+		"2.0.0.0/8":   {"registered_country": map[string]any{"iso_code": "FR"}},
+		"10.1.2.0/24": country("US"),
+	})
+	asnPath := filepath.Join(directory, "asn.mmdb")
+	writeDatabase(t, asnPath, "GeoLite2-ASN", map[string]map[string]any{
+		"1.0.0.0/8": {"autonomous_system_number": uint32(13335)},
+	})
+
+	countryDatabase, err := Open(countryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]string{
+		"1.1.1.1":   "AU",
+		"3.2.3.4":   "CN",
+		"3.3.3.3":   "",
+		"2.2.2.2":   "FR",
+		"10.1.2.3":  "US",
+		"10.1.3.1":  "",
+		"192.0.2.1": "",
+	} {
+		actual := countryDatabase.Country(netip.MustParseAddr(address))
+		if actual != expected {
+			t.Errorf("country of %s: got %q, want %q", address, actual, expected)
+		}
+	}
+
+	asnDatabase, err := Open(asnPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asn := asnDatabase.ASN(netip.MustParseAddr("1.1.1.1")); asn != 13335 {
+		t.Errorf("ASN of 1.1.1.1: got %d, want 13335", asn)
+	}
+	if asn := asnDatabase.ASN(netip.MustParseAddr("2.2.2.2")); asn != 0 {
+		t.Errorf("ASN of 2.2.2.2: got %d, want 0", asn)
+	}
+
+	_, err = Open(filepath.Join(directory, "missing.mmdb"))
+	if err == nil {
+		t.Error("opened a missing database")
+	}
+}
+
+func TestManagerReusesDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeDatabase(t, path, "GeoLite2-Country", map[string]map[string]any{
+		"1.0.0.0/8": country("AU"),
+	})
+	manager := NewManager(context.Background(), &log.Logger{Writer: &log.IOWriter{Writer: io.Discard}})
+	defer manager.Close()
+	newConfig := &config.GeoIP{Country: path, Interval: -1}
+	databases, err := manager.Prepare(newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Commit(databases)
+
+	// the file is changed without the reload loop running
+	writeDatabase(t, path, "GeoLite2-Country", map[string]map[string]any{
+		"1.0.0.0/8": country("NZ"),
+		"2.0.0.0/8": country("FR"),
+	})
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := manager.Prepare(newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Country != databases.Country {
+		t.Error("database of the same path is opened again")
+	}
+	if actual := reloaded.Country.Country(netip.MustParseAddr("1.1.1.1")); actual != "NZ" {
+		t.Errorf("reused database is not reloaded, got %q, want %q", actual, "NZ")
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.Prepare(newConfig)
+	if err == nil {
+		t.Error("prepared a database whose file is removed")
+	}
+}
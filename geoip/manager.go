@@ -0,0 +1,125 @@
+package geoip
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+// Manager opens the databases in config, and reloads them in background when changed.
+type Manager struct {
+	ctx       context.Context
+	logger    *log.Logger
+	access    sync.Mutex
+	databases *Databases
+	cancel    context.CancelFunc
+}
+
+// Databases are the opened databases prepared by Manager.Prepare, nil if not configured.
+type Databases struct {
+	Country  *Database
+	ASN      *Database
+	interval time.Duration
+}
+
+func NewManager(ctx context.Context, logger *log.Logger) *Manager {
+	return &Manager{
+		ctx:    ctx,
+		logger: logger,
+	}
+}
+
+// Prepare opens the databases in newConfig without affecting m.
+// Opened databases with unchanged paths are reused and reloaded instead of opening again.
+func (m *Manager) Prepare(newConfig *config.GeoIP) (*Databases, error) {
+	if newConfig == nil {
+		return &Databases{}, nil
+	}
+	m.access.Lock()
+	oldDatabases := m.databases
+	m.access.Unlock()
+	databases := &Databases{interval: newConfig.GetInterval()}
+	var err error
+	databases.Country, err = m.open(newConfig.Country, oldDatabases)
+	if err != nil {
+		return nil, common.Cause("open GeoIP country database: ", err)
+	}
+	databases.ASN, err = m.open(newConfig.ASN, oldDatabases)
+	if err != nil {
+		return nil, common.Cause("open GeoIP ASN database: ", err)
+	}
+	return databases, nil
+}
+
+func (m *Manager) open(path string, oldDatabases *Databases) (*Database, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if oldDatabases != nil {
+		for _, database := range []*Database{oldDatabases.Country, oldDatabases.ASN} {
+			if database != nil && database.path == path {
+				// the file may be changed while the reload loop is disabled
+				_, err := database.reload()
+				if err != nil {
+					return nil, err
+				}
+				return database, nil
+			}
+		}
+	}
+	return Open(path)
+}
+
+// Commit starts reloading the prepared databases, and stops reloading the old ones.
+func (m *Manager) Commit(staged *Databases) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+	m.databases = staged
+	if staged.interval > 0 && (staged.Country != nil || staged.ASN != nil) {
+		var ctx context.Context
+		ctx, m.cancel = context.WithCancel(m.ctx)
+		go m.reloadLoop(ctx, staged)
+	}
+}
+
+// Close stops reloading the databases.
+func (m *Manager) Close() {
+	m.Commit(&Databases{})
+}
+
+func (m *Manager) reloadLoop(ctx context.Context, databases *Databases) {
+	ticker := time.NewTicker(databases.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, database := range []*Database{databases.Country, databases.ASN} {
+			if database == nil {
+				continue
+			}
+			changed, err := database.reload()
+			if err != nil {
+				m.logger.Warn().
+					Str("path", database.path).
+					Err(err).
+					Msg("Failed to reload GeoIP database, keeping the old one")
+			} else if changed {
+				m.logger.Info().
+					Str("path", database.path).
+					Msg("GeoIP database reloaded")
+			}
+		}
+	}
+}
@@ -3,9 +3,13 @@ module github.com/layou233/zbproxy/v3
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/phuslu/log v1.0.107
 	github.com/zhangyunhao116/fastrand v0.4.0
 	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba
 	golang.org/x/sys v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/oschwald/maxminddb-golang v1.12.0
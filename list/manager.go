@@ -0,0 +1,146 @@
+package list
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+// Manager loads lists from providers, and refreshes them in background.
+type Manager struct {
+	ctx       context.Context
+	logger    *log.Logger
+	onChange  func()
+	access    sync.Mutex
+	providers map[string]*provider
+}
+
+// Providers are the loaded providers prepared by Manager.Prepare.
+type Providers struct {
+	providers map[string]*provider
+}
+
+// NewManager creates a manager, onChange is called after any list is refreshed and changed.
+func NewManager(ctx context.Context, logger *log.Logger, onChange func()) *Manager {
+	return &Manager{
+		ctx:      ctx,
+		logger:   logger,
+		onChange: onChange,
+	}
+}
+
+// Prepare loads all the providers in newConfig without affecting m.
+// Loaded providers with unchanged config are reused instead of loading again.
+func (m *Manager) Prepare(newConfig map[string]*config.ListProvider) (*Providers, error) {
+	m.access.Lock()
+	oldProviders := m.providers
+	m.access.Unlock()
+	providers := make(map[string]*provider, len(newConfig))
+	for tag, providerConfig := range newConfig {
+		if oldProvider, ok := oldProviders[tag]; ok && reflect.DeepEqual(oldProvider.config, providerConfig) {
+			providers[tag] = oldProvider
+			continue
+		}
+		newProvider, err := newProvider(tag, providerConfig)
+		if err != nil {
+			return nil, err
+		}
+		_, err = newProvider.load(m.ctx)
+		if err != nil {
+			return nil, common.Cause("load list ["+tag+"]: ", err)
+		}
+		providers[tag] = newProvider
+	}
+	return &Providers{providers: providers}, nil
+}
+
+// Commit starts refreshing the prepared providers, and stops the ones not used anymore.
+func (m *Manager) Commit(staged *Providers) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for tag, oldProvider := range m.providers {
+		if staged.providers[tag] != oldProvider && oldProvider.cancel != nil {
+			oldProvider.cancel()
+		}
+	}
+	for _, p := range staged.providers {
+		if p.cancel == nil && p.config.GetInterval() > 0 {
+			var ctx context.Context
+			ctx, p.cancel = context.WithCancel(m.ctx)
+			go m.refreshLoop(ctx, p)
+		}
+	}
+	m.providers = staged.providers
+}
+
+// Close stops refreshing all the providers.
+func (m *Manager) Close() {
+	m.Commit(&Providers{})
+}
+
+func (m *Manager) refreshLoop(ctx context.Context, p *provider) {
+	ticker := time.NewTicker(p.config.GetInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		changed, err := p.load(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				m.logger.Warn().
+					Str("list", p.tag).
+					Err(err).
+					Msg("Failed to refresh list, keeping the old entries")
+			}
+			continue
+		}
+		if changed {
+			m.logger.Info().
+				Str("list", p.tag).
+				Int("entries", len(p.Entries())).
+				Msg("List changed")
+			if m.onChange != nil {
+				m.onChange()
+			}
+		}
+	}
+}
+
+// Merge returns the inline lists with the entries of providers added.
+// lists is not modified.
+func (p *Providers) Merge(lists map[string]set.StringSet) map[string]set.StringSet {
+	if p == nil || len(p.providers) == 0 {
+		return lists
+	}
+	merged := make(map[string]set.StringSet, len(lists)+len(p.providers))
+	for tag, list := range lists {
+		merged[tag] = list
+	}
+	for tag, provider := range p.providers {
+		entries := provider.Entries()
+		inline, ok := merged[tag]
+		if !ok {
+			merged[tag] = entries
+			continue
+		}
+		union := make(set.StringSet, len(inline)+len(entries))
+		for item := range inline {
+			union.Add(item)
+		}
+		for item := range entries {
+			union.Add(item)
+		}
+		merged[tag] = union
+	}
+	return merged
+}
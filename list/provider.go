@@ -0,0 +1,223 @@
+package list
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+// maxListSize limits the size of a list downloaded from URL.
+const maxListSize = 64 << 20
+
+var errNotModified = errors.New("not modified")
+
+// CheckConfig validates the config without loading.
+func CheckConfig(tag string, newConfig *config.ListProvider) error {
+	if newConfig == nil {
+		return errors.New("list provider [" + tag + "] is empty")
+	}
+	if (newConfig.Path == "") == (newConfig.URL == "") {
+		return errors.New("list provider [" + tag + "] requires one of Path and URL")
+	}
+	if newConfig.URL != "" {
+		u, err := url.Parse(newConfig.URL)
+		if err != nil {
+			return fmt.Errorf("bad list URL [%s]: %w", newConfig.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("bad list URL [%s]: unsupported scheme", newConfig.URL)
+		}
+	}
+	return nil
+}
+
+type provider struct {
+	tag    string
+	config *config.ListProvider
+	client *http.Client
+	cancel context.CancelFunc // nil if not refreshing
+
+	access  sync.RWMutex
+	entries set.StringSet
+
+	// used for detecting changes
+	fileStates   map[string]fileState
+	etag         string
+	lastModified string
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+func newProvider(tag string, newConfig *config.ListProvider) (*provider, error) {
+	err := CheckConfig(tag, newConfig)
+	if err != nil {
+		return nil, err
+	}
+	p := &provider{
+		tag:    tag,
+		config: newConfig,
+	}
+	if newConfig.URL != "" {
+		p.client = &http.Client{Timeout: newConfig.GetTimeout()}
+	}
+	return p, nil
+}
+
+func (p *provider) Entries() set.StringSet {
+	p.access.RLock()
+	defer p.access.RUnlock()
+	return p.entries
+}
+
+// load loads the list, and returns false if it is not changed.
+func (p *provider) load(ctx context.Context) (bool, error) {
+	var (
+		entries set.StringSet
+		err     error
+	)
+	if p.config.URL != "" {
+		entries, err = p.loadURL(ctx)
+	} else {
+		entries, err = p.loadPath()
+	}
+	if errors.Is(err, errNotModified) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	p.access.Lock()
+	p.entries = entries // replaced instead of modified, since routers may hold the old one
+	p.access.Unlock()
+	return true, nil
+}
+
+func (p *provider) loadPath() (set.StringSet, error) {
+	info, err := os.Stat(p.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{p.config.Path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(p.config.Path) // sorted by name
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(p.config.Path, entry.Name()))
+		}
+	}
+
+	fileStates := make(map[string]fileState, len(files))
+	for _, file := range files {
+		info, err = os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		fileStates[file] = fileState{size: info.Size(), modTime: info.ModTime()}
+	}
+	if p.entries != nil && sameFileStates(p.fileStates, fileStates) {
+		return nil, errNotModified
+	}
+
+	entries := make(set.StringSet)
+	for _, file := range files {
+		err = readFile(file, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.fileStates = fileStates
+	return entries, nil
+}
+
+func sameFileStates(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, state := range a {
+		if b[file] != state {
+			return false
+		}
+	}
+	return true
+}
+
+func readFile(path string, entries set.StringSet) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return parseList(file, entries)
+}
+
+func (p *provider) loadURL(ctx context.Context) (set.StringSet, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.entries != nil {
+		if p.etag != "" {
+			request.Header.Set("If-None-Match", p.etag)
+		}
+		if p.lastModified != "" {
+			request.Header.Set("If-Modified-Since", p.lastModified)
+		}
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if p.entries != nil {
+			return nil, errNotModified
+		}
+		fallthrough
+	default:
+		return nil, errors.New("unexpected status: " + response.Status)
+	}
+
+	entries := make(set.StringSet)
+	err = parseList(io.LimitReader(response.Body, maxListSize), entries)
+	if err != nil {
+		return nil, err
+	}
+	p.etag = response.Header.Get("ETag")
+	p.lastModified = response.Header.Get("Last-Modified")
+	return entries, nil
+}
+
+// parseList reads one entry per line, empty lines and comments starting with "#" are skipped.
+func parseList(reader io.Reader, entries set.StringSet) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			entries.Add(line)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,110 @@
+package list
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+func TestProviderURL(t *testing.T) {
+	var (
+		access   sync.Mutex
+		content  = "# players\nSteve\nAlex # admin\n\n"
+		etag     = `"v1"`
+		status   = http.StatusOK
+		requests []string // If-None-Match of each request
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		access.Lock()
+		defer access.Unlock()
+		requests = append(requests, request.Header.Get("If-None-Match"))
+		if status != http.StatusOK {
+			writer.WriteHeader(status)
+			return
+		}
+		if request.Header.Get("If-None-Match") == etag {
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writer.Header().Set("ETag", etag)
+		writer.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	p, err := newProvider("players", &config.ListProvider{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	checkLoad := func(wantChanged bool, wantEntries ...string) {
+		t.Helper()
+		changed, err := p.load(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != wantChanged {
+			t.Errorf("load changed %v, want %v", changed, wantChanged)
+		}
+		entries := p.Entries()
+		if len(entries) != len(wantEntries) {
+			t.Errorf("got entries %v, want %v", entries, wantEntries)
+		}
+		for _, entry := range wantEntries {
+			if !entries.Has(entry) {
+				t.Errorf("entry %s is not loaded, got %v", entry, entries)
+			}
+		}
+	}
+
+	checkLoad(true, "Steve", "Alex")
+	checkLoad(false, "Steve", "Alex")
+
+	access.Lock()
+	content, etag = "Notch\n", `"v2"`
+	access.Unlock()
+	checkLoad(true, "Notch")
+
+	access.Lock()
+	status = http.StatusInternalServerError
+	access.Unlock()
+	_, err = p.load(ctx)
+	if err == nil {
+		t.Error("load succeeded with status 500")
+	}
+	if entries := p.Entries(); len(entries) != 1 || !entries.Has("Notch") {
+		t.Errorf("entries are changed to %v after a failed load", entries)
+	}
+
+	access.Lock()
+	defer access.Unlock()
+	expected := []string{"", `"v1"`, `"v1"`, `"v2"`}
+	if len(requests) != len(expected) {
+		t.Fatalf("got If-None-Match %q, want %q", requests, expected)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Fatalf("got If-None-Match %q, want %q", requests, expected)
+		}
+	}
+}
+
+func TestProviderURLNotModifiedFirst(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	p, err := newProvider("players", &config.ListProvider{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing is loaded yet, so 304 is unexpected
+	_, err = p.load(context.Background())
+	if err == nil {
+		t.Error("load succeeded with status 304 before any list is loaded")
+	}
+}
@@ -0,0 +1,136 @@
+package zbproxy
+
+import (
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/layou233/zbproxy/v3/common/logging"
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+const logTimeFormat = "2006-01-02 15:04:05-0700"
+
+type moduleLoggers struct {
+	router   *log.Logger
+	service  *log.Logger
+	outbound *log.Logger
+	config   *log.Logger
+}
+
+func newModuleLoggers(writer log.Writer) moduleLoggers {
+	newLogger := func(module string) *log.Logger {
+		return &log.Logger{
+			TimeFormat: logTimeFormat,
+			Context:    log.NewContext(nil).Str("module", module).Value(),
+			Writer:     writer,
+		}
+	}
+	return moduleLoggers{
+		router:   newLogger("router"),
+		service:  newLogger("service"),
+		outbound: newLogger("outbound"),
+		config:   newLogger("config"),
+	}
+}
+
+func (l moduleLoggers) forEach(f func(module string, logger *log.Logger)) {
+	f("router", l.router)
+	f("service", l.service)
+	f("outbound", l.outbound)
+	f("config", l.config)
+}
+
+// newLogWriter creates the log writer described by the config.
+func newLogWriter(logConfig *config.Log) (log.Writer, io.Closer) {
+	var output io.Writer
+	switch logConfig.Output {
+	case config.LogOutputFile:
+		fileWriter := logging.NewFileWriter(logConfig.File.FileOptions())
+		if logConfig.Format == config.LogFormatJSON {
+			return fileWriter, fileWriter
+		}
+		return &log.ConsoleWriter{
+			Writer:         fileWriter,
+			EndWithMessage: true,
+		}, fileWriter
+	case config.LogOutputSyslog:
+		syslogWriter := &log.SyslogWriter{
+			Network: "unixgram",
+			Address: "/dev/log",
+			Tag:     "zbproxy",
+		}
+		if logConfig.Syslog != nil {
+			if logConfig.Syslog.Network != "" {
+				syslogWriter.Network = logConfig.Syslog.Network
+			}
+			if logConfig.Syslog.Address != "" {
+				syslogWriter.Address = logConfig.Syslog.Address
+			}
+			if logConfig.Syslog.Tag != "" {
+				syslogWriter.Tag = logConfig.Syslog.Tag
+			}
+		}
+		return syslogWriter, syslogWriter
+	case config.LogOutputStderr:
+		output = os.Stderr
+	default:
+		output = os.Stdout
+	}
+	if logConfig.Format == config.LogFormatJSON {
+		return &log.IOWriter{Writer: output}, nil
+	}
+	return &log.ConsoleWriter{
+		Writer:         output,
+		ColorOutput:    true,
+		EndWithMessage: true,
+	}, nil
+}
+
+// configureLoggers applies the log config to all the loggers of the instance.
+// The writer is only replaced if it is not provided by the embedder.
+// Loggers are shared by running components, so this must be done before starting them.
+func (i *Instance) configureLoggers(customWriter bool) {
+	if !customWriter {
+		var closer io.Closer
+		i.logger.Writer, closer = newLogWriter(&i.config.Log)
+		if closer != nil {
+			go func() {
+				<-i.ctx.Done()
+				closer.Close()
+			}()
+		}
+	}
+	i.logger.Level = i.config.Log.Level
+	i.appliedLogConfig = i.config.Log
+	i.loggers.forEach(func(module string, logger *log.Logger) {
+		logger.Writer = i.logger.Writer
+		logger.Level = i.config.Log.ModuleLevel(module)
+	})
+}
+
+// updateLogLevels applies the levels of the reloaded log config to the running loggers,
+// and warns if the output is changed, which is only applied on restart.
+func (i *Instance) updateLogLevels(newConfig *config.Log) {
+	if newConfig.Level != i.appliedLogConfig.Level {
+		i.logger.SetLevel(newConfig.Level)
+	}
+	i.loggers.forEach(func(module string, logger *log.Logger) {
+		level := newConfig.ModuleLevel(module)
+		if level != i.appliedLogConfig.ModuleLevel(module) {
+			logger.SetLevel(level)
+		}
+	})
+	outputChanged := newConfig.Output != i.appliedLogConfig.Output ||
+		newConfig.Format != i.appliedLogConfig.Format ||
+		!reflect.DeepEqual(newConfig.File, i.appliedLogConfig.File) ||
+		!reflect.DeepEqual(newConfig.Syslog, i.appliedLogConfig.Syslog)
+	i.appliedLogConfig.Level = newConfig.Level
+	i.appliedLogConfig.Modules = newConfig.Modules
+	if outputChanged {
+		i.logger.Warn().
+			Msg("Log output is changed, restart zbproxy to apply it")
+	}
+}
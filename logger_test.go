@@ -0,0 +1,64 @@
+package zbproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+func TestUpdateLogLevels(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writer := &log.IOWriter{Writer: buffer}
+	i := &Instance{
+		logger:  &log.Logger{Writer: writer},
+		loggers: newModuleLoggers(writer),
+		config: &config.Root{
+			Log: config.Log{
+				Level:   log.InfoLevel,
+				Modules: map[string]log.Level{"router": log.WarnLevel},
+			},
+		},
+	}
+	i.configureLoggers(true)
+	i.loggers.router.Info().Msg("router info 1")
+	i.loggers.service.Debug().Msg("service debug 1")
+
+	i.updateLogLevels(&config.Log{
+		Level:   log.InfoLevel,
+		Modules: map[string]log.Level{"router": log.DebugLevel, "service": log.DebugLevel},
+	})
+	i.loggers.router.Info().Msg("router info 2")
+	i.loggers.service.Debug().Msg("service debug 2")
+	i.loggers.outbound.Debug().Msg("outbound debug")
+
+	output := buffer.String()
+	for message, want := range map[string]bool{
+		"router info 1":   false,
+		"service debug 1": false,
+		"router info 2":   true,
+		"service debug 2": true,
+		"outbound debug":  false,
+	} {
+		if strings.Contains(output, message) != want {
+			t.Errorf("message %q logged: %v, want %v", message, !want, want)
+		}
+	}
+	if strings.Contains(output, "restart zbproxy") {
+		t.Error("warned to restart when only the levels are changed")
+	}
+
+	buffer.Reset()
+	i.updateLogLevels(&config.Log{Level: log.InfoLevel, Format: config.LogFormatJSON})
+	i.loggers.router.Debug().Msg("router debug")
+	output = buffer.String()
+	if strings.Contains(output, "router debug") {
+		t.Error("router level override is not removed")
+	}
+	if !strings.Contains(output, "restart zbproxy") {
+		t.Error("no warning when the log format is changed")
+	}
+}
@@ -0,0 +1,136 @@
+package zbproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/handoff"
+	"github.com/layou233/zbproxy/v3/common/metrics"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+const defaultMetricsPath = "/metrics"
+
+type metricsServer struct {
+	config   config.Metrics
+	path     atomic.Value // string, can be changed without restarting
+	server   *http.Server
+	listener *net.TCPListener
+	done     chan struct{}
+}
+
+func (s *metricsServer) handoffKey() string {
+	return "metrics:" + s.config.Listen
+}
+
+func (s *metricsServer) setConfig(newConfig config.Metrics) {
+	s.config = newConfig
+	path := newConfig.Path
+	if path == "" {
+		path = defaultMetricsPath
+	}
+	s.path.Store(path)
+}
+
+func (s *metricsServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != s.path.Load().(string) {
+		http.NotFound(writer, request)
+		return
+	}
+	metrics.DefaultRegistry.ServeHTTP(writer, request)
+}
+
+func (s *metricsServer) Close() error {
+	close(s.done)
+	return s.server.Close()
+}
+
+// updateMetricsServer starts, restarts or stops the metrics HTTP server
+// to make it consistent with newConfig.
+func (i *Instance) updateMetricsServer(newConfig *config.Metrics) error {
+	server, err := i.prepareMetricsServer(newConfig)
+	if err != nil {
+		return err
+	}
+	i.commitMetricsServer(server, newConfig)
+	return nil
+}
+
+// prepareMetricsServer binds the listener of newConfig if the listen address is changed,
+// without changing the running server. The result must be either committed or discarded.
+func (i *Instance) prepareMetricsServer(newConfig *config.Metrics) (*metricsServer, error) {
+	if newConfig == nil {
+		return nil, nil
+	}
+	if i.metricsServer != nil && i.metricsServer.config.Listen == newConfig.Listen {
+		// only the path can be changed, which is applied in place
+		return i.metricsServer, nil
+	}
+	server := &metricsServer{
+		done: make(chan struct{}),
+	}
+	server.setConfig(*newConfig)
+	server.server = &http.Server{
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	listener, inherited := handoff.Listener(server.handoffKey())
+	if !inherited {
+		newListener, err := net.Listen("tcp", newConfig.Listen)
+		if err != nil {
+			return nil, common.Cause("start metrics server: ", err)
+		}
+		listener = newListener.(*net.TCPListener)
+	}
+	server.listener = listener
+	return server, nil
+}
+
+// commitMetricsServer replaces the running server with the one prepared for newConfig.
+func (i *Instance) commitMetricsServer(server *metricsServer, newConfig *config.Metrics) {
+	if newConfig != nil {
+		metrics.SetTagKeys(newConfig.TagKeys)
+	} else {
+		metrics.SetTagKeys(nil)
+	}
+	if server != nil && server == i.metricsServer {
+		server.setConfig(*newConfig)
+		return
+	}
+	if i.metricsServer != nil {
+		i.metricsServer.Close()
+		i.metricsServer = nil
+	}
+	if server == nil {
+		return
+	}
+	go func() {
+		err := server.server.Serve(server.listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			i.logger.Error().
+				Err(err).
+				Msg("Metrics server stopped")
+		}
+	}()
+	go func() {
+		select {
+		case <-i.ctx.Done():
+			server.server.Close()
+		case <-server.done:
+		}
+	}()
+	i.metricsServer = server
+	i.logger.Info().
+		Msg("Metrics listening on " + server.listener.Addr().String() + server.path.Load().(string))
+}
+
+// discardMetricsServer closes the listener of server if it is not the running one.
+func (i *Instance) discardMetricsServer(server *metricsServer) {
+	if server != nil && server != i.metricsServer {
+		server.listener.Close()
+	}
+}
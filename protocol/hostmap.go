@@ -0,0 +1,274 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/metrics"
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+// HostMap routes connections to the targets mapped from the sniffed hostname.
+type HostMap struct {
+	logger   *log.Logger
+	config   *config.Outbound
+	router   adapter.Router
+	targets  map[string]*hostMapTarget // keyed by the hostnames in config, in lower case
+	fallback adapter.Outbound          // nil if unmapped hostnames are rejected
+}
+
+type hostMapTarget struct {
+	address  string
+	port     uint16
+	outbound adapter.Outbound
+}
+
+var (
+	_ adapter.Outbound        = (*HostMap)(nil)
+	_ adapter.InjectOutbound  = (*HostMap)(nil)
+	_ adapter.DrainOutbound   = (*HostMap)(nil)
+	_ adapter.InheritOutbound = (*HostMap)(nil)
+)
+
+func NewHostMap(logger *log.Logger, newConfig *config.Outbound) (*HostMap, error) {
+	if newConfig.HostMap == nil {
+		return nil, errors.New("not host map outbound config")
+	}
+	return &HostMap{
+		logger: logger,
+		config: newConfig,
+	}, nil
+}
+
+func (o *HostMap) Name() string {
+	if o.config != nil {
+		return o.config.Name
+	}
+	return ""
+}
+
+func (o *HostMap) PostInitialize(router adapter.Router) error {
+	hostMapConfig := o.config.HostMap
+	targets := make(map[string]*hostMapTarget, len(hostMapConfig.Hosts))
+	for host, targetConfig := range hostMapConfig.Hosts {
+		if targetConfig == nil || targetConfig.TargetAddress == "" {
+			return errors.New("no target address for host [" + host + "]")
+		}
+		err := o.addTarget(targets, host, targetConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if len(hostMapConfig.HostLists) > 0 {
+		lists, err := router.FindListsByTag(hostMapConfig.HostLists)
+		if err != nil {
+			return common.Cause("load host lists: ", err)
+		}
+		for _, list := range lists {
+			for entry := range list {
+				host, targetConfig, err := parseHostMapEntry(entry)
+				if err != nil {
+					return err
+				}
+				err = o.addTarget(targets, host, targetConfig)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for host, target := range targets {
+		err := target.outbound.PostInitialize(router)
+		if err != nil {
+			return common.Cause("initialize host ["+host+"]: ", err)
+		}
+	}
+
+	var fallback adapter.Outbound
+	if hostMapConfig.Fallback != "" {
+		var err error
+		fallback, err = router.FindOutboundByName(hostMapConfig.Fallback)
+		if err != nil {
+			return common.Cause("find fallback outbound: ", err)
+		}
+	}
+	o.targets = targets
+	o.fallback = fallback
+	o.router = router
+	return nil
+}
+
+// parseHostMapEntry parses a list entry like "play.example.net 10.0.0.2:25565".
+func parseHostMapEntry(entry string) (string, *config.HostMapTarget, error) {
+	fields := strings.Fields(entry)
+	if len(fields) != 2 {
+		return "", nil, errors.New("bad host map entry [" + entry + "]")
+	}
+	targetConfig := &config.HostMapTarget{TargetAddress: fields[1]}
+	if host, port, err := net.SplitHostPort(fields[1]); err == nil {
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return "", nil, errors.New("bad port in host map entry [" + entry + "]")
+		}
+		targetConfig.TargetAddress = host
+		targetConfig.TargetPort = uint16(portNumber)
+	}
+	return fields[0], targetConfig, nil
+}
+
+func (o *HostMap) addTarget(targets map[string]*hostMapTarget, host string, targetConfig *config.HostMapTarget) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if _, duplicated := targets[host]; duplicated {
+		return errors.New("duplicated host [" + host + "]")
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return errors.New("bad host [" + host + "]: wildcard is only allowed as the first label")
+	}
+	port := targetConfig.TargetPort
+	if port == 0 {
+		port = o.config.TargetPort
+	}
+	if port == 0 {
+		return errors.New("no target port for host [" + host + "]")
+	}
+	minecraftConfig := targetConfig.Minecraft
+	if minecraftConfig == nil {
+		minecraftConfig = o.config.HostMap.Minecraft
+	}
+	if minecraftConfig != nil {
+		// copied since the Minecraft outbound modifies it when initializing
+		copied := *minecraftConfig
+		minecraftConfig = &copied
+	}
+	outbound, err := NewOutbound(o.logger, &config.Outbound{
+		Name:          o.config.Name + "/" + host, // distinct in logs, metrics and events
+		Dialer:        o.config.Dialer,
+		TargetAddress: targetConfig.TargetAddress,
+		TargetPort:    port,
+		Minecraft:     minecraftConfig,
+		SocketOptions: o.config.SocketOptions,
+		ProxyOptions:  o.config.ProxyOptions,
+	})
+	if err != nil {
+		return common.Cause("initialize host ["+host+"]: ", err)
+	}
+	targets[host] = &hostMapTarget{
+		address:  targetConfig.TargetAddress,
+		port:     port,
+		outbound: outbound,
+	}
+	return nil
+}
+
+// lookup finds the target of hostname, exact hostnames are preferred,
+// then the wildcards and suffixes with more labels.
+func (o *HostMap) lookup(hostname string) *hostMapTarget {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if target, found := o.targets[hostname]; found {
+		return target
+	}
+	if target, found := o.targets["."+hostname]; found {
+		return target
+	}
+	for {
+		dot := strings.IndexByte(hostname, '.')
+		if dot < 0 {
+			return nil
+		}
+		hostname = hostname[dot:]
+		if target, found := o.targets["*"+hostname]; found {
+			return target
+		}
+		if target, found := o.targets[hostname]; found {
+			return target
+		}
+		hostname = hostname[1:]
+	}
+}
+
+func (o *HostMap) Reload(newConfig *config.Outbound) error {
+	o.config = newConfig
+	return o.PostInitialize(o.router)
+}
+
+// Drain makes all the Minecraft targets kick new players with the message.
+func (o *HostMap) Drain(message string) {
+	for _, target := range o.targets {
+		if drainOutbound, ok := target.outbound.(adapter.DrainOutbound); ok {
+			drainOutbound.Drain(message)
+		}
+	}
+}
+
+// Inherit passes the state of the old targets to the targets of the same hostnames.
+func (o *HostMap) Inherit(old adapter.Outbound) {
+	oldHostMap, isHostMap := old.(*HostMap)
+	if !isHostMap {
+		return
+	}
+	for host, target := range o.targets {
+		oldTarget, found := oldHostMap.targets[host]
+		if !found {
+			continue
+		}
+		if inheritOutbound, ok := target.outbound.(adapter.InheritOutbound); ok {
+			inheritOutbound.Inherit(oldTarget.outbound)
+		}
+	}
+}
+
+func (o *HostMap) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, adapter.ErrInjectionRequired
+}
+
+func (o *HostMap) InjectConnection(ctx context.Context, conn *bufio.CachedConn, metadata *adapter.Metadata) error {
+	var hostname string
+	if metadata.Minecraft != nil {
+		hostname = metadata.Minecraft.CleanOriginDestination()
+	} else if metadata.TLS != nil {
+		hostname = metadata.TLS.SNI
+	}
+	target := o.lookup(hostname)
+	if target == nil {
+		if o.fallback == nil {
+			return fmt.Errorf("no target for host [%s]", hostname)
+		}
+		metadata.Stats.Outbound = o.fallback.Name()
+		return relay(ctx, o.fallback, conn, metadata)
+	}
+	metadata.Stats.Outbound = target.outbound.Name()
+	metadata.DestinationHostname = target.address
+	metadata.DestinationPort = target.port
+	return relay(ctx, target.outbound, conn, metadata)
+}
+
+// relay hands the connection to outbound, or dials the destination with it and copies the data.
+func relay(ctx context.Context, outbound adapter.Outbound, conn *bufio.CachedConn, metadata *adapter.Metadata) error {
+	if injectOutbound, isInject := outbound.(adapter.InjectOutbound); isInject {
+		return injectOutbound.InjectConnection(ctx, conn, metadata)
+	}
+	if metadata.DestinationHostname == "" || metadata.DestinationPort == 0 {
+		return errors.New("no destination to dial")
+	}
+	dialStartTime := time.Now()
+	destinationConn, err := outbound.DialContext(ctx, "tcp",
+		net.JoinHostPort(metadata.DestinationHostname, strconv.FormatUint(uint64(metadata.DestinationPort), 10)))
+	metrics.ObserveDial(outbound.Name(), dialStartTime, err)
+	if err != nil {
+		return err
+	}
+	upload, download, err := bufio.CopyConnCounted(destinationConn, conn)
+	metrics.AddTraffic(outbound.Name(), upload, download)
+	metadata.Stats.AddTraffic(upload, download)
+	return err
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"io"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+func TestHostMapLookup(t *testing.T) {
+	hostMap, err := NewHostMap(&log.Logger{Writer: &log.IOWriter{Writer: io.Discard}}, &config.Outbound{
+		Name:       "hosts",
+		TargetPort: 25565,
+		HostMap: &config.HostMap{
+			Hosts: map[string]*config.HostMapTarget{
+				"play.example.net":   {TargetAddress: "10.0.0.1"},
+				"*.example.net":      {TargetAddress: "10.0.0.2"},
+				".eu.example.net":    {TargetAddress: "10.0.0.3", TargetPort: 25566},
+				"*.play.example.net": {TargetAddress: "10.0.0.4"},
+				"Example.ORG.":       {TargetAddress: "10.0.0.5"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hostMap.PostInitialize(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		hostname string
+		address  string // empty if not found
+	}{
+		{"play.example.net", "10.0.0.1"},    // exact
+		{"PLAY.example.net.", "10.0.0.1"},   // case and trailing dot are ignored
+		{"lobby.example.net", "10.0.0.2"},   // wildcard
+		{"a.lobby.example.net", "10.0.0.2"}, // wildcard matches all the subdomains
+		{"example.net", ""},                 // but not the domain itself
+		{"eu.example.net", "10.0.0.3"},      // suffix includes the domain itself
+		{"a.b.eu.example.net", "10.0.0.3"},  // and any subdomain
+		{"eu.play.example.net", "10.0.0.4"}, // more labels are preferred
+		{"example.org", "10.0.0.5"},
+		{"example.com", ""},
+		{"", ""},
+	} {
+		target := hostMap.lookup(testCase.hostname)
+		if target == nil {
+			if testCase.address != "" {
+				t.Errorf("%s: not found, want %s", testCase.hostname, testCase.address)
+			}
+			continue
+		}
+		if target.address != testCase.address {
+			t.Errorf("%s: got %s, want %s", testCase.hostname, target.address, testCase.address)
+		}
+	}
+
+	target := hostMap.lookup("eu.example.net")
+	if target.port != 25566 {
+		t.Errorf("got port %d, want 25566", target.port)
+	}
+	if target.outbound.Name() != "hosts/.eu.example.net" {
+		t.Errorf("got target outbound name %s, want hosts/.eu.example.net", target.outbound.Name())
+	}
+	if hostMap.lookup("play.example.net").port != 25565 {
+		t.Error("target port does not default to the one of the host map")
+	}
+}
+
+func TestHostMapBadHosts(t *testing.T) {
+	for _, hosts := range []map[string]*config.HostMapTarget{
+		{"play.example.net": {TargetAddress: "10.0.0.1"}, "Play.Example.Net": {TargetAddress: "10.0.0.2"}},
+		{"a.*.example.net": {TargetAddress: "10.0.0.1"}},
+		{"play.example.net": {}},
+	} {
+		hostMap, err := NewHostMap(&log.Logger{Writer: &log.IOWriter{Writer: io.Discard}}, &config.Outbound{
+			Name:       "hosts",
+			TargetPort: 25565,
+			HostMap:    &config.HostMap{Hosts: hosts},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hostMap.PostInitialize(nil) == nil {
+			t.Errorf("bad hosts %v are accepted", hosts)
+		}
+	}
+}
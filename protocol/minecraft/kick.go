@@ -65,3 +65,60 @@ func generatePlayerNumberLimitExceededMessage(s *config.Outbound, name string) m
 		},
 	}
 }
+
+const defaultShutdownMessage = "The proxy is shutting down, please reconnect later."
+
+func generateShutdownMessage(message string) mcprotocol.Message {
+	if message == "" {
+		message = defaultShutdownMessage
+	}
+	return mcprotocol.Message{
+		Color: mcprotocol.White,
+		Extra: []mcprotocol.Message{
+			{Bold: true, Color: mcprotocol.Red, Text: "ZB"},
+			{Bold: true, Text: "Proxy"},
+			{Text: " - "},
+			{Bold: true, Color: mcprotocol.Gold, Text: "Disconnected\n"},
+			{Text: message},
+		},
+	}
+}
+
+func generateMaintenanceMessage(message string) mcprotocol.Message {
+	return mcprotocol.Message{
+		Color: mcprotocol.White,
+		Extra: []mcprotocol.Message{
+			{Bold: true, Color: mcprotocol.Red, Text: "ZB"},
+			{Bold: true, Text: "Proxy"},
+			{Text: " - "},
+			{Bold: true, Color: mcprotocol.Gold, Text: "Under Maintenance\n"},
+			{Text: message},
+		},
+	}
+}
+
+func generateQueueMessage() mcprotocol.Message {
+	return mcprotocol.Message{
+		Color: mcprotocol.White,
+		Extra: []mcprotocol.Message{
+			{Bold: true, Color: mcprotocol.Red, Text: "ZB"},
+			{Bold: true, Text: "Proxy"},
+			{Text: " - "},
+			{Bold: true, Color: mcprotocol.Gold, Text: "Queue\n"},
+			{Text: "The server is full or unavailable now, you will be transferred when a slot opens."},
+		},
+	}
+}
+
+func generateRejectMessage(message string) mcprotocol.Message {
+	return mcprotocol.Message{
+		Color: mcprotocol.White,
+		Extra: []mcprotocol.Message{
+			{Bold: true, Color: mcprotocol.Red, Text: "ZB"},
+			{Bold: true, Text: "Proxy"},
+			{Text: " - "},
+			{Bold: true, Color: mcprotocol.Gold, Text: "Connection Rejected\n"},
+			{Text: message},
+		},
+	}
+}
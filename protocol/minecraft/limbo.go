@@ -0,0 +1,510 @@
+package minecraft
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	stdbufio "bufio"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/buf"
+	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/mcprotocol"
+)
+
+// limboProtocolVersion is the only supported protocol version of limbo, 1.21 and 1.21.1.
+const limboProtocolVersion = 767
+
+const (
+	limboTickInterval      = time.Second
+	limboKeepAliveInterval = 10 * time.Second
+	limboReadTimeout       = 30 * time.Second
+	limboTransferWait      = 5 * time.Second
+	limboReadBufferSize    = 8 * 1024
+	limboMaxPacketSize     = 2 << 20
+)
+
+const defaultQueueMessage = "You are in the queue, position {POSITION} of {SIZE}"
+
+// packet IDs of protocol 767
+const (
+	clientboundLoginSuccess       = 0x02
+	serverboundLoginAcknowledged  = 0x03
+	clientboundConfigDisconnect   = 0x02
+	clientboundConfigFinish       = 0x03
+	clientboundConfigRegistryData = 0x07
+	clientboundConfigKnownPacks   = 0x0E
+	serverboundConfigFinishAck    = 0x03
+	serverboundConfigKnownPacks   = 0x07
+	clientboundPlayDisconnect     = 0x1D
+	clientboundPlayGameEvent      = 0x22
+	clientboundPlayKeepAlive      = 0x26
+	clientboundPlayLogin          = 0x2B
+	clientboundPlaySyncPosition   = 0x40
+	clientboundPlaySystemChat     = 0x6C
+	clientboundPlayTransfer       = 0x73
+)
+
+// limboKnownPackVersions are the versions of the vanilla data pack, the client selects the one it has,
+// so that the registry entries are sent without data.
+var limboKnownPackVersions = []string{"1.21", "1.21.1"}
+
+// limboRegistries are the synchronized registries with the least entries the client requires.
+// All the damage types are required since the client looks them up when joining.
+// minecraft:enchantment and minecraft:jukebox_song are also synchronized since 1.21, but they are
+// not sent as nothing in the void world refers to them. It is not verified with a real 1.21 client
+// that they can be left out, add them with a known entry like the others if the client fails to join.
+var limboRegistries = []struct {
+	id      string
+	entries []string
+}{
+	{"minecraft:dimension_type", []string{"overworld"}},
+	{"minecraft:worldgen/biome", []string{"plains"}},
+	{"minecraft:chat_type", []string{"chat"}},
+	{"minecraft:trim_pattern", []string{"coast"}},
+	{"minecraft:trim_material", []string{"quartz"}},
+	{"minecraft:wolf_variant", []string{"pale"}},
+	{"minecraft:painting_variant", []string{"kebab"}},
+	{"minecraft:banner_pattern", []string{"base"}},
+	{"minecraft:damage_type", []string{
+		"arrow", "bad_respawn_point", "cactus", "campfire", "cramming", "dragon_breath",
+		"drown", "dry_out", "explosion", "fall", "falling_anvil", "falling_block",
+		"falling_stalactite", "fireball", "fireworks", "fly_into_wall", "freeze", "generic",
+		"generic_kill", "hot_floor", "in_fire", "in_wall", "indirect_magic", "lava",
+		"lightning_bolt", "mace_smash", "magic", "mob_attack", "mob_attack_no_aggro", "mob_projectile",
+		"on_fire", "out_of_world", "outside_border", "player_attack", "player_explosion", "sonic_boom",
+		"spit", "stalagmite", "starve", "sting", "sweet_berry_bush", "thorns",
+		"thrown", "trident", "unattributed_fireball", "wind_charge", "wither", "wither_skull",
+	}},
+}
+
+var errLimboUnsupported = errors.New("the vanilla data pack of the client is unknown")
+
+// limboSession is a player held in the void world of limbo.
+type limboSession struct {
+	conn        *bufio.CachedConn
+	reader      *stdbufio.Reader
+	writer      io.Writer
+	readBuffer  *buf.Buffer // not pooled since the reading goroutine may outlive the session
+	writeBuffer *buf.Buffer
+}
+
+func newLimboSession(conn *bufio.CachedConn) *limboSession {
+	writeBuffer := buf.New()
+	writeBuffer.Reset(mcprotocol.MaxVarIntLen)
+	return &limboSession{
+		conn:        conn,
+		writer:      common.UnwrapWriter(conn),
+		readBuffer:  buf.With(make([]byte, limboReadBufferSize)),
+		writeBuffer: writeBuffer,
+	}
+}
+
+// startReading makes the session read from the unsniffed data.
+// The cache of conn can not hold all the following packets, so they are read from the raw connection.
+func (s *limboSession) startReading() {
+	var reader io.Reader = s.conn.Conn
+	if cache := s.conn.Cache(); cache != nil && !cache.IsEmpty() {
+		reader = io.MultiReader(bytes.NewReader(bytes.Clone(cache.Bytes())), s.conn.Conn)
+	}
+	s.reader = stdbufio.NewReader(reader)
+}
+
+// readPacket reads the next packet into readBuffer, and returns the packet ID.
+// The content of packets larger than readBuffer is discarded.
+func (s *limboSession) readPacket() (int32, error) {
+	s.conn.Conn.SetReadDeadline(time.Now().Add(limboReadTimeout))
+	length, _, err := mcprotocol.ReadVarIntFrom(s.reader)
+	if err != nil {
+		return 0, err
+	}
+	if length <= 0 || length > limboMaxPacketSize {
+		return 0, fmt.Errorf("bad packet length: %d", length)
+	}
+	packetID, idLength, err := mcprotocol.ReadVarIntFrom(s.reader)
+	if err != nil {
+		return 0, err
+	}
+	contentLength := int(length) - int(idLength)
+	if contentLength < 0 {
+		return 0, fmt.Errorf("bad packet length: %d", length)
+	}
+	s.readBuffer.FullReset()
+	if contentLength > s.readBuffer.Cap() {
+		_, err = io.CopyN(io.Discard, s.reader, int64(contentLength))
+		return packetID, err
+	}
+	_, err = s.readBuffer.ReadFullFrom(s.reader, contentLength)
+	return packetID, err
+}
+
+// waitPacket reads packets until the one with packetID.
+func (s *limboSession) waitPacket(packetID int32) error {
+	for {
+		id, err := s.readPacket()
+		if err != nil {
+			return err
+		}
+		if id == packetID {
+			return nil
+		}
+	}
+}
+
+// writePacket writes the packet in writeBuffer with packetID.
+func (s *limboSession) writePacket(packetID byte, build func(buffer *buf.Buffer) error) error {
+	s.writeBuffer.WriteByte(packetID)
+	err := build(s.writeBuffer)
+	if err != nil {
+		s.writeBuffer.Reset(mcprotocol.MaxVarIntLen)
+		return err
+	}
+	return mcprotocol.Conn{Writer: s.writer}.WritePacket(s.writeBuffer)
+}
+
+// login completes the offline mode login, the Login Start packet should be cached in conn.
+func (s *limboSession) login(sniffPosition int, name string) error {
+	if sniffPosition >= 0 {
+		s.conn.Rewind(sniffPosition)
+	}
+	// skip Login Start packet
+	length, _, err := mcprotocol.ReadVarIntFrom(s.conn)
+	if err != nil {
+		return common.Cause("read login start: ", err)
+	}
+	_, err = s.conn.Peek(int(length))
+	if err != nil {
+		return common.Cause("read login start: ", err)
+	}
+	s.startReading()
+
+	uuid := offlineUUID(name)
+	err = s.writePacket(clientboundLoginSuccess, func(buffer *buf.Buffer) error {
+		buffer.Write(uuid[:])
+		return mcprotocol.WriteToPacket(buffer,
+			name,
+			mcprotocol.VarInt(0), // no properties
+			false,                // strict error handling
+		)
+	})
+	if err != nil {
+		return common.Cause("send login success: ", err)
+	}
+	err = s.waitPacket(serverboundLoginAcknowledged)
+	if err != nil {
+		return common.Cause("wait login acknowledged: ", err)
+	}
+	return nil
+}
+
+// offlineUUID generates the player UUID like servers in offline mode.
+func offlineUUID(name string) [16]byte {
+	uuid := md5.Sum([]byte("OfflinePlayer:" + name))
+	uuid[6] = uuid[6]&0x0F | 0x30 // version 3
+	uuid[8] = uuid[8]&0x3F | 0x80 // variant
+	return uuid
+}
+
+// configure sends the registries in the configuration state.
+func (s *limboSession) configure() error {
+	err := s.writePacket(clientboundConfigKnownPacks, func(buffer *buf.Buffer) error {
+		mcprotocol.VarInt(len(limboKnownPackVersions)).WriteToBuffer(buffer)
+		for _, version := range limboKnownPackVersions {
+			err := mcprotocol.WriteToPacket(buffer, "minecraft", "core", version)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return common.Cause("send known packs: ", err)
+	}
+	err = s.waitPacket(serverboundConfigKnownPacks)
+	if err != nil {
+		return common.Cause("wait known packs: ", err)
+	}
+	var count mcprotocol.VarInt
+	err = mcprotocol.Scan(s.readBuffer, &count)
+	if err != nil {
+		return common.Cause("read known packs: ", err)
+	}
+	if count == 0 {
+		return errLimboUnsupported
+	}
+
+	for _, registry := range limboRegistries {
+		err = s.writePacket(clientboundConfigRegistryData, func(buffer *buf.Buffer) error {
+			err := mcprotocol.WriteString(buffer, registry.id)
+			if err != nil {
+				return err
+			}
+			mcprotocol.VarInt(len(registry.entries)).WriteToBuffer(buffer)
+			for _, entry := range registry.entries {
+				err = mcprotocol.WriteToPacket(buffer,
+					"minecraft:"+entry,
+					false, // data is loaded from the known pack
+				)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return common.Cause("send registry data: ", err)
+		}
+	}
+	err = s.writePacket(clientboundConfigFinish, func(*buf.Buffer) error { return nil })
+	if err != nil {
+		return common.Cause("finish configuration: ", err)
+	}
+	err = s.waitPacket(serverboundConfigFinishAck)
+	if err != nil {
+		return common.Cause("wait finish configuration: ", err)
+	}
+	return nil
+}
+
+// join spawns the player in the void world as a spectator.
+func (s *limboSession) join() error {
+	const dimension = "minecraft:overworld"
+	err := s.writePacket(clientboundPlayLogin, func(buffer *buf.Buffer) error {
+		return mcprotocol.WriteToPacket(buffer,
+			int32(1), // entity ID
+			false,    // hardcore
+			mcprotocol.VarInt(1),
+			dimension,
+			mcprotocol.VarInt(1), // max players
+			mcprotocol.VarInt(2), // view distance
+			mcprotocol.VarInt(2), // simulation distance
+			false,                // reduced debug info
+			true,                 // enable respawn screen
+			false,                // limited crafting
+			mcprotocol.VarInt(0), // dimension type, the first entry in the registry
+			dimension,
+			int64(0),             // hashed seed
+			uint8(3),             // spectator, so that the player does not fall and no chunk is needed
+			int8(-1),             // previous game mode
+			false,                // debug
+			true,                 // flat
+			false,                // no death location
+			mcprotocol.VarInt(0), // portal cooldown
+			false,                // enforces secure chat
+		)
+	})
+	if err != nil {
+		return common.Cause("send login (play): ", err)
+	}
+	err = s.writePacket(clientboundPlaySyncPosition, func(buffer *buf.Buffer) error {
+		binary.BigEndian.PutUint64(buffer.Extend(8), math.Float64bits(0))
+		binary.BigEndian.PutUint64(buffer.Extend(8), math.Float64bits(64))
+		binary.BigEndian.PutUint64(buffer.Extend(8), math.Float64bits(0))
+		buffer.Extend(4) // yaw
+		buffer.Extend(4) // pitch
+		return mcprotocol.WriteToPacket(buffer,
+			uint8(0),             // absolute position
+			mcprotocol.VarInt(1), // teleport ID
+		)
+	})
+	if err != nil {
+		return common.Cause("synchronize player position: ", err)
+	}
+	err = s.writePacket(clientboundPlayGameEvent, func(buffer *buf.Buffer) error {
+		buffer.WriteByte(13) // start waiting for level chunks
+		buffer.Extend(4)     // value
+		return nil
+	})
+	if err != nil {
+		return common.Cause("send game event: ", err)
+	}
+	return nil
+}
+
+func (s *limboSession) keepAlive() error {
+	return s.writePacket(clientboundPlayKeepAlive, func(buffer *buf.Buffer) error {
+		return mcprotocol.WriteToPacket(buffer, time.Now().UnixMilli())
+	})
+}
+
+// sendMessage sends a system message, overlay messages are shown above the hotbar.
+func (s *limboSession) sendMessage(msg mcprotocol.Message, overlay bool) error {
+	return s.writePacket(clientboundPlaySystemChat, func(buffer *buf.Buffer) error {
+		err := mcprotocol.WriteNBTMessage(buffer, msg)
+		if err != nil {
+			return err
+		}
+		return mcprotocol.WriteBoolean(buffer, overlay)
+	})
+}
+
+func (s *limboSession) disconnect(packetID byte, msg mcprotocol.Message) error {
+	return s.writePacket(packetID, func(buffer *buf.Buffer) error {
+		return mcprotocol.WriteNBTMessage(buffer, msg)
+	})
+}
+
+func (s *limboSession) transfer(host string, port uint16) error {
+	return s.writePacket(clientboundPlayTransfer, func(buffer *buf.Buffer) error {
+		return mcprotocol.WriteToPacket(buffer, host, mcprotocol.VarInt(port))
+	})
+}
+
+// canEnterLimbo reports whether the player can be held in limbo.
+func (o *Outbound) canEnterLimbo(metadata *adapter.Metadata) bool {
+	return o.config.Minecraft.Limbo != nil && metadata.Minecraft.ProtocolVersion == limboProtocolVersion
+}
+
+// enterQueue adds the player to the queue, and returns nil if it can not.
+func (o *Outbound) enterQueue(metadata *adapter.Metadata) *queueTicket {
+	if !o.canEnterLimbo(metadata) {
+		return nil
+	}
+	return o.queue.enter(newQueuePlayer(metadata), o.config.Minecraft.Limbo.QueueSize)
+}
+
+// freeSlots returns the number of players can be connected to the server.
+func (o *Outbound) freeSlots(reserved int) int {
+	if !o.config.Minecraft.OnlineCount.EnableMaxLimit {
+		return math.MaxInt
+	}
+	return int(o.config.Minecraft.OnlineCount.Max-o.onlineCount.Load()) - reserved
+}
+
+// checkServer reports whether the server can be connected.
+func (o *Outbound) checkServer(ctx context.Context, metadata *adapter.Metadata) bool {
+	ctx, cancel := context.WithTimeout(ctx, o.config.Minecraft.Limbo.GetCheckInterval())
+	defer cancel()
+	probeMetadata := &adapter.Metadata{
+		DestinationHostname: metadata.DestinationHostname,
+		DestinationPort:     metadata.DestinationPort,
+	}
+	conn, err := o.connectServer(ctx, probeMetadata)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// runLimbo holds the player in limbo until a slot is reserved, then transfers the player back.
+func (o *Outbound) runLimbo(ctx context.Context, conn *bufio.CachedConn, metadata *adapter.Metadata, ticket *queueTicket) error {
+	defer o.queue.leave(ticket)
+	limboConfig := o.config.Minecraft.Limbo
+	session := newLimboSession(conn)
+	defer session.writeBuffer.Release()
+
+	err := session.login(metadata.Minecraft.SniffPosition, metadata.Minecraft.PlayerName)
+	if err != nil {
+		return common.Cause("limbo: ", err)
+	}
+	err = session.configure()
+	if errors.Is(err, errLimboUnsupported) {
+		session.disconnect(clientboundConfigDisconnect, generateShutdownMessage(err.Error()))
+		return common.Cause("limbo: ", err)
+	} else if err != nil {
+		return common.Cause("limbo: ", err)
+	}
+	err = session.join()
+	if err != nil {
+		return common.Cause("limbo: ", err)
+	}
+	o.logger.Info().
+		Str("proxyConnectionID", metadata.ConnectionID).
+		Str("outbound", o.config.Name).
+		Str("player", metadata.Minecraft.PlayerName).
+		Msg("Player is waiting in limbo")
+	session.sendMessage(generateQueueMessage(), false)
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, err := session.readPacket()
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	queueMessage := limboConfig.QueueMessage
+	if queueMessage == "" {
+		queueMessage = defaultQueueMessage
+	}
+	ticker := time.NewTicker(limboTickInterval)
+	defer ticker.Stop()
+	lastKeepAlive := time.Now()
+	for {
+		select {
+		case <-ticket.admitted:
+			host, port := limboConfig.TransferAddress, limboConfig.TransferPort
+			if host == "" {
+				host = metadata.Minecraft.CleanOriginDestination()
+			}
+			if port == 0 {
+				port = metadata.Minecraft.OriginPort
+			}
+			err = session.transfer(host, port)
+			if err != nil {
+				return common.Cause("limbo transfer: ", err)
+			}
+			o.logger.Info().
+				Str("proxyConnectionID", metadata.ConnectionID).
+				Str("outbound", o.config.Name).
+				Str("player", metadata.Minecraft.PlayerName).
+				Str("transferTo", net.JoinHostPort(host, strconv.Itoa(int(port)))).
+				Msg("Transferred player from limbo")
+			select {
+			case <-readErr: // the client disconnects itself
+			case <-time.After(limboTransferWait):
+			}
+			return nil
+		case err = <-readErr:
+			if errors.Is(err, io.EOF) {
+				return nil // the player left the queue
+			}
+			return common.Cause("limbo: ", err)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if drainMessage := o.drainMessage.Load(); drainMessage != nil {
+			session.disconnect(clientboundPlayDisconnect, generateShutdownMessage(*drainMessage))
+			return nil
+		}
+		o.queue.admit(o.freeSlots, limboConfig.GetCheckInterval(), func() bool {
+			return o.checkServer(ctx, metadata)
+		})
+		if time.Since(lastKeepAlive) >= limboKeepAliveInterval {
+			err = session.keepAlive()
+			if err != nil {
+				return common.Cause("limbo keep alive: ", err)
+			}
+			lastKeepAlive = time.Now()
+		}
+		position, size := o.queue.position(ticket)
+		if position > 0 {
+			err = session.sendMessage(mcprotocol.Message{
+				Color: mcprotocol.Gold,
+				Text: strings.NewReplacer(
+					"{POSITION}", strconv.Itoa(position),
+					"{SIZE}", strconv.Itoa(size),
+				).Replace(queueMessage),
+			}, true)
+			if err != nil {
+				return common.Cause("limbo: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package minecraft
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/mcprotocol"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/event"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	defaultMaintenanceVersionName = "Maintenance"
+	defaultMaintenanceMessage     = "The server is under maintenance, please come back later."
+	reasonMaintenance             = "maintenance"
+)
+
+// MaintenanceOutbound answers status pings with a maintenance MOTD and disconnects players,
+// the bypassed players are handed to BypassOutbound.
+type MaintenanceOutbound struct {
+	logger         *log.Logger
+	config         *config.Outbound
+	router         adapter.Router
+	bypass         set.StringSet // lower case names and hyphenated UUIDs
+	bypassOutbound adapter.InjectOutbound
+}
+
+var (
+	_ adapter.Outbound       = (*MaintenanceOutbound)(nil)
+	_ adapter.InjectOutbound = (*MaintenanceOutbound)(nil)
+)
+
+func NewMaintenanceOutbound(logger *log.Logger, newConfig *config.Outbound) (*MaintenanceOutbound, error) {
+	if newConfig.Maintenance == nil {
+		return nil, errors.New("not maintenance outbound config")
+	}
+	return &MaintenanceOutbound{
+		logger: logger,
+		config: newConfig,
+	}, nil
+}
+
+func (o *MaintenanceOutbound) Name() string {
+	if o.config != nil {
+		return o.config.Name
+	}
+	return ""
+}
+
+func (o *MaintenanceOutbound) PostInitialize(router adapter.Router) error {
+	maintenanceConfig := o.config.Maintenance
+	bypass := make(set.StringSet)
+	for _, entry := range maintenanceConfig.Bypass {
+		if strings.HasPrefix(entry, "list:") {
+			lists, err := router.FindListsByTag([]string{strings.TrimPrefix(entry, "list:")})
+			if err != nil {
+				return common.Cause("load bypass list: ", err)
+			}
+			for item := range lists[0] {
+				bypass.Add(normalizePlayer(item))
+			}
+		} else {
+			bypass.Add(normalizePlayer(entry))
+		}
+	}
+	var bypassOutbound adapter.InjectOutbound
+	if maintenanceConfig.BypassOutbound != "" {
+		outbound, err := router.FindOutboundByName(maintenanceConfig.BypassOutbound)
+		if err != nil {
+			return common.Cause("find bypass outbound: ", err)
+		}
+		var isInject bool
+		bypassOutbound, isInject = outbound.(adapter.InjectOutbound)
+		if !isInject {
+			return errors.New("bypass outbound [" + maintenanceConfig.BypassOutbound + "] is not a Minecraft outbound")
+		}
+	} else if len(bypass) > 0 {
+		return errors.New("bypass outbound is required for bypassed players")
+	}
+	o.bypass = bypass
+	o.bypassOutbound = bypassOutbound
+	o.router = router
+	return nil
+}
+
+// normalizePlayer converts a player name or UUID to the form used for matching.
+func normalizePlayer(player string) string {
+	player = strings.ToLower(strings.TrimSpace(player))
+	if len(player) == 32 {
+		if _, err := hex.DecodeString(player); err == nil {
+			return player[:8] + "-" + player[8:12] + "-" + player[12:16] + "-" + player[16:20] + "-" + player[20:]
+		}
+	}
+	return player
+}
+
+func (o *MaintenanceOutbound) Reload(newConfig *config.Outbound) error {
+	o.config = newConfig
+	return o.PostInitialize(o.router)
+}
+
+func (o *MaintenanceOutbound) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, adapter.ErrInjectionRequired
+}
+
+func (o *MaintenanceOutbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn, metadata *adapter.Metadata) error {
+	if metadata.Minecraft == nil {
+		return errors.New("require Minecraft metadata")
+	}
+	maintenanceConfig := o.config.Maintenance
+	if metadata.Minecraft.NextState != mcprotocol.NextStateStatus && o.bypassOutbound != nil &&
+		(o.bypass.Has(strings.ToLower(metadata.Minecraft.PlayerName)) ||
+			(metadata.Minecraft.UUIDString() != "" && o.bypass.Has(metadata.Minecraft.UUIDString()))) {
+		o.logger.Info().
+			Str("proxyConnectionID", metadata.ConnectionID).
+			Str("outbound", o.config.Name).
+			Str("player", metadata.Minecraft.PlayerName).
+			Msg("Bypassed maintenance")
+		metadata.Stats.Outbound = maintenanceConfig.BypassOutbound
+		return o.bypassOutbound.InjectConnection(ctx, conn, metadata)
+	}
+	if metadata.Minecraft.SniffPosition >= 0 {
+		conn.Rewind(metadata.Minecraft.SniffPosition)
+	}
+
+	switch metadata.Minecraft.NextState {
+	case mcprotocol.NextStateStatus:
+		// skip Status Request packet
+		_, err := conn.Peek(2)
+		if err != nil {
+			return common.Cause("skip status request: ", err)
+		}
+		err = respondStatus(conn, o.generateMOTD(), "")
+		if err != nil {
+			return err
+		}
+		o.logger.Info().
+			Str("proxyConnectionID", metadata.ConnectionID).
+			Str("outbound", o.config.Name).
+			Msg("Responded maintenance MOTD")
+		return nil
+
+	case mcprotocol.NextStateLogin, mcprotocol.NextStateTransfer:
+		message := maintenanceConfig.Message
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+		err := sendDisconnect(conn, generateMaintenanceMessage(message))
+		if err != nil {
+			return common.Cause("send maintenance packet: ", err)
+		}
+		o.logger.Info().
+			Str("proxyConnectionID", metadata.ConnectionID).
+			Str("outbound", o.config.Name).
+			Str("player", metadata.Minecraft.PlayerName).
+			Str("sourceNetAddr", metadata.SourceAddress.String()).
+			Msg("Kicked because of maintenance")
+		e := event.NewConnectionEvent(event.TypePlayerRejected, metadata)
+		e.Outbound = o.config.Name
+		e.Reason = reasonMaintenance
+		event.Emit(ctx, e)
+		conn.Conn.(*net.TCPConn).SetLinger(10)
+		return nil
+
+	default:
+		return errors.New("unknown next state")
+	}
+}
+
+type maintenanceMOTD struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int    `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Max    int32 `json:"max"`
+		Online int32 `json:"online"`
+	} `json:"players"`
+	Description struct {
+		Text string `json:"text,omitempty"`
+	} `json:"description,omitempty"`
+	Favicon string `json:"favicon,omitempty"`
+}
+
+func (o *MaintenanceOutbound) generateMOTD() []byte {
+	maintenanceConfig := o.config.Maintenance
+	var motd maintenanceMOTD
+	motd.Version.Name = maintenanceConfig.VersionName
+	if motd.Version.Name == "" {
+		motd.Version.Name = defaultMaintenanceVersionName
+	}
+	motd.Version.Protocol = maintenanceConfig.VersionProtocol
+	if motd.Version.Protocol == 0 {
+		motd.Version.Protocol = -1
+	}
+	motd.Description.Text = maintenanceConfig.MotdDescription
+	motd.Favicon = maintenanceConfig.MotdFavicon
+	if motd.Favicon == "{DEFAULT_MOTD}" {
+		motd.Favicon = defaultMOTD
+	}
+	content, _ := json.Marshal(motd)
+	return content
+}
@@ -0,0 +1,326 @@
+package minecraft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/buf"
+	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/mcprotocol"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+var testLogger = &log.Logger{Writer: &log.IOWriter{Writer: io.Discard}}
+
+// testRouter provides the outbounds and lists to PostInitialize.
+type testRouter struct {
+	outbounds map[string]adapter.Outbound
+	lists     map[string]set.StringSet
+}
+
+func (r *testRouter) FindOutboundByName(name string) (adapter.Outbound, error) {
+	if outbound, found := r.outbounds[name]; found {
+		return outbound, nil
+	}
+	return nil, errors.New("outbound [" + name + "] is not found")
+}
+
+func (r *testRouter) FindListsByTag(tags []string) ([]set.StringSet, error) {
+	lists := make([]set.StringSet, 0, len(tags))
+	for _, tag := range tags {
+		list, found := r.lists[tag]
+		if !found {
+			return nil, errors.New("list [" + tag + "] is not found")
+		}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+func (r *testRouter) HandleConnection(net.Conn, *adapter.Metadata) {}
+
+// recordOutbound records the players injected into it.
+type recordOutbound struct {
+	players []string
+}
+
+func (o *recordOutbound) Name() string                        { return "record" }
+func (o *recordOutbound) PostInitialize(adapter.Router) error { return nil }
+func (o *recordOutbound) Reload(*config.Outbound) error       { return nil }
+func (o *recordOutbound) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, adapter.ErrInjectionRequired
+}
+
+func (o *recordOutbound) InjectConnection(_ context.Context, _ *bufio.CachedConn, metadata *adapter.Metadata) error {
+	o.players = append(o.players, metadata.Minecraft.PlayerName)
+	return nil
+}
+
+// injectTCP injects a TCP connection into outbound, writes request from the client side,
+// and returns the first packet responded, which is nil if nothing is responded.
+func injectTCP(t *testing.T, outbound adapter.InjectOutbound, metadata *adapter.Metadata, request []byte) ([]byte, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	injectErr := make(chan error, 1)
+	go func() {
+		conn := bufio.NewCachedConn(serverConn)
+		injectErr <- outbound.InjectConnection(context.Background(), conn, metadata)
+		conn.Close()
+	}()
+
+	_, err = client.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := buf.New()
+	defer buffer.Release()
+	var packet []byte
+	if mcprotocol.StreamConn(client).ReadPacket(buffer) == nil {
+		packet = append(packet, buffer.Bytes()...)
+	}
+	return packet, <-injectErr
+}
+
+// readPacketJSON decodes the JSON string field following the packet ID 0.
+func readPacketJSON(t *testing.T, packet []byte, v any) {
+	t.Helper()
+	if len(packet) == 0 || packet[0] != 0 {
+		t.Fatalf("got packet %v, want packet ID 0", packet)
+	}
+	buffer := buf.As(packet[1:])
+	content, err := mcprotocol.ReadString(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(content), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// messageText joins the texts of message and its extra messages.
+func messageText(message mcprotocol.Message) string {
+	text := message.Text
+	for _, extra := range message.Extra {
+		text += messageText(extra)
+	}
+	return text
+}
+
+func TestMaintenanceMOTD(t *testing.T) {
+	for _, testCase := range []struct {
+		name            string
+		config          config.Maintenance
+		wantVersion     string
+		wantProtocol    int
+		wantDescription string
+		wantFavicon     string
+	}{
+		{
+			name:         "default",
+			wantVersion:  defaultMaintenanceVersionName,
+			wantProtocol: -1,
+		},
+		{
+			name: "custom",
+			config: config.Maintenance{
+				VersionName:     "Closed",
+				VersionProtocol: 767,
+				MotdDescription: "Back at 8 PM",
+				MotdFavicon:     "data:image/png;base64,AAAA",
+			},
+			wantVersion:     "Closed",
+			wantProtocol:    767,
+			wantDescription: "Back at 8 PM",
+			wantFavicon:     "data:image/png;base64,AAAA",
+		},
+		{
+			name:         "default favicon",
+			config:       config.Maintenance{MotdFavicon: "{DEFAULT_MOTD}"},
+			wantVersion:  defaultMaintenanceVersionName,
+			wantProtocol: -1,
+			wantFavicon:  defaultMOTD,
+		},
+	} {
+		maintenanceConfig := testCase.config
+		outbound, err := NewMaintenanceOutbound(testLogger, &config.Outbound{Name: "maintenance", Maintenance: &maintenanceConfig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = outbound.PostInitialize(&testRouter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Status Request and Ping Request
+		request := []byte{1, 0x00, 9, 0x01, 1, 2, 3, 4, 5, 6, 7, 8}
+		packet, err := injectTCP(t, outbound, &adapter.Metadata{
+			Minecraft: &adapter.MinecraftMetadata{NextState: mcprotocol.NextStateStatus, SniffPosition: -1},
+		}, request)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+		var motd maintenanceMOTD
+		readPacketJSON(t, packet, &motd)
+		if motd.Version.Name != testCase.wantVersion || motd.Version.Protocol != testCase.wantProtocol {
+			t.Errorf("%s: got version %s (%d), want %s (%d)", testCase.name,
+				motd.Version.Name, motd.Version.Protocol, testCase.wantVersion, testCase.wantProtocol)
+		}
+		if motd.Description.Text != testCase.wantDescription {
+			t.Errorf("%s: got description %q, want %q", testCase.name, motd.Description.Text, testCase.wantDescription)
+		}
+		if motd.Favicon != testCase.wantFavicon {
+			t.Errorf("%s: got favicon %.32q, want %.32q", testCase.name, motd.Favicon, testCase.wantFavicon)
+		}
+	}
+}
+
+func TestMaintenanceDisconnect(t *testing.T) {
+	for _, testCase := range []struct {
+		message string
+		want    string
+	}{
+		{"", defaultMaintenanceMessage},
+		{"Back at 8 PM", "Back at 8 PM"},
+	} {
+		outbound, err := NewMaintenanceOutbound(testLogger, &config.Outbound{
+			Name:        "maintenance",
+			Maintenance: &config.Maintenance{Message: testCase.message},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = outbound.PostInitialize(&testRouter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := injectTCP(t, outbound, &adapter.Metadata{
+			Minecraft: &adapter.MinecraftMetadata{NextState: mcprotocol.NextStateLogin, PlayerName: "Steve", SniffPosition: -1},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message mcprotocol.Message
+		readPacketJSON(t, packet, &message)
+		if text := messageText(message); !strings.Contains(text, "Under Maintenance") || !strings.HasSuffix(text, testCase.want) {
+			t.Errorf("got disconnect message %q, want %q", text, testCase.want)
+		}
+	}
+}
+
+func TestMaintenanceBypass(t *testing.T) {
+	bypassOutbound := &recordOutbound{}
+	router := &testRouter{
+		outbounds: map[string]adapter.Outbound{"lobby": bypassOutbound},
+		lists:     map[string]set.StringSet{"admins": set.NewStringSetFromSlice([]string{"Alex"})},
+	}
+	outbound, err := NewMaintenanceOutbound(testLogger, &config.Outbound{
+		Name: "maintenance",
+		Maintenance: &config.Maintenance{
+			Bypass:         []string{"Steve", "0123456789ABCDEF0123456789abcdef", "list:admins"},
+			BypassOutbound: "lobby",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = outbound.PostInitialize(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uuid := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	for _, testCase := range []struct {
+		name     string
+		metadata adapter.MinecraftMetadata
+		bypass   bool
+	}{
+		{"name", adapter.MinecraftMetadata{PlayerName: "Steve"}, true},
+		{"name in another case", adapter.MinecraftMetadata{PlayerName: "sTEVE"}, true},
+		{"UUID", adapter.MinecraftMetadata{PlayerName: "Renamed", UUID: uuid}, true},
+		{"list", adapter.MinecraftMetadata{PlayerName: "Alex"}, true},
+		{"not bypassed", adapter.MinecraftMetadata{PlayerName: "Notch"}, false},
+		{"transfer", adapter.MinecraftMetadata{PlayerName: "Steve", NextState: mcprotocol.NextStateTransfer}, true},
+		{"status", adapter.MinecraftMetadata{PlayerName: "Steve", NextState: mcprotocol.NextStateStatus}, false},
+	} {
+		bypassOutbound.players = nil
+		minecraftMetadata := testCase.metadata
+		if minecraftMetadata.NextState == 0 {
+			minecraftMetadata.NextState = mcprotocol.NextStateLogin
+		}
+		minecraftMetadata.SniffPosition = -1
+		metadata := &adapter.Metadata{Minecraft: &minecraftMetadata}
+		request := []byte{1, 0x00, 9, 0x01, 1, 2, 3, 4, 5, 6, 7, 8}
+		packet, err := injectTCP(t, outbound, metadata, request)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+		if bypassed := len(bypassOutbound.players) > 0; bypassed != testCase.bypass {
+			t.Errorf("%s: bypassed: %v, want %v", testCase.name, bypassed, testCase.bypass)
+		}
+		if testCase.bypass {
+			if packet != nil {
+				t.Errorf("%s: bypassed player receives packet %v", testCase.name, packet)
+			}
+			if metadata.Stats.Outbound != "lobby" {
+				t.Errorf("%s: outbound of stats is %q, want lobby", testCase.name, metadata.Stats.Outbound)
+			}
+		} else if packet == nil {
+			t.Errorf("%s: nothing is responded", testCase.name)
+		}
+	}
+
+	// the bypass list is read again when initializing after a refresh
+	router.lists["admins"] = set.NewStringSetFromSlice([]string{"Notch"})
+	err = outbound.PostInitialize(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbound.bypass.Has("alex") || !outbound.bypass.Has("notch") {
+		t.Errorf("bypass list is not refreshed: %v", outbound.bypass)
+	}
+
+	for _, testCase := range []struct {
+		name   string
+		config config.Maintenance
+		err    string
+	}{
+		{"missing list", config.Maintenance{Bypass: []string{"list:missing"}, BypassOutbound: "lobby"}, "load bypass list: "},
+		{"missing outbound", config.Maintenance{Bypass: []string{"Steve"}, BypassOutbound: "missing"}, "find bypass outbound: "},
+		{"no outbound", config.Maintenance{Bypass: []string{"Steve"}}, "bypass outbound is required for bypassed players"},
+	} {
+		maintenanceConfig := testCase.config
+		outbound, err := NewMaintenanceOutbound(testLogger, &config.Outbound{Name: "maintenance", Maintenance: &maintenanceConfig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = outbound.PostInitialize(router)
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("%s: got error %v, want %q", testCase.name, err, testCase.err)
+		}
+	}
+}
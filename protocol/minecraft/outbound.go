@@ -10,17 +10,21 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common"
 	"github.com/layou233/zbproxy/v3/common/access"
 	"github.com/layou233/zbproxy/v3/common/buf"
 	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
 	"github.com/layou233/zbproxy/v3/common/mcprotocol"
+	"github.com/layou233/zbproxy/v3/common/metrics"
 	"github.com/layou233/zbproxy/v3/common/network"
 	"github.com/layou233/zbproxy/v3/common/network/socks"
 	"github.com/layou233/zbproxy/v3/common/set"
 	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/event"
 	"github.com/layou233/zbproxy/v3/version"
 
 	"github.com/phuslu/log"
@@ -35,12 +39,16 @@ type Outbound struct {
 
 	hostnameAccessLists []set.StringSet
 	nameAccessLists     []set.StringSet
-	onlineCount         atomic.Int32
+	onlineCount         *atomic.Int32           // shared with the reloaded outbound
+	queue               *queue                  // shared with the reloaded outbound
+	drainMessage        *atomic.Pointer[string] // shared with the reloaded outbound
 }
 
 var (
-	_ adapter.Outbound = (*Outbound)(nil)
-	_ network.Dialer   = (*Outbound)(nil)
+	_ adapter.Outbound        = (*Outbound)(nil)
+	_ adapter.DrainOutbound   = (*Outbound)(nil)
+	_ adapter.InheritOutbound = (*Outbound)(nil)
+	_ network.Dialer          = (*Outbound)(nil)
 )
 
 func NewOutbound(logger *log.Logger, newConfig *config.Outbound) (*Outbound, error) {
@@ -48,8 +56,11 @@ func NewOutbound(logger *log.Logger, newConfig *config.Outbound) (*Outbound, err
 		return nil, errors.New("not Minecraft outbound config")
 	}
 	outbound := &Outbound{
-		logger: logger,
-		config: newConfig,
+		logger:       logger,
+		config:       newConfig,
+		onlineCount:  new(atomic.Int32),
+		queue:        newQueue(),
+		drainMessage: new(atomic.Pointer[string]),
 	}
 	return outbound, nil
 }
@@ -179,8 +190,10 @@ func (o *Outbound) connectServer(ctx context.Context, metadata *adapter.Metadata
 		metadata.DestinationPort = o.config.TargetPort
 	}
 	destinationAddress := net.JoinHostPort(metadata.DestinationHostname, strconv.FormatUint(uint64(metadata.DestinationPort), 10))
-	o.logger.Info()
-	return o.dialer.DialContext(ctx, "tcp", destinationAddress)
+	startTime := time.Now()
+	conn, err := o.dialer.DialContext(ctx, "tcp", destinationAddress)
+	metrics.ObserveDial(o.config.Name, startTime, err)
+	return conn, err
 }
 
 func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn, metadata *adapter.Metadata) error {
@@ -190,6 +203,10 @@ func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn,
 	if o.config.Minecraft.HostnameAccess.Mode != access.DefaultMode {
 		hostnameClean := metadata.Minecraft.CleanOriginDestination()
 		if !access.Check(o.hostnameAccessLists, o.config.Minecraft.HostnameAccess.Mode, metadata.Minecraft.CleanOriginDestination()) {
+			metrics.AccessRejections.WithLabelValues(metrics.RejectMinecraftHostname).Inc()
+			if metadata.Minecraft.NextState == mcprotocol.NextStateLogin {
+				o.emitEvent(ctx, event.TypePlayerRejected, metadata, metrics.RejectMinecraftHostname)
+			}
 			conn.Conn.(*net.TCPConn).SetLinger(0)
 			conn.Close()
 			return common.Cause("hostname "+o.config.Minecraft.HostnameAccess.Mode+
@@ -255,45 +272,15 @@ func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn,
 			if err != nil {
 				return common.Cause("request remote MOTD: ", err)
 			}
-			return bufio.CopyConn(remoteConn, conn)
+			upload, download, err := bufio.CopyConnCounted(remoteConn, conn)
+			metrics.AddTraffic(o.config.Name, upload, download)
+			metadata.Stats.AddTraffic(upload, download)
+			return err
 		} else {
-			motd := generateMOTD(metadata.Minecraft.ProtocolVersion, o.config, &o.onlineCount)
-			buffer := buf.New()
-			buffer.Reset(mcprotocol.MaxVarIntLen)
-			buffer.WriteByte(0) // Client bound : Status Response
-			mcprotocol.VarInt(len(motd)).WriteToBuffer(buffer)
-			clientMC := mcprotocol.Conn{
-				Reader: conn,
-				Writer: common.UnwrapWriter(conn), // unwrap to make writev syscall possible
-				Conn:   conn,
-			}
-			err = clientMC.WriteVectorizedPacket(buffer, motd)
+			motd := generateMOTD(metadata.Minecraft.ProtocolVersion, o.config, o.onlineCount)
+			err = respondStatus(conn, motd, o.config.Minecraft.PingMode)
 			if err != nil {
-				return common.Cause("respond MOTD: ", err)
-			}
-
-			switch o.config.Minecraft.PingMode {
-			case pingModeDisconnect:
-				// do nothing and disconnect
-			case pingMode0ms:
-				buffer.WriteByte(1) // Client bound : Ping Response
-				buffer.Extend(8)    // size of int64 timestamp
-				err = clientMC.WritePacket(buffer)
-				buffer.Release()
-				if err != nil {
-					return common.Cause("respond 0ms ping: ", err)
-				}
-			default:
-				err = clientMC.ReadLimitedPacket(buffer, 9)
-				if err != nil {
-					buffer.Release()
-					return common.Cause("read ping request: ", err)
-				}
-				err = clientMC.WritePacket(buffer)
-				buffer.Release()
-				if err != nil {
-					return common.Cause("respond ping request: ", err)
-				}
+				return err
 			}
 			o.logger.Info().
 				Str("proxyConnectionID", metadata.ConnectionID).
@@ -303,11 +290,20 @@ func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn,
 			return nil
 		}
 
+	case mcprotocol.NextStateTransfer:
+		if o.config.Minecraft.Limbo == nil {
+			// TODO: Minecraft transfer support
+			conn.Conn.(*net.TCPConn).SetLinger(0)
+			return conn.Close()
+		}
+		// players transferred from the limbo log in as usual
+		fallthrough
 	case mcprotocol.NextStateLogin:
 		buffer := buf.New()
 		buffer.Reset(mcprotocol.MaxVarIntLen)
 		if o.config.Minecraft.NameAccess.Mode != access.DefaultMode {
 			if !access.Check(o.nameAccessLists, o.config.Minecraft.NameAccess.Mode, metadata.Minecraft.PlayerName) {
+				metrics.AccessRejections.WithLabelValues(metrics.RejectMinecraftName).Inc()
 				msg, err := generateKickMessage(o.config, metadata.Minecraft.PlayerName).MarshalJSON()
 				if err != nil { // almost impossible
 					buffer.Release()
@@ -327,13 +323,42 @@ func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn,
 					Str("player", metadata.Minecraft.PlayerName).
 					Str("sourceNetAddr", metadata.SourceAddress.String()).
 					Msg("Kicked by name access control")
+				o.emitEvent(ctx, event.TypePlayerRejected, metadata, metrics.RejectMinecraftName)
 				conn.Conn.(*net.TCPConn).SetLinger(10)
 				buffer.Release()
 				return nil
 			}
 		}
-		if o.config.Minecraft.OnlineCount.EnableMaxLimit &&
-			o.config.Minecraft.OnlineCount.Max <= o.onlineCount.Load() {
+		if drainMessage := o.drainMessage.Load(); drainMessage != nil {
+			msg, err := generateShutdownMessage(*drainMessage).MarshalJSON()
+			if err != nil {
+				buffer.Release()
+				return common.Cause("generate shutdown message: ", err)
+			}
+			buffer.WriteByte(0) // Client bound : Disconnect (login)
+			mcprotocol.VarInt(len(msg)).WriteToBuffer(buffer)
+			err = mcprotocol.Conn{Writer: common.UnwrapWriter(conn)}.WriteVectorizedPacket(buffer, msg)
+			buffer.Release()
+			if err != nil {
+				return common.Cause("send shutdown packet: ", err)
+			}
+			o.logger.Info().
+				Str("proxyConnectionID", metadata.ConnectionID).
+				Str("outbound", o.config.Name).
+				Str("player", metadata.Minecraft.PlayerName).
+				Msg("Kicked because of shutting down")
+			conn.Conn.(*net.TCPConn).SetLinger(10)
+			return nil
+		}
+		reserved := o.config.Minecraft.Limbo != nil && o.queue.claim(newQueuePlayer(metadata))
+		if !reserved && o.config.Minecraft.OnlineCount.EnableMaxLimit &&
+			(o.config.Minecraft.OnlineCount.Max <= o.onlineCount.Load()+int32(o.queue.reservations()) ||
+				o.config.Minecraft.Limbo != nil && o.queue.busy()) {
+			if ticket := o.enterQueue(metadata); ticket != nil {
+				buffer.Release()
+				return o.runLimbo(ctx, conn, metadata, ticket)
+			}
+			metrics.AccessRejections.WithLabelValues(metrics.RejectMinecraftOnlineMax).Inc()
 			msg, err := generatePlayerNumberLimitExceededMessage(o.config, metadata.Minecraft.PlayerName).MarshalJSON()
 			if err != nil {
 				buffer.Release()
@@ -353,6 +378,7 @@ func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn,
 				Str("player", metadata.Minecraft.PlayerName).
 				Str("sourceNetAddr", metadata.SourceAddress.String()).
 				Msg("Kicked by player number limiter")
+			o.emitEvent(ctx, event.TypePlayerRejected, metadata, metrics.RejectMinecraftOnlineMax)
 			conn.Conn.(*net.TCPConn).SetLinger(10)
 			buffer.Release()
 			return nil
@@ -361,6 +387,15 @@ func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn,
 		serverConn, err := o.connectServer(ctx, metadata)
 		if err != nil {
 			buffer.Release()
+			if ticket := o.enterQueue(metadata); ticket != nil {
+				o.logger.Warn().
+					Str("proxyConnectionID", metadata.ConnectionID).
+					Str("outbound", o.config.Name).
+					Err(err).
+					Msg("Failed to connect server, holding player in limbo")
+				o.queue.markDown()
+				return o.runLimbo(ctx, conn, metadata, ticket)
+			}
 			return common.Cause("connect server: ", err)
 		}
 		hostname := metadata.Minecraft.RewrittenDestination
@@ -403,21 +438,111 @@ func (o *Outbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn,
 			Str("player", metadata.Minecraft.PlayerName).
 			Str("sourceNetAddr", metadata.SourceAddress.String()).
 			Msg("Created Minecraft connection")
+		loginTime := time.Now()
+		o.emitEvent(ctx, event.TypePlayerLogin, metadata, "")
 		o.onlineCount.Add(1)
-		err = bufio.CopyConn(serverConn, conn)
+		onlinePlayers := metrics.MinecraftOnlinePlayers.WithLabelValues(o.config.Name)
+		onlinePlayers.Inc()
+		upload, download, err := bufio.CopyConnCounted(serverConn, conn)
 		o.onlineCount.Add(-1)
+		onlinePlayers.Dec()
+		metrics.AddTraffic(o.config.Name, upload, download)
+		metadata.Stats.AddTraffic(upload, download)
+		disconnectEvent := o.newEvent(event.TypePlayerDisconnect, metadata, "")
+		disconnectEvent.Duration = jsonx.Duration(time.Since(loginTime))
+		event.Emit(ctx, disconnectEvent)
 		return err
 
-	case mcprotocol.NextStateTransfer:
-		// TODO: Minecraft transfer support
-		conn.Conn.(*net.TCPConn).SetLinger(0)
-		return conn.Close()
-
 	default:
 		return errors.New("unknown next state")
 	}
 }
 
+// respondStatus sends the status response, then handles the ping request in pingMode.
+func respondStatus(conn *bufio.CachedConn, motd []byte, pingMode string) error {
+	buffer := buf.New()
+	buffer.Reset(mcprotocol.MaxVarIntLen)
+	buffer.WriteByte(0) // Client bound : Status Response
+	mcprotocol.VarInt(len(motd)).WriteToBuffer(buffer)
+	clientMC := mcprotocol.Conn{
+		Reader: conn,
+		Writer: common.UnwrapWriter(conn), // unwrap to make writev syscall possible
+		Conn:   conn,
+	}
+	err := clientMC.WriteVectorizedPacket(buffer, motd)
+	if err != nil {
+		buffer.Release()
+		return common.Cause("respond MOTD: ", err)
+	}
+
+	switch pingMode {
+	case pingModeDisconnect:
+		// do nothing and disconnect
+		buffer.Release()
+	case pingMode0ms:
+		buffer.WriteByte(1) // Client bound : Ping Response
+		buffer.Extend(8)    // size of int64 timestamp
+		err = clientMC.WritePacket(buffer)
+		buffer.Release()
+		if err != nil {
+			return common.Cause("respond 0ms ping: ", err)
+		}
+	default:
+		err = clientMC.ReadLimitedPacket(buffer, 9)
+		if err != nil {
+			buffer.Release()
+			return common.Cause("read ping request: ", err)
+		}
+		err = clientMC.WritePacket(buffer)
+		buffer.Release()
+		if err != nil {
+			return common.Cause("respond ping request: ", err)
+		}
+	}
+	return nil
+}
+
+// sendDisconnect sends the login disconnect packet with msg.
+func sendDisconnect(conn *bufio.CachedConn, msg mcprotocol.Message) error {
+	content, err := msg.MarshalJSON()
+	if err != nil { // almost impossible
+		return err
+	}
+	buffer := buf.New()
+	buffer.Reset(mcprotocol.MaxVarIntLen)
+	buffer.WriteByte(0) // Client bound : Disconnect (login)
+	mcprotocol.VarInt(len(content)).WriteToBuffer(buffer)
+	err = mcprotocol.Conn{Writer: common.UnwrapWriter(conn)}.WriteVectorizedPacket(buffer, content)
+	buffer.Release()
+	return err
+}
+
 func (o *Outbound) DialContext(context.Context, string, string) (net.Conn, error) {
 	return nil, adapter.ErrInjectionRequired
 }
+
+func (o *Outbound) newEvent(eventType string, metadata *adapter.Metadata, reason string) *event.Event {
+	e := event.NewConnectionEvent(eventType, metadata)
+	e.Outbound = o.config.Name
+	e.Reason = reason
+	return e
+}
+
+func (o *Outbound) emitEvent(ctx context.Context, eventType string, metadata *adapter.Metadata, reason string) {
+	event.Emit(ctx, o.newEvent(eventType, metadata, reason))
+}
+
+// Drain makes the outbound kick new players with the message instead of connecting them to the server.
+func (o *Outbound) Drain(message string) {
+	o.drainMessage.Store(&message)
+}
+
+// Inherit shares the online player count, the limbo queue and the drain state of the old outbound,
+// so the players connected before reloading are still counted and drained.
+func (o *Outbound) Inherit(old adapter.Outbound) {
+	if oldOutbound, isMinecraft := old.(*Outbound); isMinecraft {
+		o.onlineCount = oldOutbound.onlineCount
+		o.queue = oldOutbound.queue
+		o.drainMessage = oldOutbound.drainMessage
+	}
+}
@@ -0,0 +1,166 @@
+package minecraft
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+)
+
+// reservationTimeout is how long a slot is kept for the player transferred from limbo.
+const reservationTimeout = 30 * time.Second
+
+// queue holds the players waiting in limbo, it is shared with the reloaded outbound.
+type queue struct {
+	access     sync.Mutex
+	waiting    []*queueTicket
+	reserved   map[queuePlayer]time.Time // player to expiration
+	serverDown bool
+	checking   bool
+	lastCheck  time.Time
+}
+
+type queueTicket struct {
+	player   queuePlayer
+	admitted chan struct{} // closed when a slot is reserved for the player
+}
+
+// queuePlayer identifies the player coming back from limbo on a new connection.
+// The name and UUID are not verified in offline mode, so the source address is
+// also compared, a reservation can still be taken by a client sharing the address
+// and sending the same name and UUID.
+type queuePlayer struct {
+	name    string // lower case
+	uuid    [16]byte
+	address netip.Addr
+}
+
+func newQueuePlayer(metadata *adapter.Metadata) queuePlayer {
+	return queuePlayer{
+		name:    strings.ToLower(metadata.Minecraft.PlayerName),
+		uuid:    metadata.Minecraft.UUID,
+		address: metadata.SourceAddress.Addr().Unmap(),
+	}
+}
+
+func newQueue() *queue {
+	return &queue{
+		reserved: make(map[queuePlayer]time.Time),
+	}
+}
+
+// enter adds the player to the end of the queue, and returns nil if the queue is full.
+// size <= 0 means unlimited.
+func (q *queue) enter(player queuePlayer, size int) *queueTicket {
+	q.access.Lock()
+	defer q.access.Unlock()
+	if size > 0 && len(q.waiting) >= size {
+		return nil
+	}
+	ticket := &queueTicket{
+		player:   player,
+		admitted: make(chan struct{}),
+	}
+	q.waiting = append(q.waiting, ticket)
+	return ticket
+}
+
+// leave removes the ticket if it is still waiting.
+func (q *queue) leave(ticket *queueTicket) {
+	q.access.Lock()
+	defer q.access.Unlock()
+	for i, t := range q.waiting {
+		if t == ticket {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// position returns the 1-based position of the ticket and the queue size,
+// position is 0 if the ticket is not waiting.
+func (q *queue) position(ticket *queueTicket) (int, int) {
+	q.access.Lock()
+	defer q.access.Unlock()
+	for i, t := range q.waiting {
+		if t == ticket {
+			return i + 1, len(q.waiting)
+		}
+	}
+	return 0, len(q.waiting)
+}
+
+// busy reports whether new players should wait in the queue.
+func (q *queue) busy() bool {
+	q.access.Lock()
+	defer q.access.Unlock()
+	return len(q.waiting) > 0 || q.serverDown
+}
+
+// claim consumes the reservation of the player, and returns false if there is none.
+func (q *queue) claim(player queuePlayer) bool {
+	q.access.Lock()
+	defer q.access.Unlock()
+	expiration, found := q.reserved[player]
+	delete(q.reserved, player)
+	return found && time.Now().Before(expiration)
+}
+
+// reservations returns the number of the slots reserved.
+func (q *queue) reservations() int {
+	q.access.Lock()
+	defer q.access.Unlock()
+	return q.reservationsLocked()
+}
+
+func (q *queue) reservationsLocked() int {
+	now := time.Now()
+	for player, expiration := range q.reserved {
+		if !now.Before(expiration) {
+			delete(q.reserved, player)
+		}
+	}
+	return len(q.reserved)
+}
+
+// markDown makes the queue wait until checkServer succeeds.
+func (q *queue) markDown() {
+	q.access.Lock()
+	q.serverDown = true
+	q.access.Unlock()
+}
+
+// admit reserves slots for the players at the head of the queue.
+// free returns the number of free slots with the reserved ones excluded,
+// checkServer is called at most once in checkInterval if the server is down.
+func (q *queue) admit(free func(reserved int) int, checkInterval time.Duration, checkServer func() bool) {
+	q.access.Lock()
+	if q.serverDown {
+		if q.checking || time.Since(q.lastCheck) < checkInterval {
+			q.access.Unlock()
+			return
+		}
+		q.checking = true
+		q.lastCheck = time.Now()
+		q.access.Unlock()
+		up := checkServer() // without holding the lock since dialing may take a while
+		q.access.Lock()
+		q.checking = false
+		if !up {
+			q.access.Unlock()
+			return
+		}
+		q.serverDown = false
+	}
+	defer q.access.Unlock()
+	slots := free(q.reservationsLocked())
+	for slots > 0 && len(q.waiting) > 0 {
+		ticket := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.reserved[ticket.player] = time.Now().Add(reservationTimeout)
+		close(ticket.admitted)
+		slots--
+	}
+}
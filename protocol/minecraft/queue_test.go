@@ -0,0 +1,193 @@
+package minecraft
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+)
+
+var testPlayerAddress = netip.MustParseAddrPort("192.0.2.1:50000")
+
+func testPlayer(name string) queuePlayer {
+	return newQueuePlayer(&adapter.Metadata{
+		SourceAddress: testPlayerAddress,
+		Minecraft:     &adapter.MinecraftMetadata{PlayerName: name, UUID: [16]byte{1}},
+	})
+}
+
+func isAdmitted(ticket *queueTicket) bool {
+	select {
+	case <-ticket.admitted:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestQueueEnter(t *testing.T) {
+	q := newQueue()
+	first := q.enter(testPlayer("Steve"), 2)
+	second := q.enter(testPlayer("Alex"), 2)
+	if first == nil || second == nil {
+		t.Fatal("failed to enter a queue with free space")
+	}
+	if q.enter(testPlayer("Notch"), 2) != nil {
+		t.Error("entered a full queue")
+	}
+	if position, size := q.position(second); position != 2 || size != 2 {
+		t.Errorf("got position %d of %d, want 2 of 2", position, size)
+	}
+	if !q.busy() {
+		t.Error("queue with waiting players is not busy")
+	}
+
+	q.leave(first)
+	if position, size := q.position(second); position != 1 || size != 1 {
+		t.Errorf("got position %d of %d after leaving, want 1 of 1", position, size)
+	}
+	if position, _ := q.position(first); position != 0 {
+		t.Errorf("left ticket is at position %d", position)
+	}
+	q.leave(first) // no-op
+
+	unlimited := newQueue()
+	for i := 0; i < 100; i++ {
+		if unlimited.enter(testPlayer("Steve"), 0) == nil {
+			t.Fatal("failed to enter an unlimited queue")
+		}
+	}
+}
+
+func TestQueueAdmitAndClaim(t *testing.T) {
+	q := newQueue()
+	steve := q.enter(testPlayer("Steve"), 0)
+	alex := q.enter(testPlayer("Alex"), 0)
+	notch := q.enter(testPlayer("Notch"), 0)
+
+	var reservedSeen int
+	q.admit(func(reserved int) int {
+		reservedSeen = reserved
+		return 2
+	}, time.Minute, func() bool {
+		t.Error("server is checked while it is up")
+		return true
+	})
+	if reservedSeen != 0 {
+		t.Errorf("free slots are asked with %d reserved, want 0", reservedSeen)
+	}
+	if !isAdmitted(steve) || !isAdmitted(alex) || isAdmitted(notch) {
+		t.Error("the first two players are not the admitted ones")
+	}
+	if position, size := q.position(notch); position != 1 || size != 1 {
+		t.Errorf("got position %d of %d, want 1 of 1", position, size)
+	}
+	if q.reservations() != 2 {
+		t.Errorf("got %d reservations, want 2", q.reservations())
+	}
+
+	q.admit(func(reserved int) int {
+		reservedSeen = reserved
+		return 0
+	}, time.Minute, nil)
+	if reservedSeen != 2 {
+		t.Errorf("free slots are asked with %d reserved, want 2", reservedSeen)
+	}
+	if isAdmitted(notch) {
+		t.Error("admitted without free slots")
+	}
+
+	// names are case-insensitive and each reservation is claimed once
+	if !q.claim(testPlayer("steve")) {
+		t.Error("failed to claim the reservation")
+	}
+	if q.claim(testPlayer("Steve")) {
+		t.Error("claimed the reservation twice")
+	}
+	if q.claim(testPlayer("Notch")) {
+		t.Error("claimed without a reservation")
+	}
+	if q.reservations() != 1 {
+		t.Errorf("got %d reservations, want 1", q.reservations())
+	}
+
+	// the reservation is bound to the UUID and address of the queued connection
+	for _, testCase := range []struct {
+		name     string
+		metadata *adapter.Metadata
+	}{
+		{"other UUID", &adapter.Metadata{
+			SourceAddress: testPlayerAddress,
+			Minecraft:     &adapter.MinecraftMetadata{PlayerName: "Alex", UUID: [16]byte{2}},
+		}},
+		{"other address", &adapter.Metadata{
+			SourceAddress: netip.MustParseAddrPort("192.0.2.2:50000"),
+			Minecraft:     &adapter.MinecraftMetadata{PlayerName: "Alex", UUID: [16]byte{1}},
+		}},
+	} {
+		if q.claim(newQueuePlayer(testCase.metadata)) {
+			t.Errorf("claimed the reservation of Alex with %s", testCase.name)
+		}
+	}
+	// the port and IPv4-mapped form of the address do not matter
+	if !q.claim(newQueuePlayer(&adapter.Metadata{
+		SourceAddress: netip.MustParseAddrPort("[::ffff:192.0.2.1]:50001"),
+		Minecraft:     &adapter.MinecraftMetadata{PlayerName: "Alex", UUID: [16]byte{1}},
+	})) {
+		t.Error("failed to claim the reservation from a new connection")
+	}
+}
+
+func TestQueueReservationExpiry(t *testing.T) {
+	q := newQueue()
+	q.reserved[testPlayer("steve")] = time.Now().Add(-time.Second)
+	q.reserved[testPlayer("alex")] = time.Now().Add(-time.Second)
+	if q.claim(testPlayer("Steve")) {
+		t.Error("claimed an expired reservation")
+	}
+	if q.reservations() != 0 {
+		t.Errorf("got %d reservations, want expired ones removed", q.reservations())
+	}
+	if _, found := q.reserved[testPlayer("alex")]; found {
+		t.Error("expired reservation is kept")
+	}
+}
+
+func TestQueueMarkDown(t *testing.T) {
+	q := newQueue()
+	if q.busy() {
+		t.Error("empty queue is busy")
+	}
+	q.markDown()
+	if !q.busy() {
+		t.Error("queue of a down server is not busy")
+	}
+	ticket := q.enter(testPlayer("Steve"), 0)
+
+	var checks int
+	up := false
+	checkServer := func() bool {
+		checks++
+		return up
+	}
+	free := func(int) int { return 1 }
+	q.admit(free, time.Hour, checkServer)
+	if checks != 1 || isAdmitted(ticket) {
+		t.Fatalf("got %d checks and admitted %v while down, want 1 check", checks, isAdmitted(ticket))
+	}
+	q.admit(free, time.Hour, checkServer)
+	if checks != 1 {
+		t.Errorf("server is checked %d times within the check interval", checks)
+	}
+
+	up = true
+	q.lastCheck = time.Now().Add(-2 * time.Hour)
+	q.admit(free, time.Hour, checkServer)
+	if checks != 2 || !isAdmitted(ticket) {
+		t.Errorf("got %d checks and admitted %v after the server is up, want 2 checks and admitted", checks, isAdmitted(ticket))
+	}
+	if q.busy() {
+		t.Error("queue is still busy after the server is up")
+	}
+}
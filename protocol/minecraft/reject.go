@@ -0,0 +1,66 @@
+package minecraft
+
+import (
+	"context"
+	"net"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/mcprotocol"
+	"github.com/layou233/zbproxy/v3/common/metrics"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/event"
+)
+
+const defaultRejectMessage = "Your connection request is refused by ZBProxy."
+
+// RejectOutbound disconnects Minecraft players with a message, and closes other connections.
+type RejectOutbound struct {
+	message string
+}
+
+var (
+	_ adapter.Outbound       = (*RejectOutbound)(nil)
+	_ adapter.InjectOutbound = (*RejectOutbound)(nil)
+)
+
+func NewRejectOutbound(message string) *RejectOutbound {
+	if message == "" {
+		message = defaultRejectMessage
+	}
+	return &RejectOutbound{message: message}
+}
+
+func (o *RejectOutbound) Name() string {
+	return "REJECT"
+}
+
+func (o *RejectOutbound) PostInitialize(adapter.Router) error {
+	return nil
+}
+
+func (o *RejectOutbound) Reload(*config.Outbound) error {
+	return nil
+}
+
+func (o *RejectOutbound) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, adapter.ErrInjectionRequired
+}
+
+func (o *RejectOutbound) InjectConnection(ctx context.Context, conn *bufio.CachedConn, metadata *adapter.Metadata) error {
+	if metadata.Minecraft == nil || metadata.Minecraft.NextState == mcprotocol.NextStateStatus {
+		return conn.Close()
+	}
+	metrics.AccessRejections.WithLabelValues(metrics.RejectRule).Inc()
+	err := sendDisconnect(conn, generateRejectMessage(o.message))
+	if err != nil {
+		return common.Cause("send reject packet: ", err)
+	}
+	e := event.NewConnectionEvent(event.TypePlayerRejected, metadata)
+	e.Outbound = o.Name()
+	e.Reason = metrics.RejectRule
+	event.Emit(ctx, e)
+	conn.Conn.(*net.TCPConn).SetLinger(10)
+	return nil
+}
@@ -20,8 +20,16 @@ func NewOutbound(logger *log.Logger, newConfig *config.Outbound) (adapter.Outbou
 		return nil, os.ErrInvalid
 	}
 	switch {
+	case newConfig.Minecraft != nil && newConfig.Maintenance != nil:
+		return nil, errors.New("Minecraft and Maintenance can not be used together")
+	case newConfig.HostMap != nil && (newConfig.Minecraft != nil || newConfig.Maintenance != nil):
+		return nil, errors.New("HostMap can not be used with Minecraft or Maintenance")
+	case newConfig.HostMap != nil:
+		return NewHostMap(logger, newConfig)
 	case newConfig.Minecraft != nil:
 		return minecraft.NewOutbound(logger, newConfig)
+	case newConfig.Maintenance != nil:
+		return minecraft.NewMaintenanceOutbound(logger, newConfig)
 	}
 	return &Plain{
 		logger: logger,
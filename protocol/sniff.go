@@ -3,6 +3,7 @@ package protocol
 import (
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/metrics"
 	"github.com/layou233/zbproxy/v3/protocol/minecraft"
 
 	"github.com/phuslu/log"
@@ -33,6 +34,7 @@ func Sniff(logger *log.Logger, conn bufio.PeekConn, metadata *adapter.Metadata,
 			if metadata.Minecraft == nil {
 				err = minecraft.SniffClientHandshake(conn, metadata)
 				if err != nil {
+					metrics.SniffFailures.WithLabelValues(SniffTypeMinecraft).Inc()
 					logger.Trace().
 						Str("protocol", protocol).
 						Err(err).
@@ -48,9 +50,10 @@ func Sniff(logger *log.Logger, conn bufio.PeekConn, metadata *adapter.Metadata,
 
 		default:
 			if sniffAll {
-				for _, snifferFunc := range registry {
+				for name, snifferFunc := range registry {
 					err = snifferFunc(logger, conn, metadata)
 					if err != nil {
+						metrics.SniffFailures.WithLabelValues(name).Inc()
 						logger.Trace().
 							Str("protocol", protocol).
 							Err(err).
@@ -62,6 +65,7 @@ func Sniff(logger *log.Logger, conn bufio.PeekConn, metadata *adapter.Metadata,
 				if snifferFunc := registry[protocol]; snifferFunc != nil {
 					err = snifferFunc(logger, conn, metadata)
 					if err != nil {
+						metrics.SniffFailures.WithLabelValues(protocol).Inc()
 						logger.Trace().
 							Str("protocol", protocol).
 							Err(err).
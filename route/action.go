@@ -0,0 +1,101 @@
+package route
+
+import (
+	"errors"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/protocol/minecraft"
+)
+
+// ruleAction is the compiled action of a rule.
+type ruleAction struct {
+	action   string
+	rewrite  ruleRewrite
+	jump     *RuleSet                    // nil if not jumping
+	metadata map[string]*rewriteTemplate // for set-metadata
+	reject   adapter.Outbound            // for reject-with-message
+}
+
+func newRuleAction(ruleConfig *config.Rule, ruleSets map[string]*RuleSet) (ruleAction, error) {
+	action := ruleAction{action: ruleConfig.Action}
+	err := checkActionFields(ruleConfig)
+	if err != nil {
+		return action, err
+	}
+	action.rewrite, err = newRuleRewrite(&ruleConfig.Rewrite)
+	if err != nil {
+		return action, err
+	}
+	if ruleConfig.Jump != "" {
+		if ruleConfig.Action == "" && ruleConfig.Outbound != "" {
+			return action, errors.New("Jump and Outbound can not be used together")
+		}
+		var found bool
+		action.jump, found = ruleSets[ruleConfig.Jump]
+		if !found {
+			return action, errors.New("rule set [" + ruleConfig.Jump + "] is not found")
+		}
+	}
+	if len(ruleConfig.Metadata) > 0 {
+		action.metadata = make(map[string]*rewriteTemplate, len(ruleConfig.Metadata))
+		for key, value := range ruleConfig.Metadata {
+			action.metadata[key], err = compileTemplate(value)
+			if err != nil {
+				return action, common.Cause("bad metadata ["+key+"]: ", err)
+			}
+		}
+	}
+	if ruleConfig.Action == config.RuleActionRejectWithMessage {
+		action.reject = minecraft.NewRejectOutbound(ruleConfig.Message)
+	}
+	return action, nil
+}
+
+// checkActionFields makes sure the fields required by the explicit action are set,
+// and the fields used by other actions are not.
+func checkActionFields(ruleConfig *config.Rule) error {
+	var required string
+	switch ruleConfig.Action {
+	case "":
+		if len(ruleConfig.Metadata) > 0 || ruleConfig.Message != "" {
+			return errors.New("Metadata and Message require an action")
+		}
+		return nil
+	case config.RuleActionRoute:
+		required = "Outbound"
+	case config.RuleActionJump:
+		required = "Jump"
+	case config.RuleActionSniff:
+		required = "Sniff"
+	case config.RuleActionRewrite:
+		required = "Rewrite"
+	case config.RuleActionSetMetadata:
+		required = "Metadata"
+	case config.RuleActionReturn:
+	case config.RuleActionRejectWithMessage:
+		required = "Message"
+	default:
+		return errors.New("unknown action [" + ruleConfig.Action + "]")
+	}
+	for _, field := range []struct {
+		name  string
+		isSet bool
+	}{
+		{"Outbound", ruleConfig.Outbound != ""},
+		{"Jump", ruleConfig.Jump != ""},
+		{"Sniff", len(ruleConfig.Sniff) > 0},
+		{"Rewrite", ruleConfig.Rewrite != (config.RuleRewrite{})},
+		{"Metadata", len(ruleConfig.Metadata) > 0},
+		{"Message", ruleConfig.Message != ""},
+	} {
+		if field.name == required && !field.isSet {
+			return errors.New(field.name + " is required by action [" + ruleConfig.Action + "]")
+		}
+		if field.name != required && field.isSet {
+			return errors.New(field.name + " can not be used with action [" + ruleConfig.Action + "]")
+		}
+	}
+	return nil
+}
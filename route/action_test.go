@@ -0,0 +1,165 @@
+package route
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/protocol"
+	"github.com/layou233/zbproxy/v3/protocol/minecraft"
+
+	"github.com/phuslu/log"
+)
+
+var testSnifferRegistry = map[string]protocol.SnifferFunc{
+	"test": func(_ *log.Logger, _ bufio.PeekConn, metadata *adapter.Metadata) error {
+		metadata.SetCustom("sniffed", "yes")
+		return nil
+	},
+}
+
+func TestRuleActions(t *testing.T) {
+	// each rule is matched by its own service name or "all",
+	// and rules after the continuing ones route to "d"
+	router, err := newTestRouter(t, `{
+		"Rules": [
+			{"Type": "ServiceName", "Parameter": ["route", "all"], "Action": "route", "Outbound": "a"},
+			{"Type": "ServiceName", "Parameter": ["jump", "all"], "Action": "jump", "Jump": "set"},
+			{"Type": "ServiceName", "Parameter": ["sniff", "all"], "Action": "sniff", "Sniff": "test"},
+			{"Type": "ServiceName", "Parameter": ["rewrite", "all"], "Action": "rewrite", "Rewrite": {"TargetAddress": "rewritten.example.net", "TargetPort": 25566}},
+			{"Type": "ServiceName", "Parameter": ["set-metadata", "all"], "Action": "set-metadata", "Metadata": {"region": "eu-{service}"}},
+			{"Type": "ServiceName", "Parameter": "return", "Action": "return"},
+			{"Type": "ServiceName", "Parameter": "reject", "Action": "reject-with-message", "Message": "Go away"},
+			{"Type": "ServiceName", "Parameter": "legacy-continue", "Sniff": "test", "Rewrite": {"TargetAddress": "legacy.example.net"}},
+			{"Type": "ServiceName", "Parameter": "legacy-route", "Sniff": "test", "Outbound": "b"},
+			{"Type": "ServiceName", "Parameter": "legacy-jump", "Jump": "set"},
+			{"Type": "ServiceName", "Parameter": ["set-metadata", "legacy-continue", "legacy-jump", "sniff", "rewrite", "jump"], "Outbound": "d"}
+		],
+		"RuleSets": {
+			"set": {"Rules": [
+				{"Type": "always", "Action": "set-metadata", "Metadata": {"jumped": "yes"}}
+			]}
+		},
+		"DefaultOutbound": "c"
+	}`, testSnifferRegistry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		serviceName string
+		outbound    string
+		ruleIndex   int
+		check       func(metadata *adapter.Metadata) bool
+	}{
+		{"route", "a", 0, nil},
+		{"all", "a", 0, nil}, // stops at the first rule
+		{"jump", "d", 10, func(metadata *adapter.Metadata) bool {
+			jumped, _ := metadata.CustomString("jumped")
+			return jumped == "yes"
+		}},
+		{"sniff", "d", 10, func(metadata *adapter.Metadata) bool {
+			sniffed, _ := metadata.CustomString("sniffed")
+			return sniffed == "yes"
+		}},
+		{"rewrite", "d", 10, func(metadata *adapter.Metadata) bool {
+			return metadata.DestinationHostname == "rewritten.example.net" && metadata.DestinationPort == 25566
+		}},
+		{"set-metadata", "d", 10, func(metadata *adapter.Metadata) bool {
+			region, _ := metadata.CustomString("region")
+			return region == "eu-set-metadata"
+		}},
+		{"return", "c", 5, nil},
+		{"reject", "REJECT", 6, nil}, // the type of outbound is checked below
+		{"legacy-continue", "d", 10, func(metadata *adapter.Metadata) bool {
+			sniffed, _ := metadata.CustomString("sniffed")
+			return sniffed == "yes" && metadata.DestinationHostname == "legacy.example.net"
+		}},
+		{"legacy-route", "b", 8, func(metadata *adapter.Metadata) bool {
+			sniffed, _ := metadata.CustomString("sniffed")
+			return sniffed == "yes"
+		}},
+		{"legacy-jump", "d", 10, func(metadata *adapter.Metadata) bool {
+			jumped, _ := metadata.CustomString("jumped")
+			return jumped == "yes"
+		}},
+		{"none", "c", -1, nil},
+	} {
+		metadata := &adapter.Metadata{ServiceName: testCase.serviceName}
+		metadata.Stats.RuleIndex = -1
+		outbound := routeTest(t, router, metadata)
+		if outbound.Name() != testCase.outbound {
+			t.Errorf("%s: got outbound %s, want %s", testCase.serviceName, outbound.Name(), testCase.outbound)
+			continue
+		}
+		if metadata.Stats.RuleIndex != testCase.ruleIndex {
+			t.Errorf("%s: got rule index %d, want %d", testCase.serviceName, metadata.Stats.RuleIndex, testCase.ruleIndex)
+		}
+		if testCase.check != nil && !testCase.check(metadata) {
+			t.Errorf("%s: action is not applied, got metadata %+v", testCase.serviceName, metadata)
+		}
+		if testCase.serviceName == "reject" {
+			if _, isReject := outbound.(*minecraft.RejectOutbound); !isReject {
+				t.Errorf("reject: got outbound %T, want the reject outbound with message", outbound)
+			}
+		}
+	}
+}
+
+func TestRuleActionErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		rule string
+		err  string
+	}{
+		{`{"Type": "always", "Action": "unknown"}`, "unknown action [unknown]"},
+		{`{"Type": "always", "Action": "route"}`, "Outbound is required by action [route]"},
+		{`{"Type": "always", "Action": "route", "Outbound": "a", "Sniff": "test"}`, "Sniff can not be used with action [route]"},
+		{`{"Type": "always", "Action": "jump"}`, "Jump is required by action [jump]"},
+		{`{"Type": "always", "Action": "sniff", "Sniff": "test", "Outbound": "a"}`, "Outbound can not be used with action [sniff]"},
+		{`{"Type": "always", "Action": "rewrite"}`, "Rewrite is required by action [rewrite]"},
+		{`{"Type": "always", "Action": "set-metadata"}`, "Metadata is required by action [set-metadata]"},
+		{`{"Type": "always", "Action": "set-metadata", "Metadata": {"a": "{bad}"}}`, "bad metadata [a]"},
+		{`{"Type": "always", "Action": "return", "Outbound": "a"}`, "Outbound can not be used with action [return]"},
+		{`{"Type": "always", "Action": "reject-with-message"}`, "Message is required by action [reject-with-message]"},
+		{`{"Type": "always", "Metadata": {"a": "b"}}`, "Metadata and Message require an action"},
+		{`{"Type": "always", "Message": "Go away"}`, "Metadata and Message require an action"},
+	} {
+		_, err := newTestRouter(t, `{"Rules": [`+testCase.rule+`]}`, testSnifferRegistry)
+		if err == nil {
+			t.Errorf("%s: no error, want %q", testCase.rule, testCase.err)
+		} else if !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("%s: got error %q, want %q", testCase.rule, err, testCase.err)
+		}
+	}
+}
+
+func TestLogicalSubRuleFields(t *testing.T) {
+	for _, subRule := range []string{
+		`{"Type": "always", "Action": "route", "Outbound": "a"}`,
+		`{"Type": "always", "Jump": "set"}`,
+		`{"Type": "always", "Metadata": {"a": "b"}}`,
+		`{"Type": "always", "Message": "Go away"}`,
+	} {
+		for _, logicType := range []string{"and", "or"} {
+			_, err := newTestRouter(t, `{
+				"Rules": [{"Type": "`+logicType+`", "Parameter": [{"Type": "always"}, `+subRule+`], "Outbound": "a"}],
+				"RuleSets": {"set": {"Rules": []}}
+			}`, nil)
+			if err == nil {
+				t.Errorf("%s: sub-rule %s is accepted", logicType, subRule)
+			}
+		}
+	}
+
+	router, err := newTestRouter(t, `{
+		"Rules": [{"Type": "and", "Parameter": [{"Type": "always"}, {"Type": "ServiceName", "Parameter": "lobby"}], "Outbound": "a"}],
+		"DefaultOutbound": "b"
+	}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbound := routeTest(t, router, &adapter.Metadata{ServiceName: "lobby"}).Name(); outbound != "a" {
+		t.Errorf("got outbound %s, want a", outbound)
+	}
+}
@@ -0,0 +1,212 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+// rewriteTemplate is a rewrite value with variables evaluated against the connection metadata.
+//
+//	$0-$9                        the groups captured by the matched rule
+//	{source_ip} {source_port}    the client address
+//	{service}                    the name of the service accepting the connection
+//	{destination}                the current destination hostname
+//	{sni}                        the sniffed TLS server name
+//	{minecraft.hostname}         the sniffed Minecraft hostname without the FML suffix
+//	{minecraft.hostname_label_N} the Nth label of the Minecraft hostname, counted from 0 on the left
+//	{minecraft.port} {minecraft.player} {minecraft.protocol}
+//	{custom.KEY}                 the value of KEY in Metadata.Custom
+//
+// Variables without values are evaluated as empty strings,
+// "$$", "{{" and "}}" are literal "$", "{" and "}".
+// ${N} can not be used since it is substituted as an environment variable when loading config.
+type rewriteTemplate struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal  string
+	variable func(metadata *adapter.Metadata) string // nil for literal
+}
+
+// ruleRewrite is the compiled rewrite of a rule.
+type ruleRewrite struct {
+	targetAddress     *rewriteTemplate // nil if not rewritten
+	minecraftHostname *rewriteTemplate
+}
+
+func newRuleRewrite(rewriteConfig *config.RuleRewrite) (ruleRewrite, error) {
+	var (
+		rewrite ruleRewrite
+		err     error
+	)
+	if rewriteConfig.TargetAddress != "" {
+		rewrite.targetAddress, err = compileTemplate(rewriteConfig.TargetAddress)
+		if err != nil {
+			return rewrite, fmt.Errorf("bad rewrite target address [%s]: %w", rewriteConfig.TargetAddress, err)
+		}
+	}
+	if rewriteConfig.Minecraft != nil && rewriteConfig.Minecraft.Hostname != "" {
+		rewrite.minecraftHostname, err = compileTemplate(rewriteConfig.Minecraft.Hostname)
+		if err != nil {
+			return rewrite, fmt.Errorf("bad rewrite Minecraft hostname [%s]: %w", rewriteConfig.Minecraft.Hostname, err)
+		}
+	}
+	return rewrite, nil
+}
+
+func compileTemplate(template string) (*rewriteTemplate, error) {
+	t := &rewriteTemplate{}
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			t.parts = append(t.parts, templatePart{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		var next byte
+		if i+1 < len(template) {
+			next = template[i+1]
+		}
+		switch {
+		case c == '$' && next == '$', c == '{' && next == '{', c == '}' && next == '}':
+			literal.WriteByte(c)
+			i++
+		case c == '$' && next >= '0' && next <= '9':
+			flush()
+			index := int(next - '0')
+			t.parts = append(t.parts, templatePart{variable: func(metadata *adapter.Metadata) string {
+				if index < len(metadata.Captures) {
+					return metadata.Captures[index]
+				}
+				return ""
+			}})
+			i++
+		case c == '{':
+			end := strings.IndexByte(template[i+1:], '}')
+			if end < 0 {
+				return nil, errors.New("unclosed variable: " + template[i:])
+			}
+			variable, err := templateVariable(template[i+1 : i+1+end])
+			if err != nil {
+				return nil, err
+			}
+			flush()
+			t.parts = append(t.parts, templatePart{variable: variable})
+			i += 1 + end
+		case c == '}':
+			return nil, errors.New("unexpected \"}\", use \"}}\" for a literal one")
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flush()
+	return t, nil
+}
+
+func templateVariable(name string) (func(metadata *adapter.Metadata) string, error) {
+	switch name {
+	case "source_ip":
+		return func(metadata *adapter.Metadata) string {
+			if !metadata.SourceAddress.IsValid() {
+				return ""
+			}
+			return metadata.SourceAddress.Addr().Unmap().String()
+		}, nil
+	case "source_port":
+		return func(metadata *adapter.Metadata) string {
+			if !metadata.SourceAddress.IsValid() {
+				return ""
+			}
+			return strconv.Itoa(int(metadata.SourceAddress.Port()))
+		}, nil
+	case "service":
+		return func(metadata *adapter.Metadata) string {
+			return metadata.ServiceName
+		}, nil
+	case "destination":
+		return func(metadata *adapter.Metadata) string {
+			return metadata.DestinationHostname
+		}, nil
+	case "sni":
+		return func(metadata *adapter.Metadata) string {
+			if metadata.TLS == nil {
+				return ""
+			}
+			return metadata.TLS.SNI
+		}, nil
+	case "minecraft.hostname":
+		return minecraftVariable(func(m *adapter.MinecraftMetadata) string {
+			return m.CleanOriginDestination()
+		}), nil
+	case "minecraft.port":
+		return minecraftVariable(func(m *adapter.MinecraftMetadata) string {
+			return strconv.Itoa(int(m.OriginPort))
+		}), nil
+	case "minecraft.player":
+		return minecraftVariable(func(m *adapter.MinecraftMetadata) string {
+			return m.PlayerName
+		}), nil
+	case "minecraft.protocol":
+		return minecraftVariable(func(m *adapter.MinecraftMetadata) string {
+			return strconv.FormatUint(uint64(m.ProtocolVersion), 10)
+		}), nil
+	}
+	if label, isLabel := strings.CutPrefix(name, "minecraft.hostname_label_"); isLabel {
+		index, err := strconv.Atoi(label)
+		if err != nil || index < 0 {
+			return nil, errors.New("bad hostname label index: " + label)
+		}
+		return minecraftVariable(func(m *adapter.MinecraftMetadata) string {
+			hostname := m.CleanOriginDestination()
+			for i := 0; i < index; i++ {
+				dot := strings.IndexByte(hostname, '.')
+				if dot < 0 {
+					return ""
+				}
+				hostname = hostname[dot+1:]
+			}
+			label, _, _ := strings.Cut(hostname, ".")
+			return label
+		}), nil
+	}
+	if key, isCustom := strings.CutPrefix(name, "custom."); isCustom && key != "" {
+		return func(metadata *adapter.Metadata) string {
+			value, _ := metadata.CustomString(key)
+			return value
+		}, nil
+	}
+	return nil, errors.New("unknown variable: {" + name + "}")
+}
+
+func minecraftVariable(getter func(m *adapter.MinecraftMetadata) string) func(metadata *adapter.Metadata) string {
+	return func(metadata *adapter.Metadata) string {
+		if metadata.Minecraft == nil {
+			return ""
+		}
+		return getter(metadata.Minecraft)
+	}
+}
+
+// Execute evaluates the template against metadata.
+func (t *rewriteTemplate) Execute(metadata *adapter.Metadata) string {
+	if len(t.parts) == 1 && t.parts[0].variable == nil {
+		return t.parts[0].literal
+	}
+	var builder strings.Builder
+	for _, part := range t.parts {
+		if part.variable == nil {
+			builder.WriteString(part.literal)
+		} else {
+			builder.WriteString(part.variable(metadata))
+		}
+	}
+	return builder.String()
+}
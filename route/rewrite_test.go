@@ -0,0 +1,85 @@
+package route
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+)
+
+func TestCompileTemplate(t *testing.T) {
+	metadata := &adapter.Metadata{
+		ServiceName:         "lobby",
+		SourceAddress:       netip.MustParseAddrPort("[::ffff:192.0.2.1]:54321"),
+		DestinationHostname: "backend.internal",
+		TLS:                 &adapter.TLSMetadata{SNI: "tls.example.net"},
+		Minecraft: &adapter.MinecraftMetadata{
+			OriginDestination: "eu.play.example.net\x00FML\x00",
+			OriginPort:        25565,
+			PlayerName:        "Steve",
+			ProtocolVersion:   767,
+		},
+		Captures: []string{"eu.play.example.net", "eu"},
+	}
+	metadata.SetCustom("region", "eu")
+	metadata.SetCustom("shard", 3)
+
+	for _, testCase := range []struct {
+		template string
+		expected string
+	}{
+		{"mc.example.net", "mc.example.net"},
+		{"", ""},
+		{"$$1 {{x}} $ a", "$1 {x} $ a"},
+		{"$1.backend.internal", "eu.backend.internal"},
+		{"$0:$2", "eu.play.example.net:"}, // groups not captured are empty
+		{"{source_ip}:{source_port}", "192.0.2.1:54321"},
+		{"{service}/{destination}/{sni}", "lobby/backend.internal/tls.example.net"},
+		{"{minecraft.hostname}", "eu.play.example.net"},
+		{"{minecraft.port} {minecraft.player} {minecraft.protocol}", "25565 Steve 767"},
+		{"{minecraft.hostname_label_0}-{minecraft.hostname_label_2}", "eu-example"},
+		{"[{minecraft.hostname_label_4}]", "[]"},
+		{"{custom.region}-{custom.shard}-{custom.missing}", "eu-3-"},
+	} {
+		template, err := compileTemplate(testCase.template)
+		if err != nil {
+			t.Errorf("compile %q: %v", testCase.template, err)
+			continue
+		}
+		if actual := template.Execute(metadata); actual != testCase.expected {
+			t.Errorf("execute %q: got %q, want %q", testCase.template, actual, testCase.expected)
+		}
+	}
+
+	// variables are empty without the metadata they need
+	template, err := compileTemplate("{source_ip}{sni}{minecraft.player}{minecraft.hostname_label_0}$1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := template.Execute(&adapter.Metadata{}); actual != "" {
+		t.Errorf("got %q with empty metadata, want empty", actual)
+	}
+}
+
+func TestCompileTemplateErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		template string
+		err      string
+	}{
+		{"{unknown}", "unknown variable: {unknown}"},
+		{"{custom.}", "unknown variable: {custom.}"},
+		{"{}", "unknown variable: {}"},
+		{"{minecraft.hostname_label_x}", "bad hostname label index: x"},
+		{"{minecraft.hostname_label_-1}", "bad hostname label index: -1"},
+		{"a.{minecraft.hostname", "unclosed variable: {minecraft.hostname"},
+		{"a{", "unclosed variable: {"},
+		{"a}b", "unexpected \"}\", use \"}}\" for a literal one"},
+	} {
+		_, err := compileTemplate(testCase.template)
+		if err == nil {
+			t.Errorf("compile %q: no error, want %q", testCase.template, testCase.err)
+		} else if err.Error() != testCase.err {
+			t.Errorf("compile %q: got error %q, want %q", testCase.template, err, testCase.err)
+		}
+	}
+}
@@ -7,23 +7,29 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common"
 	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/metrics"
 	"github.com/layou233/zbproxy/v3/common/set"
 	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/geoip"
 	"github.com/layou233/zbproxy/v3/protocol"
 
 	"github.com/phuslu/log"
 )
 
+var errNoDestination = errors.New("no destination to dial")
+
 type RouterOptions struct {
 	Config          *config.Router
 	OutboundMap     map[string]adapter.Outbound
 	ListMap         map[string]set.StringSet
 	RuleRegistry    map[string]CustomRuleInitializer
 	SnifferRegistry map[string]protocol.SnifferFunc
+	GeoIP           *geoip.Databases
 }
 
 type Router struct {
@@ -34,8 +40,7 @@ type Router struct {
 	listMap         map[string]set.StringSet
 	ruleRegistry    map[string]CustomRuleInitializer
 	snifferRegistry map[string]protocol.SnifferFunc
-	rules           []Rule
-	defaultOutbound adapter.Outbound
+	root            *RuleSet // the rules of the router, with the default outbound
 	started         bool
 }
 
@@ -51,25 +56,25 @@ func (r *Router) Initialize(ctx context.Context, logger *log.Logger, options Rou
 	r.listMap = options.ListMap
 	r.ruleRegistry = options.RuleRegistry
 	r.snifferRegistry = options.SnifferRegistry
-	r.rules = make([]Rule, 0, len(options.Config.Rules))
-	for i, ruleConfig := range options.Config.Rules {
-		rule, err := NewRule(logger, ruleConfig, r.listMap, r.ruleRegistry)
-		if err != nil {
-			return fmt.Errorf("initialize rule [index=%d]: %w", i, err)
-		}
-		r.rules = append(r.rules, rule)
+	ruleSets, err := r.newRuleSets(options.Config.RuleSets, options.GeoIP)
+	if err != nil {
+		return err
+	}
+	r.root = &RuleSet{}
+	err = r.initializeRuleSet(r.root, options.Config.Rules, ruleSets, options.GeoIP)
+	if err != nil {
+		return err
 	}
 	if options.Config.DefaultOutbound != "" {
-		var err error
-		r.defaultOutbound, err = r.FindOutboundByName(options.Config.DefaultOutbound)
+		r.root.defaultOutbound, err = r.FindOutboundByName(options.Config.DefaultOutbound)
 		if err != nil {
 			return common.Cause("default outbound is not found: ", err)
 		}
 	} else {
-		r.defaultOutbound, _ = protocol.NewOutbound(r.logger, &config.Outbound{
+		r.root.defaultOutbound, _ = protocol.NewOutbound(r.logger, &config.Outbound{
 			Name: "default",
 		})
-		r.defaultOutbound.PostInitialize(r)
+		r.root.defaultOutbound.PostInitialize(r)
 	}
 	r.started = true
 	return nil
@@ -78,62 +83,19 @@ func (r *Router) Initialize(ctx context.Context, logger *log.Logger, options Rou
 func (r *Router) HandleConnection(conn net.Conn, metadata *adapter.Metadata) {
 	r.access.RLock()
 	cachedConn := bufio.NewCachedConn(conn)
-	outbound := r.defaultOutbound
-	for i, rule := range r.rules {
-		match := rule.Match(metadata)
-		if match {
-			r.logger.Trace().
-				Str("proxyConnectionID", metadata.ConnectionID).
-				Int("rule_index", i).
-				Msg("Rule matched")
-			ruleConfig := rule.Config()
-			// handle sniff
-			if len(ruleConfig.Sniff) > 0 {
-				protocol.Sniff(r.logger, cachedConn, metadata, r.snifferRegistry, ruleConfig.Sniff...)
-			}
-			// handle rewrite
-			if ruleConfig.Rewrite.TargetAddress != "" {
-				metadata.DestinationHostname = ruleConfig.Rewrite.TargetAddress
-			}
-			if ruleConfig.Rewrite.TargetPort > 0 {
-				metadata.DestinationPort = ruleConfig.Rewrite.TargetPort
-			}
-			if ruleConfig.Rewrite.Minecraft != nil {
-				if metadata.Minecraft == nil {
-					r.logger.Debug().
-						Str("proxyConnectionID", metadata.ConnectionID).
-						Int("rule_index", i).
-						Msg("No Minecraft metadata, skipped rewrite")
-				} else {
-					if ruleConfig.Rewrite.Minecraft.Hostname != "" {
-						metadata.Minecraft.RewrittenDestination = ruleConfig.Rewrite.Minecraft.Hostname
-					}
-					if ruleConfig.Rewrite.Minecraft.Port > 0 {
-						metadata.Minecraft.RewrittenPort = ruleConfig.Rewrite.Minecraft.Port
-					}
-				}
-			}
-			// handle outbound
-			if ruleConfig.Outbound != "" {
-				var err error
-				outbound, err = r.FindOutboundByName(ruleConfig.Outbound)
-				if err != nil {
-					r.logger.Error().
-						Str("proxyConnectionID", metadata.ConnectionID).
-						Int("rule_index", i).
-						Err(err).Msg("Failed to find outbound")
-					conn.Close()
-					r.access.RUnlock()
-					return
-				}
-				break
-			}
-		}
+	outbound, err := r.route(r.root, cachedConn, metadata)
+	if err != nil {
+		metadata.Stats.CloseReason = err
+		conn.Close()
+		r.access.RUnlock()
+		return
 	}
 
+	metadata.Stats.Outbound = outbound.Name()
 	if injectOutbound, isInject := outbound.(adapter.InjectOutbound); isInject {
 		r.access.RUnlock()
 		err := injectOutbound.InjectConnection(r.ctx, cachedConn, metadata)
+		metadata.Stats.CloseReason = err
 		var logger *log.Entry
 		if err == nil {
 			logger = r.logger.Info()
@@ -151,8 +113,10 @@ func (r *Router) HandleConnection(conn net.Conn, metadata *adapter.Metadata) {
 		cachedConn.Close()
 		return
 	} else if metadata.DestinationHostname != "" && metadata.DestinationPort > 0 {
+		dialStartTime := time.Now()
 		destinationConn, err := outbound.DialContext(r.ctx, "tcp",
 			net.JoinHostPort(metadata.DestinationHostname, strconv.FormatUint(uint64(metadata.DestinationPort), 10)))
+		metrics.ObserveDial(outbound.Name(), dialStartTime, err)
 		if err != nil {
 			r.logger.Warn().
 				Str("proxyConnectionID", metadata.ConnectionID).
@@ -160,9 +124,16 @@ func (r *Router) HandleConnection(conn net.Conn, metadata *adapter.Metadata) {
 				Str("dest", metadata.DestinationHostname).
 				Err(err).
 				Msg("Failed to dial outbound connection")
+			metadata.Stats.CloseReason = err
+			cachedConn.Close()
+			r.access.RUnlock()
+			return
 		}
 		r.access.RUnlock()
-		err = bufio.CopyConn(destinationConn, cachedConn)
+		upload, download, err := bufio.CopyConnCounted(destinationConn, cachedConn)
+		metrics.AddTraffic(outbound.Name(), upload, download)
+		metadata.Stats.AddTraffic(upload, download)
+		metadata.Stats.CloseReason = err
 		var logger *log.Entry
 		if err == nil {
 			logger = r.logger.Info()
@@ -183,10 +154,105 @@ func (r *Router) HandleConnection(conn net.Conn, metadata *adapter.Metadata) {
 	r.logger.Info().
 		Str("proxyConnectionID", metadata.ConnectionID).
 		Msg("Closed leaked connection")
+	metadata.Stats.CloseReason = errNoDestination
 	cachedConn.Close()
 	r.access.RUnlock()
 }
 
+// route evaluates the rules in ruleSet, and returns the outbound decided by them,
+// or the default outbound of ruleSet, which is nil for the sets returning to the jumping rule.
+func (r *Router) route(ruleSet *RuleSet, cachedConn *bufio.CachedConn, metadata *adapter.Metadata) (adapter.Outbound, error) {
+	for i, rule := range ruleSet.rules {
+		metadata.Captures = nil
+		if !rule.Match(metadata) {
+			continue
+		}
+		ruleLabel := strconv.Itoa(i)
+		if ruleSet.name != "" {
+			ruleLabel = ruleSet.name + "/" + ruleLabel
+		}
+		r.logger.Trace().
+			Str("proxyConnectionID", metadata.ConnectionID).
+			Str("rule_index", ruleLabel).
+			Msg("Rule matched")
+		metrics.RuleMatches.WithLabelValues(ruleLabel).Inc()
+		ruleConfig := rule.Config()
+		// handle sniff
+		if len(ruleConfig.Sniff) > 0 {
+			protocol.Sniff(r.logger, cachedConn, metadata, r.snifferRegistry, ruleConfig.Sniff...)
+		}
+		action := &ruleSet.actions[i]
+		// handle rewrite
+		rewrite := action.rewrite
+		if rewrite.targetAddress != nil {
+			metadata.DestinationHostname = rewrite.targetAddress.Execute(metadata)
+		}
+		if ruleConfig.Rewrite.TargetPort > 0 {
+			metadata.DestinationPort = ruleConfig.Rewrite.TargetPort
+		}
+		if ruleConfig.Rewrite.Minecraft != nil {
+			if metadata.Minecraft == nil {
+				r.logger.Debug().
+					Str("proxyConnectionID", metadata.ConnectionID).
+					Str("rule_index", ruleLabel).
+					Msg("No Minecraft metadata, skipped rewrite")
+			} else {
+				if rewrite.minecraftHostname != nil {
+					metadata.Minecraft.RewrittenDestination = rewrite.minecraftHostname.Execute(metadata)
+				}
+				if ruleConfig.Rewrite.Minecraft.Port > 0 {
+					metadata.Minecraft.RewrittenPort = ruleConfig.Rewrite.Minecraft.Port
+				}
+			}
+		}
+		// handle set-metadata
+		for key, value := range action.metadata {
+			metadata.SetCustom(key, value.Execute(metadata))
+		}
+		// handle return and reject
+		switch action.action {
+		case config.RuleActionReturn:
+			if ruleSet != r.root {
+				return nil, nil
+			}
+			metadata.Stats.RuleIndex = i
+			return ruleSet.defaultOutbound, nil
+		case config.RuleActionRejectWithMessage:
+			if ruleSet == r.root {
+				metadata.Stats.RuleIndex = i
+			}
+			return action.reject, nil
+		}
+		// handle jump
+		if jump := action.jump; jump != nil {
+			outbound, err := r.route(jump, cachedConn, metadata)
+			if err != nil || outbound != nil {
+				if ruleSet == r.root {
+					metadata.Stats.RuleIndex = i
+				}
+				return outbound, err
+			}
+			continue
+		}
+		// handle outbound
+		if ruleConfig.Outbound != "" {
+			outbound, err := r.FindOutboundByName(ruleConfig.Outbound)
+			if err != nil {
+				r.logger.Error().
+					Str("proxyConnectionID", metadata.ConnectionID).
+					Str("rule_index", ruleLabel).
+					Err(err).Msg("Failed to find outbound")
+				return nil, err
+			}
+			if ruleSet == r.root {
+				metadata.Stats.RuleIndex = i
+			}
+			return outbound, nil
+		}
+	}
+	return ruleSet.defaultOutbound, nil
+}
+
 func (r *Router) FindOutboundByName(name string) (adapter.Outbound, error) {
 	switch name {
 	case "REJECT":
@@ -219,9 +285,40 @@ func (r *Router) FindListsByTag(tags []string) ([]set.StringSet, error) {
 	return lists, nil
 }
 
-func (r *Router) UpdateConfig(newOptions RouterOptions) error {
+// Prepare creates a new router with the options, without affecting r.
+// The new router can be used by outbounds and services for validating,
+// then pass it to Commit to apply.
+func (r *Router) Prepare(newOptions RouterOptions) (*Router, error) {
+	if newOptions.RuleRegistry == nil {
+		r.access.RLock()
+		newOptions.RuleRegistry = r.ruleRegistry
+		r.access.RUnlock()
+	}
+	staged := &Router{}
+	err := staged.Initialize(r.ctx, r.logger, newOptions)
+	if err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// Commit replaces the rules, outbounds and lists of r with the prepared router.
+func (r *Router) Commit(staged *Router) {
 	r.access.Lock()
 	defer r.access.Unlock()
-	r.started = false
-	return r.Initialize(r.ctx, r.logger, newOptions)
+	r.outboundMap = staged.outboundMap
+	r.listMap = staged.listMap
+	r.ruleRegistry = staged.ruleRegistry
+	r.snifferRegistry = staged.snifferRegistry
+	r.root = staged.root
+}
+
+// UpdateConfig applies the options to r, r is not changed if it fails.
+func (r *Router) UpdateConfig(newOptions RouterOptions) error {
+	staged, err := r.Prepare(newOptions)
+	if err != nil {
+		return err
+	}
+	r.Commit(staged)
+	return nil
 }
@@ -0,0 +1,228 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/protocol"
+
+	"github.com/phuslu/log"
+)
+
+var testLogger = &log.Logger{Writer: &log.IOWriter{Writer: io.Discard}}
+
+// newTestRouter creates a router with the outbounds "a" to "d" from routerConfig in JSON.
+func newTestRouter(t *testing.T, routerConfig string, snifferRegistry map[string]protocol.SnifferFunc) (*Router, error) {
+	t.Helper()
+	var newConfig config.Router
+	err := json.Unmarshal([]byte(routerConfig), &newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outboundMap := make(map[string]adapter.Outbound)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		outboundMap[name], err = protocol.NewOutbound(testLogger, &config.Outbound{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := &Router{}
+	err = router.Initialize(context.Background(), testLogger, RouterOptions{
+		Config:          &newConfig,
+		OutboundMap:     outboundMap,
+		SnifferRegistry: snifferRegistry,
+	})
+	return router, err
+}
+
+// routeTest routes a connection from the service, and returns the outbound.
+func routeTest(t *testing.T, router *Router, metadata *adapter.Metadata) adapter.Outbound {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	outbound, err := router.route(router.root, bufio.NewCachedConn(server), metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbound == nil {
+		t.Fatal("no outbound is decided")
+	}
+	return outbound
+}
+
+func TestRouterJump(t *testing.T) {
+	router, err := newTestRouter(t, `{
+		"Rules": [
+			{"Type": "ServiceName", "Parameter": "jump", "Jump": "returning"},
+			{"Type": "ServiceName", "Parameter": ["jump", "routed"], "Jump": "routing"},
+			{"Type": "ServiceName", "Parameter": "default", "Jump": "default"},
+			{"Type": "ServiceName", "Parameter": "return", "Action": "return"},
+			{"Type": "always", "Outbound": "d"}
+		],
+		"RuleSets": {
+			"returning": {"Rules": [
+				{"Type": "always", "Action": "set-metadata", "Metadata": {"visited": "yes"}}
+			]},
+			"routing": {"Rules": [
+				{"Type": "ServiceName", "Parameter": "jump", "Jump": "nested"},
+				{"Type": "always", "Outbound": "b"}
+			]},
+			"nested": {"Rules": [
+				{"Type": "always", "Action": "return"},
+				{"Type": "always", "Outbound": "c"}
+			]},
+			"default": {"Rules": [
+				{"Type": "ServiceName", "Parameter": "none", "Outbound": "c"}
+			], "DefaultOutbound": "a"}
+		},
+		"DefaultOutbound": "c"
+	}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// returns from "returning" and "nested" without an outbound, then routed by "routing"
+	metadata := &adapter.Metadata{ServiceName: "jump"}
+	if outbound := routeTest(t, router, metadata).Name(); outbound != "b" {
+		t.Errorf("got outbound %s, want b", outbound)
+	}
+	if visited, _ := metadata.CustomString("visited"); visited != "yes" {
+		t.Error("rules in the returning set are not evaluated")
+	}
+	if metadata.Stats.RuleIndex != 1 {
+		t.Errorf("got rule index %d, want 1 of the jumping rule", metadata.Stats.RuleIndex)
+	}
+
+	// the set without a matched rule uses its default outbound
+	metadata = &adapter.Metadata{ServiceName: "default"}
+	if outbound := routeTest(t, router, metadata).Name(); outbound != "a" {
+		t.Errorf("got outbound %s, want default outbound a of the set", outbound)
+	}
+	if metadata.Stats.RuleIndex != 2 {
+		t.Errorf("got rule index %d, want 2", metadata.Stats.RuleIndex)
+	}
+
+	// return in the root uses the default outbound of the router
+	metadata = &adapter.Metadata{ServiceName: "return"}
+	if outbound := routeTest(t, router, metadata).Name(); outbound != "c" {
+		t.Errorf("got outbound %s, want default outbound c", outbound)
+	}
+
+	metadata = &adapter.Metadata{ServiceName: "other"}
+	if outbound := routeTest(t, router, metadata).Name(); outbound != "d" {
+		t.Errorf("got outbound %s, want d", outbound)
+	}
+}
+
+func TestRuleSetRule(t *testing.T) {
+	router, err := newTestRouter(t, `{
+		"Rules": [
+			{"Type": "RuleSet", "Parameter": ["empty", "lobby"], "Outbound": "a"},
+			{"Type": "RuleSet", "Parameter": "lobby", "Invert": true, "Outbound": "b"}
+		],
+		"RuleSets": {
+			"empty": {"Rules": []},
+			"lobby": {"Rules": [
+				{"Type": "ServiceName", "Parameter": "lobby", "Outbound": "c"},
+				{"Type": "ServiceName", "Parameter": "hub", "Action": "return"}
+			]}
+		},
+		"DefaultOutbound": "d"
+	}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the matching of the rules is used, not their actions
+	for serviceName, expected := range map[string]string{
+		"lobby": "a",
+		"hub":   "a",
+		"other": "b",
+	} {
+		if outbound := routeTest(t, router, &adapter.Metadata{ServiceName: serviceName}).Name(); outbound != expected {
+			t.Errorf("%s: got outbound %s, want %s", serviceName, outbound, expected)
+		}
+	}
+}
+
+func TestRuleSetErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		config string
+		err    string
+	}{
+		{
+			`{"Rules": [{"Type": "always", "Jump": "missing"}]}`,
+			"rule set [missing] is not found",
+		},
+		{
+			`{"Rules": [{"Type": "RuleSet", "Parameter": "missing"}]}`,
+			"rule set [missing] is not found",
+		},
+		{
+			`{"Rules": [{"Type": "always", "Jump": "a", "Outbound": "a"}], "RuleSets": {"a": {"Rules": []}}}`,
+			"Jump and Outbound can not be used together",
+		},
+		{
+			`{"RuleSets": {"a": {"Rules": []}, "b": null}}`,
+			"rule set [b] is empty",
+		},
+		{
+			`{"RuleSets": {"a": {"Rules": [], "DefaultOutbound": "missing"}}}`,
+			"default outbound of rule set [a] is not found",
+		},
+		{
+			`{"RuleSets": {"a": {"Rules": [{"Type": "always", "Jump": "a"}]}}}`,
+			"rule set [a] references itself: a -> a",
+		},
+	} {
+		_, err := newTestRouter(t, testCase.config, nil)
+		if err == nil {
+			t.Errorf("%s: no error, want %q", testCase.config, testCase.err)
+		} else if !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("%s: got error %q, want %q", testCase.config, err, testCase.err)
+		}
+	}
+}
+
+func TestCheckRuleSetCycles(t *testing.T) {
+	for _, testCase := range []struct {
+		ruleSets string
+		cycle    bool
+	}{
+		{`{"a": {"Rules": [{"Type": "always", "Jump": "b"}]}, "b": {"Rules": []}}`, false},
+		// diamond references are not cycles
+		{`{
+			"a": {"Rules": [{"Type": "RuleSet", "Parameter": ["b", "c"]}]},
+			"b": {"Rules": [{"Type": "always", "Jump": "c"}]},
+			"c": {"Rules": []}
+		}`, false},
+		{`{"a": {"Rules": [{"Type": "always", "Jump": "missing"}]}}`, false}, // reported when initializing
+		{`{"a": {"Rules": [{"Type": "RuleSet", "Parameter": "a"}]}}`, true},
+		{`{
+			"a": {"Rules": [{"Type": "always", "Jump": "b"}]},
+			"b": {"Rules": [{"Type": "RuleSet", "Parameter": "c"}]},
+			"c": {"Rules": [{"Type": "always", "Jump": "a"}]}
+		}`, true},
+		{`{
+			"a": {"Rules": [{"Type": "and", "Parameter": [{"Type": "always"}, {"Type": "or", "Parameter": [{"Type": "RuleSet", "Parameter": "b"}]}]}]},
+			"b": {"Rules": [{"Type": "always", "Jump": "a"}]}
+		}`, true},
+	} {
+		var configs map[string]*config.RuleSet
+		err := json.Unmarshal([]byte(testCase.ruleSets), &configs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkRuleSetCycles(configs)
+		if (err != nil) != testCase.cycle {
+			t.Errorf("%s: got error %v, want cycle %v", testCase.ruleSets, err, testCase.cycle)
+		}
+	}
+}
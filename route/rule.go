@@ -7,8 +7,10 @@ import (
 
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
 	"github.com/layou233/zbproxy/v3/common/set"
 	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/geoip"
 
 	"github.com/phuslu/log"
 )
@@ -25,36 +27,105 @@ type Rule interface {
 	Match(metadata *adapter.Metadata) bool
 }
 
-func NewRule(logger *log.Logger, config *config.Rule, listMap map[string]set.StringSet, ruleRegistry map[string]CustomRuleInitializer) (Rule, error) {
-	switch config.Type {
-	case "always":
-		return &RuleAlways{config}, nil
-	case "and":
-		return NewLogicalAndRule(logger, config, listMap, ruleRegistry)
-	case "or":
-		return NewLogicalOrRule(logger, config, listMap, ruleRegistry)
-	case "ServiceName":
-		return NewServiceNameRule(config, listMap)
-	case "SourceIPVersion":
-		return NewSourceIPVersionRule(config)
-	case "SourceIP":
-		return NewSourceIPRule(config, listMap)
-	case "SourcePort":
-		return NewSourcePortRule(config)
-	case "MinecraftHostname":
-		return NewMinecraftHostnameRule(config, listMap)
-	case "MinecraftPlayerName":
-		return NewMinecraftPlayerNameRule(config, listMap)
-	case "MinecraftStatus":
-		return NewMinecraftStatusRule(config)
+// RuleOptions are what rules are created with.
+type RuleOptions struct {
+	Logger       *log.Logger
+	ListMap      map[string]set.StringSet
+	RuleRegistry map[string]CustomRuleInitializer
+	GeoIP        *geoip.Databases
+	RuleSets     map[string]*RuleSet // the named rule sets, which may not be initialized yet
+}
+
+// builtinRule is a built-in rule type.
+type builtinRule struct {
+	parameter  any // the type Parameter is decoded into, nil if the rule has no parameter
+	initialize func(config *config.Rule, options RuleOptions) (Rule, error)
+}
+
+// builtinRules are the built-in rule types, which are also registered to config
+// for strict decoding and the schema.
+var builtinRules map[string]builtinRule
+
+func init() {
+	builtinRules = map[string]builtinRule{
+		"always": {nil, func(config *config.Rule, _ RuleOptions) (Rule, error) {
+			return &RuleAlways{config}, nil
+		}},
+		"and": {[]config.Rule{}, NewLogicalAndRule},
+		"or":  {[]config.Rule{}, NewLogicalOrRule},
+		"ServiceName": {jsonx.Listable[string]{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewServiceNameRule(config, options.ListMap)
+		}},
+		"SourceIPVersion": {uint8(0), func(config *config.Rule, _ RuleOptions) (Rule, error) {
+			return NewSourceIPVersionRule(config)
+		}},
+		"SourceIP": {jsonx.Listable[string]{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewSourceIPRule(config, options.ListMap)
+		}},
+		"SourceGeoIP": {jsonx.Listable[string]{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewSourceGeoIPRule(config, options.ListMap, options.GeoIP)
+		}},
+		"SourceASN": {jsonx.Listable[string]{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewSourceASNRule(config, options.ListMap, options.GeoIP)
+		}},
+		"SourcePort": {[]uint16{}, func(config *config.Rule, _ RuleOptions) (Rule, error) {
+			return NewSourcePortRule(config)
+		}},
+		"Time": {jsonx.Listable[string]{}, func(config *config.Rule, _ RuleOptions) (Rule, error) {
+			return NewTimeRule(config)
+		}},
+		"RuleSet": {jsonx.Listable[string]{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewRuleSetRule(config, options.RuleSets)
+		}},
+		"MinecraftHostname": {config.RuleDomain{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewMinecraftHostnameRule(config, options.ListMap)
+		}},
+		"MinecraftPlayerName": {jsonx.Listable[string]{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewMinecraftPlayerNameRule(config, options.ListMap)
+		}},
+		"MinecraftStatus": {nil, func(config *config.Rule, _ RuleOptions) (Rule, error) {
+			return NewMinecraftStatusRule(config)
+		}},
+		"Tag": {map[string]jsonx.Listable[string]{}, func(config *config.Rule, options RuleOptions) (Rule, error) {
+			return NewTagRule(config, options.ListMap)
+		}},
+	}
+	for name, rule := range builtinRules {
+		config.RegisterRuleType(name, rule.parameter)
 	}
-	if len(ruleRegistry) > 0 && strings.HasPrefix(config.Type, typeCustomPrefix) {
+}
+
+func NewRule(config *config.Rule, options RuleOptions) (Rule, error) {
+	if rule, found := builtinRules[config.Type]; found {
+		return rule.initialize(config, options)
+	}
+	if len(options.RuleRegistry) > 0 && strings.HasPrefix(config.Type, typeCustomPrefix) {
 		typeName := strings.TrimPrefix(config.Type, typeCustomPrefix)
-		ruleInitializer, found := ruleRegistry[typeName]
+		ruleInitializer, found := options.RuleRegistry[typeName]
 		if !found {
 			return nil, fmt.Errorf("unknown custom rule type: %s", typeName)
 		}
-		return ruleInitializer(logger, config, listMap)
+		return ruleInitializer(options.Logger, config, options.ListMap)
 	}
 	return nil, common.Cause("type ["+config.Type+"]: ", ErrRuleTypeNotFound)
 }
+
+// expandListEntries returns the entries with "list:" references expanded.
+func expandListEntries(parameter []string, listMap map[string]set.StringSet) ([]string, error) {
+	entries := make([]string, 0, len(parameter))
+	for _, i := range parameter {
+		if strings.HasPrefix(i, parameterListPrefix) {
+			i = strings.TrimPrefix(i, parameterListPrefix)
+			list, found := listMap[i]
+			if !found {
+				return nil, fmt.Errorf("list [%s] is not found", i)
+			}
+			for k := range list {
+				entries = append(entries, k)
+			}
+		} else {
+			entries = append(entries, i)
+		}
+	}
+	return entries, nil
+}
@@ -2,7 +2,7 @@ package route
 
 import (
 	"encoding/json"
-	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/layou233/zbproxy/v3/adapter"
@@ -13,8 +13,10 @@ import (
 )
 
 type ruleDomain struct {
-	matcher *domain.Matcher
-	config  *config.Rule
+	matcher  *domain.Matcher // nil if no domain or domain suffix
+	keywords []string
+	patterns []*regexp.Regexp // compiled from both regular expressions and globs
+	config   *config.Rule
 }
 
 func (r *ruleDomain) Config() *config.Rule {
@@ -27,39 +29,75 @@ func newDomainRule(newConfig *config.Rule, listMap map[string]set.StringSet) (ru
 	if err != nil {
 		return ruleDomain{}, common.Cause("bad domain rule parameter: ", err)
 	}
-	builder := domain.NewMatcherBuilder(len(domainConfig.Domain) + 2*len(domainConfig.DomainSuffix))
-	for _, i := range domainConfig.Domain {
-		if strings.HasPrefix(i, parameterListPrefix) {
-			i = strings.TrimPrefix(i, parameterListPrefix)
-			list, found := listMap[i]
-			if !found {
-				return ruleDomain{}, fmt.Errorf("list [%s] is not found", i)
-			}
-			for k := range list {
-				builder.AddDomain(k)
-			}
-		} else {
+	domains, err := expandListEntries(domainConfig.Domain, listMap)
+	if err != nil {
+		return ruleDomain{}, err
+	}
+	domainSuffixes, err := expandListEntries(domainConfig.DomainSuffix, listMap)
+	if err != nil {
+		return ruleDomain{}, err
+	}
+	rule := ruleDomain{config: newConfig}
+	if len(domains) > 0 || len(domainSuffixes) > 0 { // the matcher can not be built empty
+		builder := domain.NewMatcherBuilder(len(domains) + 2*len(domainSuffixes))
+		for _, i := range domains {
 			builder.AddDomain(i)
 		}
-	}
-	for _, i := range domainConfig.DomainSuffix {
-		if strings.HasPrefix(i, parameterListPrefix) {
-			i = strings.TrimPrefix(i, parameterListPrefix)
-			list, found := listMap[i]
-			if !found {
-				return ruleDomain{}, fmt.Errorf("list [%s] is not found", i)
-			}
-			for k := range list {
-				builder.AddDomainSuffix(k)
-			}
-		} else {
+		for _, i := range domainSuffixes {
 			builder.AddDomainSuffix(i)
 		}
+		rule.matcher = builder.Build()
+	}
+
+	rule.keywords, err = expandListEntries(domainConfig.DomainKeyword, listMap)
+	if err != nil {
+		return ruleDomain{}, err
+	}
+	regexes, err := expandListEntries(domainConfig.DomainRegex, listMap)
+	if err != nil {
+		return ruleDomain{}, err
+	}
+	globs, err := expandListEntries(domainConfig.DomainGlob, listMap)
+	if err != nil {
+		return ruleDomain{}, err
+	}
+	rule.patterns = make([]*regexp.Regexp, 0, len(regexes)+len(globs))
+	for _, i := range regexes {
+		pattern, err := regexp.Compile(i)
+		if err != nil {
+			return ruleDomain{}, common.Cause("bad domain regex ["+i+"]: ", err)
+		}
+		rule.patterns = append(rule.patterns, pattern)
+	}
+	for _, i := range globs {
+		pattern, err := domain.CompileGlob(i)
+		if err != nil {
+			return ruleDomain{}, common.Cause("bad domain glob ["+i+"]: ", err)
+		}
+		rule.patterns = append(rule.patterns, pattern)
+	}
+	return rule, nil
+}
+
+// match returns the captured groups, or nil if hostname is not matched.
+// Domain and DomainSuffix match the hostname as sent, the others match it
+// with the Forge suffix removed, which is also the whole match in the captures.
+func (r *ruleDomain) match(hostname string, cleanHostname string) []string {
+	if r.matcher != nil && r.matcher.Match(hostname) {
+		return []string{cleanHostname}
+	}
+	hostname = cleanHostname
+	for _, keyword := range r.keywords {
+		if strings.Contains(hostname, keyword) {
+			return []string{hostname}
+		}
 	}
-	return ruleDomain{
-		matcher: builder.Build(),
-		config:  newConfig,
-	}, nil
+	for _, pattern := range r.patterns {
+		if captures := pattern.FindStringSubmatch(hostname); captures != nil {
+			return captures
+		}
+	}
+	return nil
 }
 
 type RuleMinecraftHostname struct {
@@ -78,7 +116,11 @@ var _ Rule = (*RuleMinecraftHostname)(nil)
 
 func (r *RuleMinecraftHostname) Match(metadata *adapter.Metadata) (match bool) {
 	if metadata.Minecraft != nil {
-		match = r.matcher.Match(metadata.Minecraft.OriginDestination)
+		captures := r.match(metadata.Minecraft.OriginDestination, metadata.Minecraft.CleanOriginDestination())
+		match = captures != nil
+		if match && !r.config.Invert {
+			metadata.Captures = captures
+		}
 	}
 	if r.config.Invert {
 		match = !match
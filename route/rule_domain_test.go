@@ -0,0 +1,49 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+func TestMinecraftHostnameRule(t *testing.T) {
+	const forgeHostname = "play.example.net\x00FML\x00"
+	for _, testCase := range []struct {
+		parameter string
+		hostname  string
+		captures  []string // nil if not matched
+	}{
+		{`{"Domain": "play.example.net"}`, "play.example.net", []string{"play.example.net"}},
+		{`{"Domain": "play.example.net"}`, forgeHostname, nil}, // matched as sent
+		{`{"DomainSuffix": "example.net"}`, "play.example.net", []string{"play.example.net"}},
+		{`{"DomainSuffix": "example.net"}`, "example.net", []string{"example.net"}},
+		{`{"DomainSuffix": "example.net"}`, "badexample.net", nil},
+		{`{"DomainKeyword": "example"}`, forgeHostname, []string{"play.example.net"}},
+		{`{"DomainRegex": "^(\\w+)\\.example\\.net$"}`, forgeHostname, []string{"play.example.net", "play"}},
+		{`{"DomainGlob": "*.example.net"}`, "eu.play.example.net", nil},
+		{`{"DomainGlob": "*.example.net"}`, forgeHostname, []string{"play.example.net", "play"}},
+	} {
+		ruleConfig := &config.Rule{Type: "MinecraftHostname", Parameter: []byte(testCase.parameter)}
+		rule, err := NewMinecraftHostnameRule(ruleConfig, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.parameter, err)
+		}
+		metadata := &adapter.Metadata{Minecraft: &adapter.MinecraftMetadata{OriginDestination: testCase.hostname}}
+		match := rule.Match(metadata)
+		if match != (testCase.captures != nil) {
+			t.Errorf("%s on %q: got match %v", testCase.parameter, testCase.hostname, match)
+			continue
+		}
+		if len(metadata.Captures) != len(testCase.captures) {
+			t.Errorf("%s on %q: got captures %q, want %q", testCase.parameter, testCase.hostname, metadata.Captures, testCase.captures)
+			continue
+		}
+		for i := range testCase.captures {
+			if metadata.Captures[i] != testCase.captures[i] {
+				t.Errorf("%s on %q: got captures %q, want %q", testCase.parameter, testCase.hostname, metadata.Captures, testCase.captures)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/access"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/geoip"
+)
+
+// readRuleEntries reads the string list parameter, with the entries of "list:" references expanded.
+func readRuleEntries(newConfig *config.Rule, listMap map[string]set.StringSet) ([]string, error) {
+	var parameter jsonx.Listable[string]
+	err := json.Unmarshal(newConfig.Parameter, &parameter)
+	if err != nil {
+		return nil, err
+	}
+	return expandListEntries(parameter, listMap)
+}
+
+type RuleSourceGeoIP struct {
+	database  *geoip.Database
+	countries set.StringSet
+	config    *config.Rule
+}
+
+var _ Rule = (*RuleSourceGeoIP)(nil)
+
+func NewSourceGeoIPRule(newConfig *config.Rule, listMap map[string]set.StringSet, databases *geoip.Databases) (*RuleSourceGeoIP, error) {
+	if databases == nil || databases.Country == nil {
+		return nil, errors.New("GeoIP country database is not configured")
+	}
+	entries, err := readRuleEntries(newConfig, listMap)
+	if err != nil {
+		return nil, fmt.Errorf("bad country code list [%v]: %w", newConfig.Parameter, err)
+	}
+	countries := make(set.StringSet, len(entries))
+	for _, country := range entries {
+		countries.Add(strings.ToUpper(country))
+	}
+	return &RuleSourceGeoIP{
+		database:  databases.Country,
+		countries: countries,
+		config:    newConfig,
+	}, nil
+}
+
+func (r *RuleSourceGeoIP) Config() *config.Rule {
+	return r.config
+}
+
+func (r *RuleSourceGeoIP) Match(metadata *adapter.Metadata) (match bool) {
+	country := r.database.Country(access.NormalizeIP(metadata.SourceAddress.Addr()))
+	match = country != "" && r.countries.Has(country)
+	if r.config.Invert {
+		match = !match
+	}
+	return
+}
+
+type RuleSourceASN struct {
+	database *geoip.Database
+	numbers  map[uint32]struct{}
+	config   *config.Rule
+}
+
+var _ Rule = (*RuleSourceASN)(nil)
+
+func NewSourceASNRule(newConfig *config.Rule, listMap map[string]set.StringSet, databases *geoip.Databases) (*RuleSourceASN, error) {
+	if databases == nil || databases.ASN == nil {
+		return nil, errors.New("GeoIP ASN database is not configured")
+	}
+	entries, err := readRuleEntries(newConfig, listMap)
+	if err != nil {
+		return nil, fmt.Errorf("bad ASN list [%v]: %w", newConfig.Parameter, err)
+	}
+	numbers := make(map[uint32]struct{}, len(entries))
+	for _, entry := range entries {
+		// both "AS13335" and "13335" are accepted
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(entry), "AS"), 10, 32)
+		if err != nil || number == 0 {
+			return nil, fmt.Errorf("bad ASN [%s]", entry)
+		}
+		numbers[uint32(number)] = struct{}{}
+	}
+	return &RuleSourceASN{
+		database: databases.ASN,
+		numbers:  numbers,
+		config:   newConfig,
+	}, nil
+}
+
+func (r *RuleSourceASN) Config() *config.Rule {
+	return r.config
+}
+
+func (r *RuleSourceASN) Match(metadata *adapter.Metadata) (match bool) {
+	number := r.database.ASN(access.NormalizeIP(metadata.SourceAddress.Addr()))
+	if number != 0 {
+		_, match = r.numbers[number]
+	}
+	if r.config.Invert {
+		match = !match
+	}
+	return
+}
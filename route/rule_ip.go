@@ -3,11 +3,11 @@ package route
 import (
 	"encoding/json"
 	"fmt"
-	"net/netip"
 	"strings"
 
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/access"
 	"github.com/layou233/zbproxy/v3/common/jsonx"
 	"github.com/layou233/zbproxy/v3/common/set"
 	"github.com/layou233/zbproxy/v3/config"
@@ -37,13 +37,13 @@ func NewSourceIPRule(newConfig *config.Rule, listMap map[string]set.StringSet) (
 				return nil, fmt.Errorf("list [%s] is not found", i)
 			}
 			for k := range list {
-				err = addIPToBuilder(&builder, k)
+				err = access.AddIPToBuilder(&builder, k)
 				if err != nil {
-					return nil, fmt.Errorf("bad IP address or CIDR [%s]: %w", i, err)
+					return nil, fmt.Errorf("bad IP address or CIDR [%s]: %w", k, err)
 				}
 			}
 		} else {
-			err = addIPToBuilder(&builder, i)
+			err = access.AddIPToBuilder(&builder, i)
 			if err != nil {
 				return nil, fmt.Errorf("bad IP address or CIDR [%s]: %w", i, err)
 			}
@@ -59,31 +59,12 @@ func NewSourceIPRule(newConfig *config.Rule, listMap map[string]set.StringSet) (
 	}, nil
 }
 
-func addIPToBuilder(builder *netipx.IPSetBuilder, s string) error {
-	// modified from netipx.ParsePrefixOrAddr
-	i := strings.LastIndexByte(s, '/')
-	if i < 0 {
-		addr, err := netip.ParseAddr(s)
-		if err != nil {
-			return err
-		}
-		builder.Add(addr)
-	} else {
-		prefix, err := netip.ParsePrefix(s)
-		if err != nil {
-			return err
-		}
-		builder.AddPrefix(prefix)
-	}
-	return nil
-}
-
 func (r *RuleSourceIP) Config() *config.Rule {
 	return r.config
 }
 
 func (r *RuleSourceIP) Match(metadata *adapter.Metadata) (match bool) {
-	match = r.set.Contains(metadata.SourceAddress.Addr().WithZone(""))
+	match = r.set.Contains(access.NormalizeIP(metadata.SourceAddress.Addr()))
 	if r.config.Invert {
 		match = !match
 	}
@@ -2,13 +2,11 @@ package route
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common"
-	"github.com/layou233/zbproxy/v3/common/set"
 	"github.com/layou233/zbproxy/v3/config"
-
-	"github.com/phuslu/log"
 )
 
 type ruleLogic struct {
@@ -16,7 +14,7 @@ type ruleLogic struct {
 	config *config.Rule
 }
 
-func newLogicalRule(logger *log.Logger, newConfig *config.Rule, listMap map[string]set.StringSet, ruleRegistry map[string]CustomRuleInitializer) (ruleLogic, error) {
+func newLogicalRule(newConfig *config.Rule, options RuleOptions) (ruleLogic, error) {
 	var ruleConfig []config.Rule
 	err := json.Unmarshal(newConfig.Parameter, &ruleConfig)
 	if err != nil {
@@ -24,8 +22,13 @@ func newLogicalRule(logger *log.Logger, newConfig *config.Rule, listMap map[stri
 	}
 	rules := make([]Rule, 0, len(ruleConfig))
 	for i := range ruleConfig {
+		// only the matching of sub-rules is used
+		subRule := &ruleConfig[i]
+		if subRule.Action != "" || subRule.Jump != "" || len(subRule.Metadata) > 0 || subRule.Message != "" {
+			return ruleLogic{}, errors.New("Action, Jump, Metadata and Message can not be used in logic rule parameter")
+		}
 		var newRule Rule
-		newRule, err = NewRule(logger, &ruleConfig[i], listMap, ruleRegistry)
+		newRule, err = NewRule(subRule, options)
 		if err != nil {
 			return ruleLogic{}, common.Cause("initialize rule in logic rule parameter: ", err)
 		}
@@ -47,8 +50,8 @@ type RuleLogicalAnd struct {
 
 var _ Rule = (*RuleLogicalAnd)(nil)
 
-func NewLogicalAndRule(logger *log.Logger, newConfig *config.Rule, listMap map[string]set.StringSet, ruleRegistry map[string]CustomRuleInitializer) (Rule, error) {
-	logicRule, err := newLogicalRule(logger, newConfig, listMap, ruleRegistry)
+func NewLogicalAndRule(newConfig *config.Rule, options RuleOptions) (Rule, error) {
+	logicRule, err := newLogicalRule(newConfig, options)
 	if err != nil {
 		return nil, err
 	}
@@ -75,8 +78,8 @@ type RuleLogicalOr struct {
 
 var _ Rule = (*RuleLogicalOr)(nil)
 
-func NewLogicalOrRule(logger *log.Logger, newConfig *config.Rule, listMap map[string]set.StringSet, ruleRegistry map[string]CustomRuleInitializer) (Rule, error) {
-	logicRule, err := newLogicalRule(logger, newConfig, listMap, ruleRegistry)
+func NewLogicalOrRule(newConfig *config.Rule, options RuleOptions) (Rule, error) {
+	logicRule, err := newLogicalRule(newConfig, options)
 	if err != nil {
 		return nil, err
 	}
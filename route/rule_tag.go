@@ -0,0 +1,89 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+// RuleTag matches the values in Metadata.Custom, which are set by rule actions, sniffers or custom rules.
+type RuleTag struct {
+	tags   map[string][]set.StringSet // empty if the key only needs to exist
+	config *config.Rule
+}
+
+var _ Rule = (*RuleTag)(nil)
+
+func NewTagRule(newConfig *config.Rule, listMap map[string]set.StringSet) (Rule, error) {
+	var tagMap map[string]jsonx.Listable[string]
+	err := json.Unmarshal(newConfig.Parameter, &tagMap)
+	if err != nil {
+		return nil, fmt.Errorf("bad tag map %v: %w", newConfig.Parameter, err)
+	}
+	if len(tagMap) == 0 {
+		return nil, errors.New("no tag")
+	}
+	tags := make(map[string][]set.StringSet, len(tagMap))
+	for key, values := range tagMap {
+		var sets []set.StringSet
+		if len(values) > 0 {
+			sets = []set.StringSet{
+				{}, // new set for individual values
+			}
+		}
+		for _, i := range values {
+			if strings.HasPrefix(i, parameterListPrefix) {
+				i = strings.TrimPrefix(i, parameterListPrefix)
+				valueSet, found := listMap[i]
+				if !found {
+					return nil, fmt.Errorf("list [%v] is not found", i)
+				}
+				sets = append(sets, valueSet)
+			} else {
+				sets[0].Add(i)
+			}
+		}
+		tags[key] = sets
+	}
+	return &RuleTag{
+		tags:   tags,
+		config: newConfig,
+	}, nil
+}
+
+func (r *RuleTag) Config() *config.Rule {
+	return r.config
+}
+
+func (r *RuleTag) Match(metadata *adapter.Metadata) (match bool) {
+	match = true
+	for key, sets := range r.tags {
+		value, found := metadata.CustomString(key)
+		if !found || !matchTagValue(sets, value) {
+			match = false
+			break
+		}
+	}
+	if r.config.Invert {
+		match = !match
+	}
+	return
+}
+
+func matchTagValue(sets []set.StringSet, value string) bool {
+	if len(sets) == 0 {
+		return true
+	}
+	for _, valueSet := range sets {
+		if valueSet.Has(value) {
+			return true
+		}
+	}
+	return false
+}
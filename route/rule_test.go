@@ -0,0 +1,34 @@
+package route
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/layou233/zbproxy/v3/common/set"
+)
+
+func TestExpandListEntries(t *testing.T) {
+	listMap := map[string]set.StringSet{
+		"admins": set.NewStringSetFromSlice([]string{"Steve", "Alex"}),
+		"empty":  {},
+	}
+	entries, err := expandListEntries([]string{"Notch", "list:admins", "list:empty"}, listMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(entries)
+	expected := []string{"Alex", "Notch", "Steve"}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %q, want %q", entries, expected)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Fatalf("got %q, want %q", entries, expected)
+		}
+	}
+
+	_, err = expandListEntries([]string{"list:missing"}, listMap)
+	if err == nil {
+		t.Error("missing list is expanded")
+	}
+}
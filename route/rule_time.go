@@ -0,0 +1,256 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+// RuleTime matches the time when the connection is routed.
+// Each window in the parameter is made of any of the following parts separated by spaces,
+// and all the parts given should match:
+//   - weekdays: "Mon", "Sat-Sun", "Mon,Wed,Fri-Sun"
+//   - time of day: "18:00-23:00", or "22:00-02:00" crossing midnight,
+//     which belongs to the weekday it starts on
+//   - absolute dates: "2026-12-24/2026-12-26" with the end day included,
+//     or "2026-12-24T18:00/2026-12-26T06:00" with the end excluded
+//   - time zone: "Asia/Shanghai", "UTC", local time zone by default
+//
+// For example, "Sat-Sun 18:00-23:00 Asia/Shanghai".
+type RuleTime struct {
+	windows []timeWindow
+	config  *config.Rule
+}
+
+var _ Rule = (*RuleTime)(nil)
+
+type timeWindow struct {
+	location *time.Location
+	days     [7]bool // indexed by time.Weekday, all false if not limited
+	limitDay bool
+
+	startMinute, endMinute int // minutes of day, not limited if both are 0
+	limitTime              bool
+
+	start, end time.Time // zero if not limited
+}
+
+func NewTimeRule(newConfig *config.Rule) (*RuleTime, error) {
+	var windowList jsonx.Listable[string]
+	err := json.Unmarshal(newConfig.Parameter, &windowList)
+	if err != nil {
+		return nil, fmt.Errorf("bad time window list [%v]: %w", newConfig.Parameter, err)
+	}
+	if len(windowList) == 0 {
+		return nil, errors.New("time window list is empty")
+	}
+	windows := make([]timeWindow, 0, len(windowList))
+	for _, s := range windowList {
+		window, err := parseTimeWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad time window [%s]: %w", s, err)
+		}
+		windows = append(windows, window)
+	}
+	return &RuleTime{
+		windows: windows,
+		config:  newConfig,
+	}, nil
+}
+
+func parseTimeWindow(s string) (timeWindow, error) {
+	window := timeWindow{location: time.Local}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return window, errors.New("empty window")
+	}
+	var (
+		dateRange      string
+		hasLocation    bool
+		hasDateOrTimes bool
+	)
+	for _, field := range fields {
+		startsWithDigit := field[0] >= '0' && field[0] <= '9'
+		switch {
+		case startsWithDigit && strings.Contains(field, "/"):
+			if dateRange != "" {
+				return window, errors.New("duplicated date range")
+			}
+			dateRange = field // parsed after the location is known
+			hasDateOrTimes = true
+		case startsWithDigit:
+			if window.limitTime {
+				return window, errors.New("duplicated time of day")
+			}
+			var err error
+			window.startMinute, window.endMinute, err = parseTimeOfDay(field)
+			if err != nil {
+				return window, err
+			}
+			window.limitTime = true
+			hasDateOrTimes = true
+		default:
+			if days, err := parseWeekdays(field); err == nil {
+				if window.limitDay {
+					return window, errors.New("duplicated weekdays")
+				}
+				window.days = days
+				window.limitDay = true
+				hasDateOrTimes = true
+				continue
+			}
+			location, err := time.LoadLocation(field)
+			if err != nil {
+				return window, fmt.Errorf("unknown part [%s]: %w", field, err)
+			}
+			if hasLocation {
+				return window, errors.New("duplicated time zone")
+			}
+			window.location = location
+			hasLocation = true
+		}
+	}
+	if !hasDateOrTimes {
+		return window, errors.New("no weekdays, time of day or date range")
+	}
+	if dateRange != "" {
+		var err error
+		window.start, window.end, err = parseDateRange(dateRange, window.location)
+		if err != nil {
+			return window, err
+		}
+	}
+	return window, nil
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+func parseWeekdays(s string) (days [7]bool, err error) {
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		from, found := weekdayNames[strings.ToLower(first)]
+		if !found {
+			return days, fmt.Errorf("unknown weekday [%s]", first)
+		}
+		to, found := weekdayNames[strings.ToLower(last)]
+		if !found {
+			return days, fmt.Errorf("unknown weekday [%s]", last)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseTimeOfDay parses "HH:MM-HH:MM" into minutes of day, the end may be "24:00".
+func parseTimeOfDay(s string) (start int, end int, err error) {
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("bad time of day [%s]", s)
+	}
+	start, err = parseClock(first)
+	if err != nil || start == 24*60 {
+		return 0, 0, fmt.Errorf("bad time of day [%s]", s)
+	}
+	end, err = parseClock(last)
+	if err != nil || start == end {
+		return 0, 0, fmt.Errorf("bad time of day [%s]", s)
+	}
+	return start, end, nil
+}
+
+func parseClock(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	clock, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// parseDateRange parses "start/end" where both are dates or both are date times.
+func parseDateRange(s string, location *time.Location) (start time.Time, end time.Time, err error) {
+	first, last, _ := strings.Cut(s, "/")
+	layout := "2006-01-02T15:04"
+	dateOnly := !strings.Contains(first, "T")
+	if dateOnly {
+		layout = "2006-01-02"
+	}
+	start, err = time.ParseInLocation(layout, first, location)
+	if err != nil {
+		return start, end, fmt.Errorf("bad date range [%s]: %w", s, err)
+	}
+	end, err = time.ParseInLocation(layout, last, location)
+	if err != nil {
+		return start, end, fmt.Errorf("bad date range [%s]: %w", s, err)
+	}
+	if dateOnly {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(start) {
+		return start, end, fmt.Errorf("bad date range [%s]: end is not after start", s)
+	}
+	return start, end, nil
+}
+
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	if !w.start.IsZero() && (t.Before(w.start) || !t.Before(w.end)) {
+		return false
+	}
+	day := t.Weekday()
+	if w.limitTime {
+		minute := t.Hour()*60 + t.Minute()
+		if w.startMinute < w.endMinute {
+			if minute < w.startMinute || minute >= w.endMinute {
+				return false
+			}
+		} else if minute < w.endMinute {
+			day = (day + 6) % 7 // the window crossing midnight started yesterday
+		} else if minute < w.startMinute {
+			return false
+		}
+	}
+	return !w.limitDay || w.days[day]
+}
+
+func (r *RuleTime) Config() *config.Rule {
+	return r.config
+}
+
+func (r *RuleTime) Match(metadata *adapter.Metadata) (match bool) {
+	now := time.Now()
+	for i := range r.windows {
+		if r.windows[i].contains(now) {
+			match = true
+			break
+		}
+	}
+	if r.config.Invert {
+		match = !match
+	}
+	return
+}
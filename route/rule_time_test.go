@@ -0,0 +1,117 @@
+package route
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	// 2026-10-16 is a Friday
+	for _, testCase := range []struct {
+		window string
+		times  map[string]bool // RFC 3339 time to whether it is contained
+	}{
+		{"22:00-02:00 UTC", map[string]bool{
+			"2026-10-19T21:59:59Z": false,
+			"2026-10-19T22:00:00Z": true,
+			"2026-10-19T23:30:00Z": true,
+			"2026-10-20T01:59:59Z": true,
+			"2026-10-20T02:00:00Z": false,
+		}},
+		{"Fri 22:00-02:00 UTC", map[string]bool{
+			"2026-10-15T23:00:00Z": false, // Thursday
+			"2026-10-16T01:00:00Z": false, // started on Thursday
+			"2026-10-16T23:00:00Z": true,
+			"2026-10-17T01:00:00Z": true, // started on Friday
+			"2026-10-17T23:00:00Z": false,
+		}},
+		{"18:00-24:00 UTC", map[string]bool{
+			"2026-10-19T17:59:00Z": false,
+			"2026-10-19T23:59:00Z": true,
+			"2026-10-20T00:00:00Z": false,
+		}},
+		{"Sat-Mon UTC", map[string]bool{
+			"2026-10-16T12:00:00Z": false, // Friday
+			"2026-10-17T12:00:00Z": true,
+			"2026-10-18T12:00:00Z": true,
+			"2026-10-19T12:00:00Z": true,
+			"2026-10-20T12:00:00Z": false, // Tuesday
+		}},
+		{"Mon,Wed-Thu UTC", map[string]bool{
+			"2026-10-19T12:00:00Z": true,
+			"2026-10-20T12:00:00Z": false,
+			"2026-10-21T12:00:00Z": true,
+			"2026-10-22T12:00:00Z": true,
+			"2026-10-23T12:00:00Z": false,
+		}},
+		{"2026-12-24/2026-12-26 UTC", map[string]bool{
+			"2026-12-23T23:59:59Z": false,
+			"2026-12-24T00:00:00Z": true,
+			"2026-12-26T23:59:59Z": true, // the end day is included
+			"2026-12-27T00:00:00Z": false,
+		}},
+		{"2026-12-24T18:00/2026-12-26T06:00 UTC", map[string]bool{
+			"2026-12-24T17:59:59Z": false,
+			"2026-12-24T18:00:00Z": true,
+			"2026-12-26T05:59:59Z": true,
+			"2026-12-26T06:00:00Z": false, // the end is excluded
+		}},
+		{"18:00-23:00 Asia/Shanghai", map[string]bool{
+			"2026-10-19T09:59:00Z": false,
+			"2026-10-19T10:00:00Z": true,
+			"2026-10-19T14:59:00Z": true,
+			"2026-10-19T15:00:00Z": false,
+		}},
+		{"Mon Asia/Shanghai", map[string]bool{
+			"2026-10-18T15:59:00Z": false, // Sunday in Shanghai
+			"2026-10-18T16:00:00Z": true,  // Sunday in UTC, Monday in Shanghai
+			"2026-10-19T15:59:00Z": true,
+			"2026-10-19T16:00:00Z": false,
+		}},
+		{"Asia/Shanghai 2026-12-24/2026-12-24", map[string]bool{
+			"2026-12-23T15:59:59Z": false,
+			"2026-12-23T16:00:00Z": true,
+			"2026-12-24T15:59:59Z": true,
+			"2026-12-24T16:00:00Z": false,
+		}},
+	} {
+		window, err := parseTimeWindow(testCase.window)
+		if err != nil {
+			t.Errorf("parse %s: %v", testCase.window, err)
+			continue
+		}
+		for s, expected := range testCase.times {
+			moment, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if window.contains(moment) != expected {
+				t.Errorf("%s contains %s: got %v, want %v", testCase.window, s, !expected, expected)
+			}
+		}
+	}
+}
+
+func TestParseTimeWindowErrors(t *testing.T) {
+	for _, window := range []string{
+		"",
+		"UTC",
+		"Funday",
+		"Mon Tue",
+		"10:00-11:00 12:00-13:00",
+		"Mon UTC Asia/Shanghai",
+		"2026-01-01/2026-01-02 2026-02-01/2026-02-02",
+		"10:00-10:00",
+		"24:00-01:00",
+		"10:00",
+		"25:00-26:00",
+		"2026-01-02/2026-01-01",
+		"2026-01-01T10:00/2026-01-01T10:00",
+		"2026-01-01/2026-01-02T10:00",
+	} {
+		_, err := parseTimeWindow(window)
+		if err == nil {
+			t.Errorf("parse %q: no error", window)
+		}
+	}
+}
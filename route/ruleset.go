@@ -0,0 +1,199 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/geoip"
+)
+
+// RuleSet is a group of rules evaluated in order.
+// The rules of Router are the root set, and the named sets can be matched or jumped into.
+type RuleSet struct {
+	name            string // empty for the root set
+	rules           []Rule
+	actions         []ruleAction     // compiled actions of rules
+	defaultOutbound adapter.Outbound // nil if returning to the jumping rule
+}
+
+// Match reports whether any rule in the set matches.
+func (s *RuleSet) Match(metadata *adapter.Metadata) bool {
+	for _, rule := range s.rules {
+		if rule.Match(metadata) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRuleSets creates all the named rule sets, which may reference each other without cycles.
+func (r *Router) newRuleSets(configs map[string]*config.RuleSet, geoIP *geoip.Databases) (map[string]*RuleSet, error) {
+	ruleSets := make(map[string]*RuleSet, len(configs))
+	for name, ruleSetConfig := range configs {
+		if ruleSetConfig == nil {
+			return nil, errors.New("rule set [" + name + "] is empty")
+		}
+		ruleSets[name] = &RuleSet{name: name}
+	}
+	err := checkRuleSetCycles(configs)
+	if err != nil {
+		return nil, err
+	}
+	for name, ruleSetConfig := range configs {
+		ruleSet := ruleSets[name]
+		err = r.initializeRuleSet(ruleSet, ruleSetConfig.Rules, ruleSets, geoIP)
+		if err != nil {
+			return nil, common.Cause("initialize rule set ["+name+"]: ", err)
+		}
+		if ruleSetConfig.DefaultOutbound != "" {
+			ruleSet.defaultOutbound, err = r.FindOutboundByName(ruleSetConfig.DefaultOutbound)
+			if err != nil {
+				return nil, common.Cause("default outbound of rule set ["+name+"] is not found: ", err)
+			}
+		}
+	}
+	return ruleSets, nil
+}
+
+func (r *Router) initializeRuleSet(ruleSet *RuleSet, rules []*config.Rule, ruleSets map[string]*RuleSet, geoIP *geoip.Databases) error {
+	ruleSet.rules = make([]Rule, 0, len(rules))
+	ruleSet.actions = make([]ruleAction, 0, len(rules))
+	for i, ruleConfig := range rules {
+		rule, err := NewRule(ruleConfig, RuleOptions{
+			Logger:       r.logger,
+			ListMap:      r.listMap,
+			RuleRegistry: r.ruleRegistry,
+			GeoIP:        geoIP,
+			RuleSets:     ruleSets,
+		})
+		if err != nil {
+			return fmt.Errorf("initialize rule [index=%d]: %w", i, err)
+		}
+		action, err := newRuleAction(ruleConfig, ruleSets)
+		if err != nil {
+			return fmt.Errorf("initialize rule [index=%d]: %w", i, err)
+		}
+		ruleSet.rules = append(ruleSet.rules, rule)
+		ruleSet.actions = append(ruleSet.actions, action)
+	}
+	return nil
+}
+
+// checkRuleSetCycles returns an error if any rule set references itself by matching or jumping.
+func checkRuleSetCycles(configs map[string]*config.RuleSet) error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	states := make(map[string]int, len(configs))
+	var visit func(path []string) error
+	visit = func(path []string) error {
+		name := path[len(path)-1]
+		switch states[name] {
+		case visiting:
+			return errors.New("rule set [" + name + "] references itself: " + strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		ruleSetConfig, found := configs[name]
+		if !found {
+			return nil // reported when initializing the rule
+		}
+		states[name] = visiting
+		for _, reference := range ruleSetReferences(ruleSetConfig.Rules) {
+			err := visit(append(path[:len(path):len(path)], reference))
+			if err != nil {
+				return err
+			}
+		}
+		states[name] = visited
+		return nil
+	}
+	for name := range configs {
+		err := visit([]string{name})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ruleSetReferences returns the names of rule sets referenced by rules, including the nested rules.
+func ruleSetReferences(rules []*config.Rule) []string {
+	var names []string
+	for _, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		if rule.Jump != "" {
+			names = append(names, rule.Jump)
+		}
+		switch rule.Type {
+		case "RuleSet":
+			var parameter jsonx.Listable[string]
+			if json.Unmarshal(rule.Parameter, &parameter) == nil {
+				names = append(names, parameter...)
+			}
+		case "and", "or":
+			var subRules []*config.Rule
+			if json.Unmarshal(rule.Parameter, &subRules) == nil {
+				names = append(names, ruleSetReferences(subRules)...)
+			}
+		}
+	}
+	return names
+}
+
+// RuleRuleSet matches if any of the referenced rule sets matches.
+type RuleRuleSet struct {
+	ruleSets []*RuleSet
+	config   *config.Rule
+}
+
+var _ Rule = (*RuleRuleSet)(nil)
+
+func NewRuleSetRule(newConfig *config.Rule, ruleSets map[string]*RuleSet) (Rule, error) {
+	var names jsonx.Listable[string]
+	err := json.Unmarshal(newConfig.Parameter, &names)
+	if err != nil {
+		return nil, common.Cause("bad rule set rule parameter: ", err)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no rule set")
+	}
+	rule := &RuleRuleSet{
+		ruleSets: make([]*RuleSet, 0, len(names)),
+		config:   newConfig,
+	}
+	for _, name := range names {
+		ruleSet, found := ruleSets[name]
+		if !found {
+			return nil, errors.New("rule set [" + name + "] is not found")
+		}
+		rule.ruleSets = append(rule.ruleSets, ruleSet)
+	}
+	return rule, nil
+}
+
+func (r *RuleRuleSet) Config() *config.Rule {
+	return r.config
+}
+
+func (r *RuleRuleSet) Match(metadata *adapter.Metadata) (match bool) {
+	for _, ruleSet := range r.ruleSets {
+		if ruleSet.Match(metadata) {
+			match = true
+			break
+		}
+	}
+	if r.config.Invert {
+		match = !match
+	}
+	return
+}
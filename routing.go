@@ -0,0 +1,82 @@
+package zbproxy
+
+import (
+	"context"
+	"errors"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/geoip"
+	"github.com/layou233/zbproxy/v3/protocol"
+	"github.com/layou233/zbproxy/v3/route"
+
+	"github.com/phuslu/log"
+)
+
+// routingOptions are the inputs of buildRouting.
+type routingOptions struct {
+	ctx             context.Context
+	outboundLogger  *log.Logger
+	routerLogger    *log.Logger
+	config          *config.Root
+	listMap         map[string]set.StringSet
+	geoIP           *geoip.Databases
+	ruleRegistry    map[string]route.CustomRuleInitializer
+	snifferRegistry map[string]protocol.SnifferFunc
+	// baseRouter prepares the new router if it is not nil,
+	// and the new outbounds inherit the outbounds of the same names in oldOutbounds.
+	baseRouter   *route.Router
+	oldOutbounds map[string]adapter.Outbound
+}
+
+// buildRouting creates the outbounds and the router of the config,
+// it is shared by starting, reloading and checking.
+func buildRouting(options routingOptions) (map[string]adapter.Outbound, *route.Router, error) {
+	outboundMap := make(map[string]adapter.Outbound, len(options.config.Outbounds))
+	for _, outboundConfig := range options.config.Outbounds {
+		if _, duplicated := outboundMap[outboundConfig.Name]; duplicated {
+			return nil, nil, errors.New("duplicated outbound [" + outboundConfig.Name + "]")
+		}
+		outbound, err := protocol.NewOutbound(options.outboundLogger, outboundConfig)
+		if err != nil {
+			return nil, nil, common.Cause("initialize outbound ["+outboundConfig.Name+"]: ", err)
+		}
+		if inheritOutbound, ok := outbound.(adapter.InheritOutbound); ok {
+			if oldOutbound, exists := options.oldOutbounds[outboundConfig.Name]; exists {
+				inheritOutbound.Inherit(oldOutbound)
+			}
+		}
+		outboundMap[outboundConfig.Name] = outbound
+	}
+
+	routerOptions := route.RouterOptions{
+		Config:          &options.config.Router,
+		OutboundMap:     outboundMap,
+		ListMap:         options.listMap,
+		RuleRegistry:    options.ruleRegistry,
+		SnifferRegistry: options.snifferRegistry,
+		GeoIP:           options.geoIP,
+	}
+	var (
+		router *route.Router
+		err    error
+	)
+	if options.baseRouter != nil {
+		router, err = options.baseRouter.Prepare(routerOptions)
+	} else {
+		router = &route.Router{}
+		err = router.Initialize(options.ctx, options.routerLogger, routerOptions)
+	}
+	if err != nil {
+		return nil, nil, common.Cause("initialize router: ", err)
+	}
+	for _, outbound := range outboundMap {
+		err = outbound.PostInitialize(router)
+		if err != nil {
+			return nil, nil, common.Cause("post initialize outbound ["+outbound.Name()+"]: ", err)
+		}
+	}
+	return outboundMap, router, nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/logging"
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+// AccessLogger writes one JSON record for every finished connection.
+// It is shared by all services and can be reconfigured at runtime.
+type AccessLogger struct {
+	access sync.RWMutex
+	config config.LogFile
+	writer *logging.FileWriter
+	logger *log.Logger
+}
+
+// Update applies the new access log config, nil disables the access log.
+func (l *AccessLogger) Update(newConfig *config.LogFile) error {
+	staged, err := l.Prepare(newConfig)
+	if err != nil {
+		return err
+	}
+	l.Commit(staged)
+	return nil
+}
+
+// Prepare validates newConfig and opens its file without changing the running access log,
+// nil disables the access log. The result must be either committed or discarded.
+func (l *AccessLogger) Prepare(newConfig *config.LogFile) (*AccessLogger, error) {
+	l.access.RLock()
+	unchanged := newConfig == nil && l.writer == nil ||
+		newConfig != nil && l.writer != nil && *newConfig == l.config
+	l.access.RUnlock()
+	if unchanged {
+		return l, nil
+	}
+	staged := &AccessLogger{}
+	if newConfig == nil {
+		return staged, nil
+	}
+	if newConfig.Path == "" {
+		return nil, errors.New("access log path is empty")
+	}
+	staged.config = *newConfig
+	staged.writer = logging.NewFileWriter(newConfig.FileOptions())
+	err := staged.writer.Open()
+	if err != nil {
+		staged.writer.Close()
+		return nil, common.Cause("open access log: ", err)
+	}
+	staged.logger = &log.Logger{
+		Level:      log.InfoLevel,
+		TimeFormat: time.RFC3339Nano,
+		Writer:     staged.writer,
+	}
+	return staged, nil
+}
+
+// Commit applies the access log prepared by Prepare, and closes the old file.
+func (l *AccessLogger) Commit(staged *AccessLogger) {
+	if staged == l {
+		return
+	}
+	l.access.Lock()
+	oldWriter := l.writer
+	l.config = staged.config
+	l.writer = staged.writer
+	l.logger = staged.logger
+	l.access.Unlock()
+	if oldWriter != nil {
+		oldWriter.Close()
+	}
+}
+
+// Discard closes the file opened by Prepare.
+func (l *AccessLogger) Discard(staged *AccessLogger) {
+	if staged != l && staged.writer != nil {
+		staged.writer.Close()
+	}
+}
+
+func (l *AccessLogger) Log(metadata *adapter.Metadata) {
+	if l == nil {
+		return
+	}
+	l.access.RLock()
+	defer l.access.RUnlock()
+	if l.logger == nil {
+		return
+	}
+	endTime := time.Now()
+	entry := l.logger.Log().
+		Str("id", metadata.ConnectionID).
+		Time("start", metadata.Stats.StartTime).
+		Dur("duration", endTime.Sub(metadata.Stats.StartTime)).
+		Str("service", metadata.ServiceName).
+		Int("rule", metadata.Stats.RuleIndex).
+		Str("outbound", metadata.Stats.Outbound).
+		Str("src", metadata.SourceAddress.String()).
+		Str("dest", metadata.DestinationHostname).
+		Uint16("destPort", metadata.DestinationPort)
+	if metadata.Minecraft != nil {
+		entry = entry.
+			Str("hostname", metadata.Minecraft.CleanOriginDestination()).
+			Str("player", metadata.Minecraft.PlayerName).
+			Str("uuid", metadata.Minecraft.UUIDString())
+	} else if metadata.TLS != nil {
+		entry = entry.Str("hostname", metadata.TLS.SNI)
+	}
+	if tags := metadata.Tags(); len(tags) > 0 {
+		tagContext := log.NewContext(nil)
+		for key, value := range tags {
+			tagContext = tagContext.Str(key, value)
+		}
+		entry = entry.Dict("tags", tagContext.Value())
+	}
+	entry = entry.
+		Int64("upload", metadata.Stats.Upload).
+		Int64("download", metadata.Stats.Download)
+	if metadata.Stats.CloseReason != nil {
+		entry = entry.Str("reason", metadata.Stats.CloseReason.Error())
+	} else {
+		entry = entry.Str("reason", "closed")
+	}
+	entry.Msg("")
+}
+
+func (l *AccessLogger) Close() error {
+	return l.Update(nil)
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/config"
+)
+
+func TestAccessLogRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLogger := &AccessLogger{}
+	err := accessLogger.Update(&config.LogFile{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minecraftMetadata := &adapter.Metadata{
+		ConnectionID:        "1",
+		ServiceName:         "mc",
+		SourceAddress:       netip.MustParseAddrPort("192.0.2.1:50000"),
+		DestinationHostname: "backend.internal",
+		DestinationPort:     25565,
+		Minecraft: &adapter.MinecraftMetadata{
+			PlayerName:        "Steve",
+			OriginDestination: "mc.example.com\x00FML\x00",
+			UUID:              [16]byte{0x06, 0x9a, 0x79, 0xf4, 0x44, 0xe9, 0x4d, 0x6b, 0x8e, 0x9d, 0x3b, 0x6a, 0x5d, 0x2e, 0x4f, 0x1c},
+		},
+		Stats: adapter.ConnectionStats{
+			StartTime:   time.Now().Add(-time.Second),
+			RuleIndex:   2,
+			Outbound:    "lobby",
+			Upload:      100,
+			Download:    2000,
+			CloseReason: errors.New("kicked"),
+		},
+	}
+	minecraftMetadata.SetCustom("region", "eu")
+	accessLogger.Log(minecraftMetadata)
+	accessLogger.Log(&adapter.Metadata{
+		ConnectionID:  "2",
+		ServiceName:   "https",
+		SourceAddress: netip.MustParseAddrPort("[2001:db8::1]:443"),
+		TLS:           &adapter.TLSMetadata{SNI: "www.example.com"},
+		Stats: adapter.ConnectionStats{
+			StartTime: time.Now(),
+			RuleIndex: -1,
+			Outbound:  "direct",
+		},
+	})
+	err = accessLogger.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for decoder.More() {
+		var record map[string]any
+		err = decoder.Decode(&record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2:\n%s", len(records), content)
+	}
+
+	for _, testCase := range []struct {
+		record int
+		want   map[string]any
+	}{
+		{0, map[string]any{
+			"id":       "1",
+			"service":  "mc",
+			"rule":     float64(2),
+			"outbound": "lobby",
+			"src":      "192.0.2.1:50000",
+			"dest":     "backend.internal",
+			"destPort": float64(25565),
+			"hostname": "mc.example.com",
+			"player":   "Steve",
+			"uuid":     "069a79f4-44e9-4d6b-8e9d-3b6a5d2e4f1c",
+			"tags":     map[string]any{"region": "eu"},
+			"upload":   float64(100),
+			"download": float64(2000),
+			"reason":   "kicked",
+		}},
+		{1, map[string]any{
+			"id":       "2",
+			"service":  "https",
+			"rule":     float64(-1),
+			"outbound": "direct",
+			"src":      "[2001:db8::1]:443",
+			"hostname": "www.example.com",
+			"upload":   float64(0),
+			"download": float64(0),
+			"reason":   "closed",
+		}},
+	} {
+		record := records[testCase.record]
+		for key, want := range testCase.want {
+			got, found := record[key]
+			if !found {
+				t.Errorf("record %d: field %s is missing", testCase.record, key)
+				continue
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("record %d: field %s = %s, want %s", testCase.record, key, gotJSON, wantJSON)
+			}
+		}
+		for _, key := range []string{"time", "start", "duration"} {
+			if _, found := record[key]; !found {
+				t.Errorf("record %d: field %s is missing", testCase.record, key)
+			}
+		}
+	}
+	if _, found := records[1]["player"]; found {
+		t.Error("record 1: a TLS connection has a player field")
+	}
+	if duration := records[0]["duration"].(float64); duration < 1000 {
+		t.Errorf("record 0: duration is %vms, want at least 1000ms", duration)
+	}
+}
@@ -6,96 +6,143 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"reflect"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common"
 	"github.com/layou233/zbproxy/v3/common/access"
 	"github.com/layou233/zbproxy/v3/common/bufio"
+	"github.com/layou233/zbproxy/v3/common/handoff"
+	"github.com/layou233/zbproxy/v3/common/metrics"
 	"github.com/layou233/zbproxy/v3/common/network"
 	"github.com/layou233/zbproxy/v3/common/set"
 	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/event"
 	"github.com/layou233/zbproxy/v3/protocol/minecraft"
 
 	"github.com/phuslu/log"
+	"go4.org/netipx"
 )
 
 type Service struct {
-	tcpListener    *net.TCPListener
-	ctx            context.Context
+	tcpListener   *net.TCPListener
+	ctx           context.Context
+	logger        *log.Logger
+	accessLogger  *AccessLogger
+	listenAddress string
+
+	// access protects the fields below, which can be changed by reloading
+	// while the listener is accepting
+	access         sync.RWMutex
 	router         adapter.Router
-	logger         *log.Logger
 	config         *config.Service
 	legacyOutbound adapter.Outbound
-	listenAddress  string
-	ipAccessLists  []set.StringSet
+	ipAccessSet    *netipx.IPSet // nil if IP access control is disabled
+
+	// active connections are kept across reloading for draining
+	connAccess  sync.Mutex
+	connections map[net.Conn]struct{}
+	drained     chan struct{} // closed when all connections are finished in draining
 
 	// TODO: udp service
 }
 
-var _ adapter.Service = (*Service)(nil)
+var (
+	_ adapter.Service       = (*Service)(nil)
+	_ adapter.DrainService  = (*Service)(nil)
+	_ adapter.ServiceReload = (*reloadPlan)(nil)
+)
 
-func NewService(logger *log.Logger, newConfig *config.Service) *Service {
+// NewService creates a new service. accessLogger can be nil if access log is not needed.
+func NewService(logger *log.Logger, accessLogger *AccessLogger, newConfig *config.Service) *Service {
 	return &Service{
 		listenAddress: ":" + strconv.Itoa(int(newConfig.Listen)),
 		logger:        logger,
+		accessLogger:  accessLogger,
 		config:        newConfig,
 	}
 }
 
-func (s *Service) listenLoop() {
+func (s *Service) listenLoop(listener *net.TCPListener) {
 	for {
-		conn, err := s.tcpListener.AcceptTCP()
+		conn, err := listener.AcceptTCP()
 		if err != nil {
 			return
 		}
+		s.access.RLock()
+		serviceConfig := s.config
+		router := s.router
+		legacyOutbound := s.legacyOutbound
+		ipAccessSet := s.ipAccessSet
+		s.access.RUnlock()
+		metrics.ServiceConnections.WithLabelValues(serviceConfig.Name).Inc()
+		s.trackConn(conn)
 		go func() {
+			defer s.untrackConn(conn)
 			tcpAddress := conn.RemoteAddr().(*net.TCPAddr)
 			ipString := tcpAddress.IP.String()
-			if s.ipAccessLists != nil &&
-				!access.Check(s.ipAccessLists, s.config.IPAccess.Mode, ipString) {
+			metadata := &adapter.Metadata{
+				ServiceName:         serviceConfig.Name,
+				DestinationHostname: serviceConfig.TargetAddress,
+				DestinationPort:     serviceConfig.TargetPort,
+				SourceAddress:       netip.AddrPortFrom(common.MustOK(netip.AddrFromSlice(tcpAddress.IP)).Unmap(), uint16(tcpAddress.Port)),
+				Stats: adapter.ConnectionStats{
+					StartTime: time.Now(),
+					RuleIndex: -1,
+				},
+			}
+			metadata.GenerateID()
+			defer s.accessLogger.Log(metadata)
+			defer func() { metrics.AddTags(metadata.Tags()) }()
+			if ipAccessSet != nil &&
+				!access.CheckIP(ipAccessSet, serviceConfig.IPAccess.Mode, metadata.SourceAddress.Addr()) {
+				metrics.AccessRejections.WithLabelValues(metrics.RejectServiceIP).Inc()
+				metadata.Stats.CloseReason = access.ErrRejected
 				conn.SetLinger(0)
 				conn.Close()
 				s.logger.Warn().
-					Str("service", s.config.Name).
+					Str("proxyConnectionID", metadata.ConnectionID).
+					Str("service", serviceConfig.Name).
 					Str("ip", ipString).
 					Msg("Rejected by access control")
+				accessEvent := event.NewConnectionEvent(event.TypeAccessRejected, metadata)
+				accessEvent.Reason = metrics.RejectServiceIP
+				event.Emit(s.ctx, accessEvent)
 				return
 			}
-			metadata := &adapter.Metadata{
-				ServiceName:         s.config.Name,
-				DestinationHostname: s.config.TargetAddress,
-				DestinationPort:     s.config.TargetPort,
-				SourceAddress:       netip.AddrPortFrom(common.MustOK(netip.AddrFromSlice(tcpAddress.IP)).Unmap(), uint16(tcpAddress.Port)),
-			}
-			metadata.GenerateID()
 			s.logger.Info().
 				Str("proxyConnectionID", metadata.ConnectionID).
-				Str("service", s.config.Name).
+				Str("service", serviceConfig.Name).
 				Str("ip", ipString).Msg("New inbound connection")
-			if s.legacyOutbound != nil {
+			if legacyOutbound != nil {
 				defer s.logger.Info().
 					Str("proxyConnectionID", metadata.ConnectionID).
-					Str("service", s.config.Name).
+					Str("service", serviceConfig.Name).
 					Str("ip", ipString).Msg("Disconnected")
 				defer conn.Close()
-				switch outbound := s.legacyOutbound.(type) {
+				metadata.Stats.Outbound = legacyOutbound.Name()
+				switch outbound := legacyOutbound.(type) {
 				case *minecraft.Outbound:
 					bufConn := &bufio.CachedConn{Conn: conn}
 					err = minecraft.SniffClientHandshake(bufConn, metadata)
 					bufConn.Release()
 					if err != nil {
+						metadata.Stats.CloseReason = err
 						s.logger.Warn().
 							Str("proxyConnectionID", metadata.ConnectionID).
-							Str("service", s.config.Name).
+							Str("service", serviceConfig.Name).
 							Str("ip", ipString).Err(err).Msg("Error when reading Minecraft handshake")
 						return
 					}
 					err = outbound.InjectConnection(s.ctx, bufConn, metadata)
 					if err != nil {
+						metadata.Stats.CloseReason = err
 						s.logger.Info().
 							Str("proxyConnectionID", metadata.ConnectionID).
-							Str("service", s.config.Name).
+							Str("service", serviceConfig.Name).
 							Str("player", metadata.Minecraft.PlayerName).
 							Str("ip", ipString).
 							Err(err).
@@ -103,80 +150,299 @@ func (s *Service) listenLoop() {
 					}
 				}
 			} else {
-				s.router.HandleConnection(conn, metadata)
+				router.HandleConnection(conn, metadata)
 			}
 		}()
 	}
 }
 
+// Check validates the config of the service without listening.
+func (s *Service) Check() error {
+	_, _, err := s.loadConfig(s.config, s.router, nil)
+	return err
+}
+
 func (s *Service) Start(ctx context.Context) error {
 	var err error
+	s.legacyOutbound, s.ipAccessSet, err = s.loadConfig(s.config, s.router, nil)
+	if err != nil {
+		return err
+	}
+	s.tcpListener, err = s.listen(ctx, s.listenAddress, s.config)
+	if err != nil {
+		return err
+	}
+	s.ctx = ctx
+
+	go s.listenLoop(s.tcpListener)
+	return nil
+}
+
+// loadConfig prepares the legacy outbound and access control lists of newConfig.
+// The new legacy outbound inherits the old one if it exists,
+// so that its online player count is kept.
+func (s *Service) loadConfig(newConfig *config.Service, router adapter.Router, oldOutbound adapter.Outbound) (
+	legacyOutbound adapter.Outbound, ipAccessSet *netipx.IPSet, err error,
+) {
 	// handle legacy modes
-	if s.config.Minecraft != nil && s.config.TLSSniffing != nil {
-		return errors.New("Minecraft and TLSSniffing are mutually exclusive in legacy mode")
-	}
-	if s.config.Minecraft != nil {
-		s.legacyOutbound, err = minecraft.NewOutbound(s.logger, &config.Outbound{
-			Name:          "legacy-" + s.config.Name,
-			TargetAddress: s.config.TargetAddress,
-			TargetPort:    s.config.TargetPort,
-			Minecraft:     s.config.Minecraft,
-			SocketOptions: network.ConvertLegacyOutboundOptions(s.config.SocketOptions),
-		})
+	if newConfig.Minecraft != nil && newConfig.TLSSniffing != nil {
+		return nil, nil, errors.New("Minecraft and TLSSniffing are mutually exclusive in legacy mode")
+	}
+
+	// load legacy IP access control
+	if newConfig.IPAccess.Mode != access.DefaultMode {
+		var ipAccessLists []set.StringSet
+		ipAccessLists, err = router.FindListsByTag(newConfig.IPAccess.ListTags)
 		if err != nil {
-			return common.Cause("initialize legacy Minecraft outbound: ", err)
+			return nil, nil, common.Cause("load access control lists: ", err)
 		}
-		err = s.legacyOutbound.PostInitialize(s.router)
+		ipAccessSet, err = access.NewIPSet(ipAccessLists)
 		if err != nil {
-			return common.Cause("post initialize legacy Minecraft outbound: ", err)
+			return nil, nil, common.Cause("load access control lists: ", err)
 		}
 	}
 
-	// load legacy IP access control
-	if s.config.IPAccess.Mode != access.DefaultMode {
-		s.ipAccessLists, err = s.router.FindListsByTag(s.config.IPAccess.ListTags)
+	if newConfig.Minecraft != nil {
+		outboundConfig := &config.Outbound{
+			Name:          "legacy-" + newConfig.Name,
+			TargetAddress: newConfig.TargetAddress,
+			TargetPort:    newConfig.TargetPort,
+			Minecraft:     newConfig.Minecraft,
+			SocketOptions: network.ConvertLegacyOutboundOptions(newConfig.SocketOptions),
+		}
+		var minecraftOutbound *minecraft.Outbound
+		minecraftOutbound, err = minecraft.NewOutbound(s.logger, outboundConfig)
+		if err != nil {
+			return nil, nil, common.Cause("initialize legacy Minecraft outbound: ", err)
+		}
+		if oldOutbound != nil {
+			minecraftOutbound.Inherit(oldOutbound)
+		}
+		legacyOutbound = minecraftOutbound
+		err = legacyOutbound.PostInitialize(router)
 		if err != nil {
-			return common.Cause("load access control lists: ", err)
+			return nil, nil, common.Cause("post initialize legacy Minecraft outbound: ", err)
 		}
 	}
+	return legacyOutbound, ipAccessSet, nil
+}
 
+func (s *Service) listen(ctx context.Context, listenAddress string, newConfig *config.Service) (*net.TCPListener, error) {
+	if listener, inherited := handoff.Listener(handoffKey(listenAddress)); inherited {
+		s.logger.Info().
+			Str("service", newConfig.Name).
+			Msg("Inherited listener on " + listenAddress)
+		return listener, nil
+	}
 	listenConfig := &net.ListenConfig{
-		Control: network.NewListenerControlFromOptions(s.config.SocketOptions),
+		Control: network.NewListenerControlFromOptions(newConfig.SocketOptions),
 	}
-	if s.config.SocketOptions != nil {
-		network.SetListenerTCPKeepAlive(listenConfig, s.config.SocketOptions.KeepAliveConfig())
-		if s.config.SocketOptions.MultiPathTCP {
+	if newConfig.SocketOptions != nil {
+		network.SetListenerTCPKeepAlive(listenConfig, newConfig.SocketOptions.KeepAliveConfig())
+		if newConfig.SocketOptions.MultiPathTCP {
 			network.SetListenerMultiPathTCP(listenConfig, true)
 		}
 	}
-	listener, err := listenConfig.Listen(ctx, "tcp", s.listenAddress)
+	listener, err := listenConfig.Listen(ctx, "tcp", listenAddress)
 	if err != nil {
-		return common.Cause("start listening: ", err)
+		return nil, common.Cause("start listening: ", err)
 	}
-	s.tcpListener = listener.(*net.TCPListener)
-	s.ctx = ctx
 	s.logger.Info().
-		Str("service", s.config.Name).
-		Msg("Listening on " + s.listenAddress)
+		Str("service", newConfig.Name).
+		Msg("Listening on " + listenAddress)
+	return listener.(*net.TCPListener), nil
+}
 
-	go s.listenLoop()
-	return nil
+// reloadPlan is a prepared reload of the service, the running service is not changed until it is applied.
+type reloadPlan struct {
+	service        *Service
+	ctx            context.Context
+	config         *config.Service
+	listenAddress  string
+	legacyOutbound adapter.Outbound
+	ipAccessSet    *netipx.IPSet
+	listener       *net.TCPListener // bound on the new port, nil if the port is unchanged
+	rebindInPlace  bool             // the socket options are changed on the same port
 }
 
+// Reload applies newConfig without closing the listener,
+// unless the listen port or socket options are changed.
+// In that case, a new listener is bound before closing the old one if the port is changed.
 func (s *Service) Reload(ctx context.Context, newConfig *config.Service) error {
-	if s.tcpListener == nil {
-		return os.ErrClosed
+	s.access.RLock()
+	router := s.router
+	s.access.RUnlock()
+	plan, err := s.PrepareReload(ctx, newConfig, router)
+	if err != nil {
+		return err
+	}
+	return plan.Apply()
+}
+
+// PrepareReload loads newConfig and binds the listener if the service is not listening
+// or the port is changed. The service is started when the result is applied if it is not yet.
+func (s *Service) PrepareReload(ctx context.Context, newConfig *config.Service, router adapter.Router) (adapter.ServiceReload, error) {
+	plan := &reloadPlan{
+		service:       s,
+		ctx:           ctx,
+		config:        newConfig,
+		listenAddress: ":" + strconv.Itoa(int(newConfig.Listen)),
+	}
+	s.access.RLock()
+	oldOutbound := s.legacyOutbound
+	s.access.RUnlock()
+	var err error
+	plan.legacyOutbound, plan.ipAccessSet, err = s.loadConfig(newConfig, router, oldOutbound)
+	if err != nil {
+		return nil, err
+	}
+	if s.tcpListener == nil || plan.listenAddress != s.listenAddress {
+		plan.listener, err = s.listen(ctx, plan.listenAddress, newConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else if !reflect.DeepEqual(s.config.SocketOptions, newConfig.SocketOptions) {
+		plan.rebindInPlace = true
+	}
+	return plan, nil
+}
+
+func (p *reloadPlan) RebindsInPlace() bool {
+	return p.rebindInPlace
+}
+
+// Discard releases the listener bound by the plan.
+func (p *reloadPlan) Discard() {
+	if p.listener != nil {
+		p.listener.Close()
+	}
+}
+
+// Apply applies the plan.
+// If binding with the changed socket options fails, the listener is bound with the old options again.
+func (p *reloadPlan) Apply() error {
+	return p.service.applyReload(p)
+}
+
+func (s *Service) applyReload(plan *reloadPlan) error {
+	newListener := plan.listener
+	if plan.rebindInPlace {
+		// the port must be released before binding again
+		s.Close()
+		var err error
+		newListener, err = s.listen(plan.ctx, plan.listenAddress, plan.config)
+		if err != nil {
+			oldListener, restoreErr := s.listen(s.ctx, s.listenAddress, s.config)
+			if restoreErr != nil {
+				s.logger.Error().
+					Str("service", s.config.Name).
+					Err(restoreErr).
+					Msg("Error when restoring listener, it is bound again on next reload")
+				return err
+			}
+			s.tcpListener = oldListener
+			go s.listenLoop(oldListener)
+			return err
+		}
+	}
+
+	s.access.Lock()
+	s.config = plan.config
+	s.legacyOutbound = plan.legacyOutbound
+	s.ipAccessSet = plan.ipAccessSet
+	s.access.Unlock()
+
+	if newListener != nil {
+		if s.tcpListener != nil {
+			s.tcpListener.Close()
+		}
+		s.tcpListener = newListener
+		s.listenAddress = plan.listenAddress
+		s.ctx = plan.ctx
+		go s.listenLoop(newListener)
+	} else {
+		s.logger.Debug().
+			Str("service", plan.config.Name).
+			Msg("Reloaded without re-binding")
 	}
-	s.Close()
-	s.listenAddress = ":" + strconv.Itoa(int(newConfig.Listen))
-	s.config = newConfig
-	s.legacyOutbound = nil
-	s.ipAccessLists = nil
-	return s.Start(ctx)
+	return nil
 }
 
 func (s *Service) UpdateRouter(router adapter.Router) {
+	s.access.Lock()
 	s.router = router
+	s.access.Unlock()
+}
+
+func handoffKey(listenAddress string) string {
+	return "service:" + listenAddress
+}
+
+// HandoffListener returns the listener with its handoff key,
+// or nil if the service is not listening.
+func (s *Service) HandoffListener() (key string, listener *net.TCPListener) {
+	return handoffKey(s.listenAddress), s.tcpListener
+}
+
+func (s *Service) trackConn(conn net.Conn) {
+	s.connAccess.Lock()
+	if s.connections == nil {
+		s.connections = make(map[net.Conn]struct{})
+	}
+	s.connections[conn] = struct{}{}
+	s.connAccess.Unlock()
+}
+
+func (s *Service) untrackConn(conn net.Conn) {
+	s.connAccess.Lock()
+	delete(s.connections, conn)
+	if len(s.connections) == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+	s.connAccess.Unlock()
+}
+
+// Drain makes the legacy Minecraft outbound kick new players with the message.
+func (s *Service) Drain(message string) {
+	s.access.RLock()
+	legacyOutbound := s.legacyOutbound
+	s.access.RUnlock()
+	if drainOutbound, ok := legacyOutbound.(adapter.DrainOutbound); ok {
+		drainOutbound.Drain(message)
+	}
+}
+
+func (s *Service) Shutdown(ctx context.Context) error {
+	if s.tcpListener != nil {
+		s.Close()
+	}
+	s.connAccess.Lock()
+	if len(s.connections) == 0 {
+		s.connAccess.Unlock()
+		return nil
+	}
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+	}
+	drained := s.drained
+	s.connAccess.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+	s.connAccess.Lock()
+	remaining := len(s.connections)
+	for conn := range s.connections {
+		conn.Close()
+	}
+	s.connAccess.Unlock()
+	s.logger.Warn().
+		Str("service", s.config.Name).
+		Int("connections", remaining).
+		Msg("Drain timeout, closed remaining connections")
+	return ctx.Err()
 }
 
 func (s *Service) Close() error {
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/network"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+
+	"github.com/phuslu/log"
+)
+
+var testLogger = &log.Logger{Writer: &log.IOWriter{Writer: io.Discard}}
+
+// testRouter reports the service name of every handled connection.
+type testRouter struct {
+	handled chan string
+}
+
+func (r *testRouter) FindOutboundByName(string) (adapter.Outbound, error) { return nil, nil }
+
+func (r *testRouter) FindListsByTag([]string) ([]set.StringSet, error) { return nil, nil }
+
+func (r *testRouter) HandleConnection(conn net.Conn, metadata *adapter.Metadata) {
+	conn.Close()
+	r.handled <- metadata.ServiceName
+}
+
+// freePort returns a port which is not in use.
+// It is chosen below the ephemeral port range of common systems,
+// so that it does not collide with the local ports of client connections.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	for attempt := 0; attempt < 100; attempt++ {
+		port := 20000 + rand.Intn(12000)
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			listener.Close()
+			return uint16(port)
+		}
+	}
+	t.Fatal("no free port is found")
+	return 0
+}
+
+func startTestService(t *testing.T, serviceConfig *config.Service) (*Service, *testRouter) {
+	t.Helper()
+	router := &testRouter{handled: make(chan string, 1)}
+	s := NewService(testLogger, nil, serviceConfig)
+	s.UpdateRouter(router)
+	err := s.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, router
+}
+
+// checkServing checks that a connection to port is handled by the service named name.
+func checkServing(t *testing.T, router *testRouter, port uint16, name string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+	if err != nil {
+		t.Fatalf("port %d is not listening: %v", port, err)
+	}
+	defer conn.Close()
+	select {
+	case handled := <-router.handled:
+		if handled != name {
+			t.Errorf("connection is handled by service %s, want %s", handled, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection to port %d is not handled", port)
+	}
+}
+
+func TestPrepareReload(t *testing.T) {
+	port := freePort(t)
+	oldConfig := &config.Service{Name: "old", Listen: port}
+	s, router := startTestService(t, oldConfig)
+	newPort := freePort(t)
+
+	for _, testCase := range []struct {
+		name         string
+		config       *config.Service
+		wantListener bool
+		wantRebind   bool
+	}{
+		{
+			name:   "unchanged listener",
+			config: &config.Service{Name: "renamed", Listen: port, TargetAddress: "mc.example.com"},
+		},
+		{
+			name: "changed socket options",
+			config: &config.Service{Name: "renamed", Listen: port, SocketOptions: &network.InboundSocketOptions{
+				TCPFastOpen: true,
+			}},
+			wantRebind: true,
+		},
+		{
+			name:         "changed port",
+			config:       &config.Service{Name: "renamed", Listen: newPort},
+			wantListener: true,
+		},
+	} {
+		reload, err := s.PrepareReload(context.Background(), testCase.config, router)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+		plan := reload.(*reloadPlan)
+		if (plan.listener != nil) != testCase.wantListener {
+			t.Errorf("%s: bound a new listener: %v, want %v", testCase.name, plan.listener != nil, testCase.wantListener)
+		}
+		if plan.RebindsInPlace() != testCase.wantRebind {
+			t.Errorf("%s: rebinds in place: %v, want %v", testCase.name, plan.RebindsInPlace(), testCase.wantRebind)
+		}
+		// preparing does not change the running service
+		checkServing(t, router, port, "old")
+		reload.Discard()
+	}
+
+	// apply the changed port, the old port is released
+	reload, err := s.PrepareReload(context.Background(), &config.Service{Name: "new", Listen: newPort}, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reload.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkServing(t, router, newPort, "new")
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+	if err == nil {
+		conn.Close()
+		t.Error("old port is still listening")
+	}
+
+	// a new service binds when preparing
+	newService := NewService(testLogger, nil, &config.Service{Name: "second", Listen: port})
+	reload, err = newService.PrepareReload(context.Background(), &config.Service{Name: "second", Listen: port}, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reload.(*reloadPlan).listener == nil {
+		t.Error("a service not listening does not bind when preparing")
+	}
+	reload.Discard()
+
+	// binding a port in use fails when preparing
+	_, err = newService.PrepareReload(context.Background(), &config.Service{Name: "second", Listen: newPort}, router)
+	if err == nil {
+		t.Error("preparing on a port in use succeeds")
+	}
+}
+
+func TestReloadRebindFailure(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("unknown TCP congestion algorithms only fail on Linux")
+	}
+	port := freePort(t)
+	oldConfig := &config.Service{Name: "old", Listen: port}
+	s, router := startTestService(t, oldConfig)
+
+	reload, err := s.PrepareReload(context.Background(), &config.Service{
+		Name:          "new",
+		Listen:        port,
+		SocketOptions: &network.InboundSocketOptions{TCPCongestion: "no-such-algorithm"},
+	}, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reload.RebindsInPlace() {
+		t.Fatal("changed socket options do not rebind in place")
+	}
+	err = reload.Apply()
+	if err == nil {
+		t.Fatal("rebinding with a bad congestion algorithm succeeds")
+	}
+
+	// the old listener and config are restored
+	if s.config != oldConfig {
+		t.Errorf("config is changed to %s after failing", s.config.Name)
+	}
+	checkServing(t, router, port, "old")
+}
@@ -0,0 +1,48 @@
+package zbproxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/common/handoff"
+	"github.com/layou233/zbproxy/v3/service"
+)
+
+const upgradeReadyTimeout = time.Minute
+
+// Upgrade starts a new process of the current executable with the same arguments,
+// and hands the listeners of services and the metrics server to it.
+// After it succeeds, call Shutdown to drain the connections of this instance.
+// Only supported on Linux.
+func (i *Instance) Upgrade() error {
+	i.access.Lock()
+	defer i.access.Unlock()
+	listeners := make(map[string]*net.TCPListener, len(i.serviceMap)+1)
+	for _, s := range i.serviceMap {
+		if tcpService, isTCP := s.(*service.Service); isTCP {
+			key, listener := tcpService.HandoffListener()
+			if listener != nil {
+				listeners[key] = listener
+			}
+		}
+	}
+	if i.metricsServer != nil {
+		listeners[i.metricsServer.handoffKey()] = i.metricsServer.listener
+	}
+	pid, err := handoff.Upgrade(listeners, upgradeReadyTimeout)
+	if err != nil {
+		return err
+	}
+	i.logger.Info().
+		Int("pid", pid).
+		Int("listeners", len(listeners)).
+		Msg("Handed listeners to the new process")
+	return nil
+}
+
+// upgradeReady is called after the instance is started,
+// it notifies the parent process if this instance is started by Upgrade.
+func (i *Instance) upgradeReady() {
+	handoff.CloseUnused()
+	handoff.Ready()
+}
@@ -3,11 +3,16 @@ package zbproxy
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/layou233/zbproxy/v3/adapter"
 	"github.com/layou233/zbproxy/v3/common"
+	"github.com/layou233/zbproxy/v3/common/set"
 	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/event"
+	"github.com/layou233/zbproxy/v3/geoip"
+	"github.com/layou233/zbproxy/v3/list"
 	"github.com/layou233/zbproxy/v3/protocol"
 	"github.com/layou233/zbproxy/v3/route"
 	"github.com/layou233/zbproxy/v3/service"
@@ -25,26 +30,38 @@ type Options struct {
 }
 
 type Instance struct {
-	ctx             context.Context
-	logger          *log.Logger
-	config          *config.Root
-	router          *route.Router
-	serviceMap      map[string]adapter.Service
-	outboundMap     map[string]adapter.Outbound
-	ruleRegistry    map[string]route.CustomRuleInitializer
-	snifferRegistry map[string]protocol.SnifferFunc
+	access           sync.Mutex // serializes config updating and shutting down
+	closed           bool
+	ctx              context.Context
+	logger           *log.Logger
+	loggers          moduleLoggers
+	appliedLogConfig config.Log // the log config in use, only the levels are applied on reload
+	config           *config.Root
+	router           *route.Router
+	serviceMap       map[string]adapter.Service
+	serviceConfigs   map[string]*config.Service // the configs the services are running with
+	outboundMap      map[string]adapter.Outbound
+	ruleRegistry     map[string]route.CustomRuleInitializer
+	snifferRegistry  map[string]protocol.SnifferFunc
+	metricsServer    *metricsServer
+	accessLogger     *service.AccessLogger
+	events           *event.Bus
+	lists            *list.Manager
+	listProviders    *list.Providers
+	geoIP            *geoip.Manager
+	geoIPDatabases   *geoip.Databases
 }
 
 func NewInstance(ctx context.Context, options Options) (*Instance, error) {
 	instance := &Instance{
-		ctx: ctx,
 		logger: &log.Logger{
-			TimeFormat: "2006-01-02 15:04:05-0700",
+			TimeFormat: logTimeFormat,
 			Writer:     options.LogWriter,
 		},
 		config:          options.Config,
 		ruleRegistry:    options.RuleRegistry,
 		snifferRegistry: options.SnifferRegistry,
+		accessLogger:    &service.AccessLogger{},
 	}
 	if options.LogWriter == nil {
 		instance.logger.Writer = &log.ConsoleWriter{
@@ -52,25 +69,37 @@ func NewInstance(ctx context.Context, options Options) (*Instance, error) {
 			EndWithMessage: true,
 		}
 	}
+	instance.loggers = newModuleLoggers(instance.logger.Writer)
+	instance.events = event.NewBus(ctx, instance.logger)
+	ctx = event.WithBus(ctx, instance.events)
+	instance.ctx = ctx
+	instance.lists = list.NewManager(ctx, instance.loggers.config, instance.refreshLists)
+	instance.geoIP = geoip.NewManager(ctx, instance.loggers.config)
 	if options.Config == nil {
 		if options.ConfigFilePath != "" {
+			// the watcher is started after configuring the loggers it uses
 			newConfig, err := config.LoadConfigFromFile(
-				ctx, options.ConfigFilePath, !options.DisableReload, instance.logger)
+				ctx, options.ConfigFilePath, false, instance.loggers.config)
 			if err != nil {
 				return nil, err
 			}
 			instance.config = newConfig
-			if !options.DisableReload {
-				// configure handler here
-				// if you provide config directly from option
-				// then configure it by yourself like this
-				newConfig.SetUpdateHandler(instance.UpdateConfig)
-			}
 		} else {
 			return nil, errors.New("no config provided for zbproxy")
 		}
 	}
-	instance.logger.Level = instance.config.Log.Level
+	instance.configureLoggers(options.LogWriter != nil)
+	if options.Config == nil && !options.DisableReload {
+		// configure handler here
+		// if you provide config directly from option
+		// then configure it by yourself like this
+		instance.config.SetReloadHandler(instance.ApplyConfig)
+		instance.config.SetReloadErrorHandler(instance.emitReloadFailed)
+		err := instance.config.Watch()
+		if err != nil {
+			return nil, common.Cause("watch config: ", err)
+		}
+	}
 
 	return instance, nil
 }
@@ -83,52 +112,62 @@ func (i *Instance) Router() *route.Router {
 	return i.router
 }
 
+// Events returns the event bus, use it to subscribe events in process.
+func (i *Instance) Events() *event.Bus {
+	return i.events
+}
+
 func (i *Instance) Start() error {
 	var err error
 	startTime := time.Now()
 
-	// initialize outbounds
-	outboundMap := make(map[string]adapter.Outbound, len(i.config.Outbounds))
-	for _, outboundConfig := range i.config.Outbounds {
-		var outbound adapter.Outbound
-		outbound, err = protocol.NewOutbound(i.logger, outboundConfig)
-		if err != nil {
-			return common.Cause("initialize outbound ["+outboundConfig.Name+"]: ", err)
-		}
-		outboundMap[outbound.Name()] = outbound
+	err = i.accessLogger.Update(i.config.AccessLog)
+	if err != nil {
+		return common.Cause("initialize access log: ", err)
 	}
-	i.outboundMap = outboundMap
 
-	// initialize router
-	i.router = &route.Router{}
-	err = i.router.Initialize(i.ctx, i.logger, route.RouterOptions{
-		Config:          &i.config.Router,
-		OutboundMap:     outboundMap,
-		ListMap:         i.config.Lists,
-		RuleRegistry:    i.ruleRegistry,
-		SnifferRegistry: i.snifferRegistry,
-	})
+	i.listProviders, err = i.lists.Prepare(i.config.ListProviders)
 	if err != nil {
-		return common.Cause("initialize router: ", err)
+		return err
 	}
-	for _, outbound := range outboundMap {
-		err = outbound.PostInitialize(i.router)
-		if err != nil {
-			return common.Cause("post initialize outbound ["+outbound.Name()+"]: ", err)
-		}
+	i.geoIPDatabases, err = i.geoIP.Prepare(i.config.GeoIP)
+	if err != nil {
+		return err
+	}
+
+	// initialize outbounds and router
+	i.outboundMap, i.router, err = buildRouting(i.routingOptions(i.config, i.listProviders.Merge(i.config.Lists), i.geoIPDatabases))
+	if err != nil {
+		return err
 	}
 
 	// initialize services
 	i.serviceMap = make(map[string]adapter.Service, len(i.config.Services))
+	i.serviceConfigs = make(map[string]*config.Service, len(i.config.Services))
 	for _, serviceConfig := range i.config.Services {
-		newService := service.NewService(i.logger, serviceConfig)
+		newService := service.NewService(i.loggers.service, i.accessLogger, serviceConfig)
 		newService.UpdateRouter(i.router)
 		err = newService.Start(i.ctx)
 		if err != nil {
 			return common.Cause("start service ["+serviceConfig.Name+"]: ", err)
 		}
 		i.serviceMap[serviceConfig.Name] = newService
+		i.serviceConfigs[serviceConfig.Name] = serviceConfig
+	}
+
+	sinks, err := event.NewSinks(i.logger, i.config.Events, nil)
+	if err != nil {
+		return common.Cause("initialize event sinks: ", err)
+	}
+	i.events.SetSinks(sinks)
+	err = i.updateMetricsServer(i.config.Metrics)
+	if err != nil {
+		return err
 	}
+	i.lists.Commit(i.listProviders)
+	i.geoIP.Commit(i.geoIPDatabases)
+
+	i.upgradeReady()
 
 	i.logger.Info().
 		Str("duration", time.Now().Sub(startTime).String()).
@@ -140,76 +179,266 @@ func (i *Instance) Reload() bool {
 	return i.config.Reload()
 }
 
+// UpdateConfig applies the config of i after it is replaced by reloading,
+// it is kept for the handler set by config.Root.SetUpdateHandler.
+// If it fails, the running instance is kept unchanged, but the config of i is not reverted.
+// Use ApplyConfig with config.Root.SetReloadHandler instead.
 func (i *Instance) UpdateConfig() {
-	// update outbounds
-	newOutboundMap := make(map[string]adapter.Outbound, len(i.config.Outbounds))
-	for _, outboundConfig := range i.config.Outbounds {
-		if oldOutbound, ok := i.outboundMap[outboundConfig.Name]; ok {
-			err := oldOutbound.Reload(outboundConfig)
-			if err != nil {
-				i.logger.Error().
-					Str("outbound", outboundConfig.Name).
-					Err(err).
-					Msg("Error when updating outbounds")
-				return
-			}
-			newOutboundMap[outboundConfig.Name] = oldOutbound
-		} else {
-			newOutbound, err := protocol.NewOutbound(i.logger, outboundConfig)
-			if err != nil {
-				i.logger.Error().
-					Str("outbound", outboundConfig.Name).
-					Err(err).
-					Msg("Error when initializing outbounds")
-				return
-			}
-			newOutboundMap[outboundConfig.Name] = newOutbound
-		}
+	err := i.ApplyConfig(i.config)
+	if err != nil {
+		i.logger.Error().
+			Err(err).
+			Msg("Error when updating config")
+	}
+}
+
+// ApplyConfig builds and validates everything of newConfig first, then applies them together.
+// If anything fails, the running instance is kept unchanged and the error is returned.
+func (i *Instance) ApplyConfig(newConfig *config.Root) error {
+	i.access.Lock()
+	defer i.access.Unlock()
+	if i.closed {
+		return errors.New("instance is closed")
+	}
+	err := i.updateConfig(newConfig)
+	if err != nil {
+		i.emitReloadFailed(err)
+		return err
 	}
+	event.Emit(i.ctx, &event.Event{Type: event.TypeConfigReloaded})
+	return nil
+}
 
-	// update router
-	err := i.router.UpdateConfig(route.RouterOptions{
-		Config:          &i.config.Router,
-		OutboundMap:     newOutboundMap,
-		ListMap:         i.config.Lists,
-		RuleRegistry:    i.ruleRegistry,
-		SnifferRegistry: i.snifferRegistry,
+func (i *Instance) emitReloadFailed(err error) {
+	event.Emit(i.ctx, &event.Event{
+		Type:   event.TypeConfigReloadFailed,
+		Reason: err.Error(),
 	})
+}
+
+func (i *Instance) updateConfig(newConfig *config.Root) error {
+	// prepare everything without changing the running instance
+	accessLog, err := i.accessLogger.Prepare(newConfig.AccessLog)
+	if err != nil {
+		return common.Cause("initialize access log: ", err)
+	}
+	metricsServer, err := i.prepareMetricsServer(newConfig.Metrics)
+	if err != nil {
+		i.accessLogger.Discard(accessLog)
+		return err
+	}
+	discard := func() {
+		i.accessLogger.Discard(accessLog)
+		i.discardMetricsServer(metricsServer)
+	}
+	listProviders, err := i.lists.Prepare(newConfig.ListProviders)
+	if err != nil {
+		discard()
+		return err
+	}
+	geoIPDatabases, err := i.geoIP.Prepare(newConfig.GeoIP)
+	if err != nil {
+		discard()
+		return err
+	}
+	sinks, err := event.NewSinks(i.logger, newConfig.Events, i.events.Sinks())
+	if err != nil {
+		discard()
+		return common.Cause("initialize event sinks: ", err)
+	}
+	err = i.updateRouting(newConfig, listProviders.Merge(newConfig.Lists), geoIPDatabases)
+	if err != nil {
+		discard()
+		event.CloseSinks(sinks, i.events.Sinks())
+		return err
+	}
+
+	// routing is updated, apply others
+	i.listProviders = listProviders
+	i.lists.Commit(listProviders)
+	i.geoIPDatabases = geoIPDatabases
+	i.geoIP.Commit(geoIPDatabases)
+	i.events.SetSinks(sinks)
+	i.accessLogger.Commit(accessLog)
+	i.commitMetricsServer(metricsServer, newConfig.Metrics)
+	if newConfig != i.config {
+		i.config.Apply(newConfig)
+	}
+	i.updateLogLevels(&newConfig.Log)
+	return nil
+}
+
+// refreshLists rebuilds the outbounds, router and services with the refreshed lists,
+// without reloading the whole config.
+// All of them are rebuilt, since outbounds and services also copy lists for access control.
+func (i *Instance) refreshLists() {
+	i.access.Lock()
+	defer i.access.Unlock()
+	if i.closed {
+		return
+	}
+	err := i.updateRouting(i.config, i.listProviders.Merge(i.config.Lists), i.geoIPDatabases)
 	if err != nil {
 		i.logger.Error().
 			Err(err).
-			Msg("Error when updating router")
-		return
+			Msg("Error when applying refreshed lists, keeping the old ones")
 	}
+}
 
-	// update services
-	newServiceMap := make(map[string]adapter.Service, len(i.config.Services))
-	for _, serviceConfig := range i.config.Services {
-		if oldService, ok := i.serviceMap[serviceConfig.Name]; ok {
-			err = oldService.Reload(i.ctx, serviceConfig)
-			if err != nil {
-				i.logger.Error().
-					Str("service", serviceConfig.Name).
-					Err(err).
-					Msg("Error when updating services")
-				return
+// updateRouting builds outbounds, router and services with newConfig, listMap and geoIP,
+// then applies them together if all of them succeed.
+func (i *Instance) updateRouting(newConfig *config.Root, listMap map[string]set.StringSet, geoIP *geoip.Databases) error {
+	options := i.routingOptions(newConfig, listMap, geoIP)
+	options.baseRouter = i.router
+	options.oldOutbounds = i.outboundMap
+	newOutboundMap, newRouter, err := buildRouting(options)
+	if err != nil {
+		return err
+	}
+
+	// prepare services, the running ones are not changed
+	newServiceMap := make(map[string]adapter.Service, len(newConfig.Services))
+	newServiceConfigs := make(map[string]*config.Service, len(newConfig.Services))
+	reloads := make([]adapter.ServiceReload, 0, len(newConfig.Services))
+	reloadedServices := make([]adapter.Service, 0, len(newConfig.Services))
+	discard := func(reloads []adapter.ServiceReload) {
+		for _, reload := range reloads {
+			reload.Discard()
+		}
+	}
+	for _, serviceConfig := range newConfig.Services {
+		if _, duplicated := newServiceMap[serviceConfig.Name]; duplicated {
+			discard(reloads)
+			return errors.New("duplicated service [" + serviceConfig.Name + "]")
+		}
+		s, exists := i.serviceMap[serviceConfig.Name]
+		if !exists {
+			s = service.NewService(i.loggers.service, i.accessLogger, serviceConfig)
+		}
+		reload, err := s.PrepareReload(i.ctx, serviceConfig, newRouter)
+		if err != nil {
+			discard(reloads)
+			return common.Cause("prepare service ["+serviceConfig.Name+"]: ", err)
+		}
+		reloads = append(reloads, reload)
+		reloadedServices = append(reloadedServices, s)
+		newServiceMap[serviceConfig.Name] = s
+		newServiceConfigs[serviceConfig.Name] = serviceConfig
+	}
+
+	// listeners re-bound on the same port can only be tried after closing the old ones,
+	// so they are applied first, and reverted if any of them fails
+	for index, reload := range reloads {
+		if !reload.RebindsInPlace() {
+			continue
+		}
+		err = reload.Apply()
+		if err == nil {
+			continue
+		}
+		for revertIndex, applied := range reloads[:index] {
+			if !applied.RebindsInPlace() {
+				applied.Discard()
+				continue
 			}
-			newServiceMap[serviceConfig.Name] = oldService
-		} else {
-			newService := service.NewService(i.logger, serviceConfig)
-			newService.UpdateRouter(i.router)
-			err = newService.Start(i.ctx)
-			if err != nil {
+			name := newConfig.Services[revertIndex].Name
+			revertErr := reloadedServices[revertIndex].Reload(i.ctx, i.serviceConfigs[name])
+			if revertErr != nil {
 				i.logger.Error().
-					Str("service", serviceConfig.Name).
-					Err(err).
-					Msg("Error when initializing services")
-				return
+					Str("service", name).
+					Err(revertErr).
+					Msg("Error when reverting service")
 			}
-			newServiceMap[serviceConfig.Name] = newService
 		}
+		discard(reloads[index+1:])
+		return common.Cause("reload service ["+newConfig.Services[index].Name+"]: ", err)
 	}
 
+	// everything is ready, apply them
+	i.router.Commit(newRouter)
+	for name, s := range i.serviceMap {
+		if _, exists := newServiceMap[name]; !exists {
+			s.Close()
+		}
+	}
+	for _, s := range newServiceMap {
+		s.UpdateRouter(i.router)
+	}
+	for _, reload := range reloads {
+		if !reload.RebindsInPlace() {
+			reload.Apply() // only re-binding in place can fail
+		}
+	}
 	i.outboundMap = newOutboundMap
 	i.serviceMap = newServiceMap
+	i.serviceConfigs = newServiceConfigs
+	return nil
+}
+
+// routingOptions returns the options to build the routing of newConfig with the registries of i.
+func (i *Instance) routingOptions(newConfig *config.Root, listMap map[string]set.StringSet, geoIP *geoip.Databases) routingOptions {
+	return routingOptions{
+		ctx:             i.ctx,
+		outboundLogger:  i.loggers.outbound,
+		routerLogger:    i.loggers.router,
+		config:          newConfig,
+		listMap:         listMap,
+		geoIP:           geoIP,
+		ruleRegistry:    i.ruleRegistry,
+		snifferRegistry: i.snifferRegistry,
+	}
+}
+
+// Shutdown stops accepting new connections, and waits for active connections
+// until the drain timeout in config elapses or ctx is done, then closes them.
+func (i *Instance) Shutdown(ctx context.Context) error {
+	startTime := time.Now()
+	i.config.Close()
+	i.access.Lock()
+	defer i.access.Unlock()
+	i.closed = true
+
+	var disconnectMessage string
+	if i.config.Shutdown != nil {
+		disconnectMessage = i.config.Shutdown.DisconnectMessage
+	}
+	for _, outbound := range i.outboundMap {
+		if drainOutbound, ok := outbound.(adapter.DrainOutbound); ok {
+			drainOutbound.Drain(disconnectMessage)
+		}
+	}
+	for _, s := range i.serviceMap {
+		if drainService, ok := s.(adapter.DrainService); ok {
+			drainService.Drain(disconnectMessage)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, i.config.Shutdown.GetDrainTimeout())
+	defer cancel()
+	i.logger.Info().
+		Msg("Shutting down, waiting for active connections")
+	errChan := make(chan error, len(i.serviceMap))
+	for _, s := range i.serviceMap {
+		go func(s adapter.Service) {
+			errChan <- s.Shutdown(ctx)
+		}(s)
+	}
+	var err error
+	for range i.serviceMap {
+		if shutdownErr := <-errChan; shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+
+	if i.metricsServer != nil {
+		i.metricsServer.Close()
+		i.metricsServer = nil
+	}
+	i.accessLogger.Close()
+	i.lists.Close()
+	i.geoIP.Close()
+	i.logger.Info().
+		Str("duration", time.Now().Sub(startTime).String()).
+		Msg("zbproxy stopped")
+	return err
 }
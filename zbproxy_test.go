@@ -0,0 +1,430 @@
+package zbproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/layou233/zbproxy/v3/adapter"
+	"github.com/layou233/zbproxy/v3/common/access"
+	"github.com/layou233/zbproxy/v3/common/jsonx"
+	"github.com/layou233/zbproxy/v3/common/network"
+	"github.com/layou233/zbproxy/v3/common/set"
+	"github.com/layou233/zbproxy/v3/config"
+	"github.com/layou233/zbproxy/v3/event"
+	"github.com/layou233/zbproxy/v3/route"
+	"github.com/layou233/zbproxy/v3/service"
+
+	"github.com/phuslu/log"
+)
+
+var discardWriter = &log.IOWriter{Writer: io.Discard}
+
+// holdOutbound hands every dialed connection to the test instead of connecting anywhere.
+type holdOutbound struct {
+	conns chan net.Conn
+}
+
+func (o *holdOutbound) Name() string { return "hold" }
+
+func (o *holdOutbound) PostInitialize(adapter.Router) error { return nil }
+
+func (o *holdOutbound) Reload(*config.Outbound) error { return nil }
+
+func (o *holdOutbound) DialContext(context.Context, string, string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	o.conns <- remote
+	return local, nil
+}
+
+// startHoldInstance starts an instance with one service routing everything to a holdOutbound,
+// and returns the address of the service.
+func startHoldInstance(t *testing.T, shutdownConfig *config.Shutdown) (*Instance, *holdOutbound, string) {
+	t.Helper()
+	serviceConfig := &config.Service{
+		Name:          "hold",
+		TargetAddress: "backend.internal",
+		TargetPort:    25565,
+	}
+	i, err := NewInstance(context.Background(), Options{
+		Config: &config.Root{
+			Services: []*config.Service{serviceConfig},
+			Router:   config.Router{DefaultOutbound: "hold"},
+			Shutdown: shutdownConfig,
+		},
+		LogWriter: discardWriter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound := &holdOutbound{conns: make(chan net.Conn, 1)}
+	i.outboundMap = map[string]adapter.Outbound{"hold": outbound}
+	i.router = &route.Router{}
+	err = i.router.Initialize(i.ctx, i.loggers.router, route.RouterOptions{
+		Config:      &i.config.Router,
+		OutboundMap: i.outboundMap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := service.NewService(i.loggers.service, i.accessLogger, serviceConfig)
+	s.UpdateRouter(i.router)
+	err = s.Start(i.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.serviceMap = map[string]adapter.Service{serviceConfig.Name: s}
+	_, listener := s.HandoffListener()
+	return i, outbound, listener.Addr().String()
+}
+
+func TestShutdownDrain(t *testing.T) {
+	i, outbound, address := startHoldInstance(t, &config.Shutdown{
+		DrainTimeout: jsonx.Duration(5 * time.Second),
+	})
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	backend := <-outbound.conns
+
+	// the relay finishes by itself before the drain timeout
+	const relayTime = 100 * time.Millisecond
+	go func() {
+		time.Sleep(relayTime)
+		backend.Close()
+	}()
+	startTime := time.Now()
+	err = i.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if duration := time.Since(startTime); duration < relayTime || duration > 4*time.Second {
+		t.Errorf("shutdown took %s, want to wait for the relay of %s", duration, relayTime)
+	}
+	_, err = net.DialTimeout("tcp", address, time.Second)
+	if err == nil {
+		t.Error("service is still accepting after shutdown")
+	}
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	const drainTimeout = 100 * time.Millisecond
+	i, outbound, address := startHoldInstance(t, &config.Shutdown{
+		DrainTimeout: jsonx.Duration(drainTimeout),
+	})
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	backend := <-outbound.conns
+	defer backend.Close()
+
+	startTime := time.Now()
+	err = i.Shutdown(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown returned %v, want the drain timeout", err)
+	}
+	if duration := time.Since(startTime); duration < drainTimeout || duration > 4*time.Second {
+		t.Errorf("shutdown took %s, want about %s", duration, drainTimeout)
+	}
+
+	// the held connection is closed
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+		t.Errorf("client connection is not closed after the drain timeout: %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// freePort returns a port which is not in use.
+// It is chosen below the ephemeral port range of common systems,
+// so that it does not collide with the local ports of client connections.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	for attempt := 0; attempt < 100; attempt++ {
+		port := 20000 + rand.Intn(12000)
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			listener.Close()
+			return uint16(port)
+		}
+	}
+	t.Fatal("no free port is found")
+	return 0
+}
+
+// isListening reports whether the port is accepting,
+// the connection may be reset by the service immediately.
+func isListening(port uint16) bool {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(int(port)), time.Second)
+	if err != nil {
+		return !errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return true
+}
+
+// startInstance starts an instance with the config, the services should reset all connections.
+func startInstance(t *testing.T, rootConfig *config.Root) *Instance {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	i, err := NewInstance(ctx, Options{
+		Config:    rootConfig,
+		LogWriter: discardWriter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+		defer shutdownCancel()
+		i.Shutdown(shutdownCtx)
+	})
+	return i
+}
+
+func TestApplyConfigRollback(t *testing.T) {
+	oldPort, newPort, busyPort := freePort(t), freePort(t), freePort(t)
+	busyListener, err := net.Listen("tcp", ":"+strconv.Itoa(int(busyPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busyListener.Close()
+
+	oldConfig := &config.Root{
+		Services: []*config.Service{{Name: "a", Listen: oldPort}},
+		Router:   config.Router{DefaultOutbound: "RESET"},
+	}
+	i := startInstance(t, oldConfig)
+	oldServices := oldConfig.Services
+	failures := make(chan *event.Event, 1)
+	i.Events().Subscribe(func(e *event.Event) {
+		if e.Type == event.TypeConfigReloadFailed {
+			failures <- e
+		}
+	})
+
+	// the new service b is bound first, then a fails to bind the port in use
+	err = i.ApplyConfig(&config.Root{
+		Services: []*config.Service{
+			{Name: "b", Listen: newPort},
+			{Name: "a", Listen: busyPort},
+		},
+		Router: config.Router{DefaultOutbound: "REJECT"},
+		Lists:  map[string]set.StringSet{"new": set.NewStringSetFromSlice([]string{"Steve"})},
+	})
+	if err == nil {
+		t.Fatal("applying a service on a port in use succeeds")
+	}
+	if !strings.Contains(err.Error(), "prepare service [a]") {
+		t.Errorf("error does not name the failed service: %v", err)
+	}
+
+	if !isListening(oldPort) {
+		t.Error("old service is not listening after rollback")
+	}
+	if isListening(newPort) {
+		t.Error("listener of the new service is not released after rollback")
+	}
+	if len(i.config.Services) != 1 || i.config.Services[0] != oldServices[0] ||
+		i.config.Router.DefaultOutbound != "RESET" {
+		t.Error("config is changed after rollback")
+	}
+	if len(i.serviceMap) != 1 || i.serviceConfigs["a"] != oldServices[0] {
+		t.Errorf("services are changed after rollback: %v", i.serviceMap)
+	}
+	if _, err = i.router.FindListsByTag([]string{"new"}); err == nil {
+		t.Error("router is changed after rollback")
+	}
+	select {
+	case e := <-failures:
+		if !strings.Contains(e.Reason, "prepare service [a]") {
+			t.Errorf("reload failure event has reason %q", e.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("reload failure event is not emitted")
+	}
+
+	// the same config without the conflict is applied
+	err = i.ApplyConfig(&config.Root{
+		Services: []*config.Service{
+			{Name: "b", Listen: newPort},
+			{Name: "a", Listen: oldPort},
+		},
+		Router: config.Router{DefaultOutbound: "REJECT"},
+		Lists:  map[string]set.StringSet{"new": set.NewStringSetFromSlice([]string{"Steve"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isListening(oldPort) || !isListening(newPort) {
+		t.Error("services are not listening after applying")
+	}
+	if _, err = i.router.FindListsByTag([]string{"new"}); err != nil {
+		t.Errorf("router is not updated: %v", err)
+	}
+}
+
+func TestApplyConfigRevertRebind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("unknown TCP congestion algorithms only fail on Linux")
+	}
+	portA, portB := freePort(t), freePort(t)
+	oldConfig := &config.Root{
+		Services: []*config.Service{
+			{Name: "a", Listen: portA},
+			{Name: "b", Listen: portB},
+		},
+		Router: config.Router{DefaultOutbound: "RESET"},
+	}
+	i := startInstance(t, oldConfig)
+	oldServices := oldConfig.Services
+
+	// a is re-bound with keep alive options, then b fails and a is reverted
+	err := i.ApplyConfig(&config.Root{
+		Services: []*config.Service{
+			{Name: "a", Listen: portA, SocketOptions: &network.InboundSocketOptions{}},
+			{Name: "b", Listen: portB, SocketOptions: &network.InboundSocketOptions{TCPCongestion: "no-such-algorithm"}},
+		},
+		Router: config.Router{DefaultOutbound: "RESET"},
+	})
+	if err == nil {
+		t.Fatal("re-binding with a bad congestion algorithm succeeds")
+	}
+	if !strings.Contains(err.Error(), "reload service [b]") {
+		t.Errorf("error does not name the failed service: %v", err)
+	}
+	if !isListening(portA) || !isListening(portB) {
+		t.Error("services are not listening after reverting")
+	}
+	if i.serviceConfigs["a"] != oldServices[0] || i.serviceConfigs["b"] != oldServices[1] ||
+		i.config.Services[0] != oldServices[0] {
+		t.Error("config is changed after reverting")
+	}
+}
+
+func TestUpdateConfigLegacyHandler(t *testing.T) {
+	oldPort, newPort := freePort(t), freePort(t)
+	i := startInstance(t, &config.Root{
+		Services: []*config.Service{{Name: "a", Listen: oldPort}},
+		Router:   config.Router{DefaultOutbound: "RESET"},
+	})
+
+	// handlers set by SetUpdateHandler are called after the config is replaced
+	i.config.Apply(&config.Root{
+		Services: []*config.Service{{Name: "a", Listen: newPort}},
+		Router:   config.Router{DefaultOutbound: "RESET"},
+	})
+	i.UpdateConfig()
+	if !isListening(newPort) || isListening(oldPort) {
+		t.Error("service is not moved to the new port")
+	}
+	if i.serviceConfigs["a"].Listen != newPort {
+		t.Error("service config is not updated")
+	}
+}
+
+func TestRefreshListsUpdatesAccess(t *testing.T) {
+	directory := t.TempDir()
+	listPath := filepath.Join(directory, "blocked.txt")
+	accessLogPath := filepath.Join(directory, "access.log")
+	err := os.WriteFile(listPath, []byte("192.0.2.1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	serviceConfig := &config.Service{}
+	err = json.Unmarshal([]byte(`{"Name": "a", "Listen": `+strconv.Itoa(int(port))+`,
+  "IPAccess": {"Mode": "block", "ListTags": ["blocked"]}}`), serviceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startInstance(t, &config.Root{
+		Services: []*config.Service{serviceConfig},
+		Router:   config.Router{DefaultOutbound: "REJECT"},
+		ListProviders: map[string]*config.ListProvider{
+			"blocked": {Path: listPath, Interval: jsonx.Duration(10 * time.Millisecond)},
+		},
+		AccessLog: &config.LogFile{Path: accessLogPath},
+	})
+
+	// rejected reports whether a new connection is rejected by the access control,
+	// by reading its record in the access log
+	records := 0
+	rejected := func() bool {
+		t.Helper()
+		// rejected connections can be reset before dialing returns
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+		if err == nil {
+			conn.Close()
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			content, _ := os.ReadFile(accessLogPath)
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			if len(content) > 0 && len(lines) > records {
+				records = len(lines)
+				var record struct{ Reason string }
+				err = json.Unmarshal([]byte(lines[len(lines)-1]), &record)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return record.Reason == access.ErrRejected.Error()
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatal("connection is not logged")
+		return false
+	}
+	// waitRejected waits until the refreshed list is applied
+	waitRejected := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for rejected() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("rejected is not %v after refreshing the list", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if rejected() {
+		t.Fatal("connection is rejected before blocking")
+	}
+	err = os.WriteFile(listPath, []byte("192.0.2.1\n127.0.0.1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRejected(true)
+	err = os.WriteFile(listPath, []byte("192.0.2.1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRejected(false)
+}